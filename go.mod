@@ -7,8 +7,12 @@ require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/gorilla/mux v1.7.4
 	github.com/julienschmidt/httprouter v1.3.0
+	github.com/lib/pq v1.9.0
 	github.com/segmentio/ksuid v1.0.3
 	github.com/sirupsen/logrus v1.6.0
 	github.com/urfave/negroni v1.0.0
 	go.mongodb.org/mongo-driver v1.4.0
+	golang.org/x/crypto v0.0.0-20210513164829-c07d793c2f9a
+	gopkg.in/yaml.v2 v2.4.0
+	modernc.org/sqlite v1.10.8
 )
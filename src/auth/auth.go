@@ -2,11 +2,8 @@ package auth
 
 import (
 	"encoding/json"
-	"github.com/dgrijalva/jwt-go"
 	"net/http"
-	"net/url"
 	"shoppinglist-server/src/credentials"
-	"shoppinglist-server/src/logic"
 	slUtils "shoppinglist-server/src/utils"
 )
 
@@ -15,29 +12,23 @@ type credentialInfo struct {
 	Password string `json:"password"`
 }
 
+// CookieOptions configure the cookies the tokens are stored in
+type CookieOptions struct {
+	Domain   string
+	Secure   bool
+	SameSite http.SameSite
+}
+
 type loginHandler struct {
 	cred   credentials.CredController
-	secret []byte
+	tokens *TokenIssuer
 }
 type registrationHandler struct {
-	cred   credentials.CredController
-	secret []byte
+	cred    credentials.CredController
+	tokens  *TokenIssuer
+	newUser func(username string) error
 }
 
-func setJWTCookie(writer http.ResponseWriter, username string, secret []byte) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": username,
-	})
-	tokenString, _ := token.SignedString(secret)
-	tokenString = url.QueryEscape(tokenString)
-	http.SetCookie(writer, &http.Cookie{
-		Name:     "jwt",
-		Value:    tokenString,
-		Path:     "/",
-		HttpOnly: true,
-		SameSite: 1,
-	})
-}
 func (r registrationHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	var creds credentialInfo
 	err := json.NewDecoder(request.Body).Decode(&creds)
@@ -51,13 +42,17 @@ func (r registrationHandler) ServeHTTP(writer http.ResponseWriter, request *http
 		_, _ = writer.Write(slUtils.NewWrappedError("username is already taken"))
 		return
 	}
-	err = logic.InitNewUser(creds.Username)
+	err = r.newUser(creds.Username)
 	if err != nil {
 		writer.WriteHeader(http.StatusInternalServerError)
 		_, _ = writer.Write(slUtils.WrapError(err))
+		return
 	}
 	// User has provided correct credentials and needs JWT to be set
-	setJWTCookie(writer, creds.Username, r.secret)
+	if err = r.tokens.startSession(writer, creds.Username); err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		_, _ = writer.Write(slUtils.WrapError(err))
+	}
 }
 
 func (l loginHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
@@ -74,18 +69,24 @@ func (l loginHandler) ServeHTTP(writer http.ResponseWriter, request *http.Reques
 		return
 	}
 	// User has provided correct credentials and needs JWT to be set
-	setJWTCookie(writer, creds.Username, l.secret)
+	if err = l.tokens.startSession(writer, creds.Username); err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		_, _ = writer.Write(slUtils.WrapError(err))
+	}
 }
 
-func NewLoginHandler(cred credentials.CredController, secret []byte) http.Handler {
+func NewLoginHandler(cred credentials.CredController, tokens *TokenIssuer) http.Handler {
 	return loginHandler{
 		cred:   cred,
-		secret: secret,
+		tokens: tokens,
 	}
 }
-func NewRegistrationHandler(cred credentials.CredController, secret []byte) http.Handler {
+
+// NewRegistrationHandler creates a handler which calls newUser to set up the data of a registered user
+func NewRegistrationHandler(cred credentials.CredController, tokens *TokenIssuer, newUser func(username string) error) http.Handler {
 	return registrationHandler{
-		cred:   cred,
-		secret: secret,
+		cred:    cred,
+		tokens:  tokens,
+		newUser: newUser,
 	}
 }
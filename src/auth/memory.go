@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+type memoryTokenStore struct {
+	mutex   sync.Mutex
+	refresh map[string]RefreshToken
+	revoked map[string]time.Time
+}
+
+// NewMemoryTokenStore keeps tokens in the process, all sessions are lost on restart
+func NewMemoryTokenStore() TokenStore {
+	return &memoryTokenStore{
+		refresh: make(map[string]RefreshToken),
+		revoked: make(map[string]time.Time),
+	}
+}
+
+func (s *memoryTokenStore) SaveRefreshToken(token RefreshToken) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// Expired tokens are dropped here instead of by a TTL index
+	now := time.Now()
+	for hash, stored := range s.refresh {
+		if stored.Expires.Before(now) {
+			delete(s.refresh, hash)
+		}
+	}
+	s.refresh[token.Hash] = token
+	return nil
+}
+
+func (s *memoryTokenStore) UseRefreshToken(hash string) (*RefreshToken, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	token, ok := s.refresh[hash]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	if token.Used {
+		return &token, ErrTokenReused
+	}
+	if !token.Expires.After(time.Now()) {
+		return nil, ErrTokenNotFound
+	}
+	token.Used = true
+	s.refresh[hash] = token
+	return &token, nil
+}
+
+func (s *memoryTokenStore) RevokeSession(session string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for hash, token := range s.refresh {
+		if token.Session == session {
+			delete(s.refresh, hash)
+		}
+	}
+	return nil
+}
+
+func (s *memoryTokenStore) RevokeAccessToken(id string, expires time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	for revokedId, revokedExpires := range s.revoked {
+		if revokedExpires.Before(now) {
+			delete(s.revoked, revokedId)
+		}
+	}
+	s.revoked[id] = expires
+	return nil
+}
+
+func (s *memoryTokenStore) IsAccessTokenRevoked(id string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.revoked[id]
+	return ok, nil
+}
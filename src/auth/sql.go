@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"database/sql"
+	"shoppinglist-server/src/sqldb"
+	"time"
+)
+
+type sqlTokenStore struct {
+	db *sqldb.DB
+}
+
+func NewSQLTokenStore(db *sqldb.DB) TokenStore {
+	return sqlTokenStore{db: db}
+}
+
+func (s sqlTokenStore) SaveRefreshToken(token RefreshToken) error {
+	return s.db.InTx(func(tx *sqldb.Tx) error {
+		// Expired tokens are dropped here instead of by a TTL index
+		_, err := tx.Exec(`DELETE FROM refresh_tokens WHERE expires < ?`, sqldb.Nanos(time.Now()))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO refresh_tokens (hash, username, session, used, expires) VALUES (?, ?, ?, ?, ?)`,
+			token.Hash, token.Username, token.Session, token.Used, sqldb.Nanos(token.Expires))
+		return err
+	})
+}
+
+func (s sqlTokenStore) UseRefreshToken(hash string) (*RefreshToken, error) {
+	var token RefreshToken
+	var expires int64
+	var result error
+	err := s.db.InTx(func(tx *sqldb.Tx) error {
+		err := tx.QueryRow(`SELECT hash, username, session, used, expires FROM refresh_tokens WHERE hash = ?`, hash).
+			Scan(&token.Hash, &token.Username, &token.Session, &token.Used, &expires)
+		if err == sql.ErrNoRows {
+			result = ErrTokenNotFound
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		token.Expires = sqldb.FromNanos(expires)
+		if token.Used {
+			result = ErrTokenReused
+			return nil
+		}
+		if !token.Expires.After(time.Now()) {
+			result = ErrTokenNotFound
+			return nil
+		}
+		// The condition on used makes concurrent uses of the same token fail
+		updated, err := sqldb.Affected(tx.Exec(`UPDATE refresh_tokens SET used = ? WHERE hash = ? AND used = ?`, true, hash, false))
+		if err != nil {
+			return err
+		}
+		if updated != 1 {
+			result = ErrTokenReused
+		}
+		token.Used = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result == ErrTokenNotFound {
+		return nil, result
+	}
+	return &token, result
+}
+
+func (s sqlTokenStore) RevokeSession(session string) error {
+	_, err := s.db.Exec(`DELETE FROM refresh_tokens WHERE session = ?`, session)
+	return err
+}
+
+func (s sqlTokenStore) RevokeAccessToken(id string, expires time.Time) error {
+	return s.db.InTx(func(tx *sqldb.Tx) error {
+		// Revoked tokens are only remembered until they would expire anyway
+		_, err := tx.Exec(`DELETE FROM revoked_tokens WHERE expires < ?`, sqldb.Nanos(time.Now()))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO revoked_tokens (id, expires) VALUES (?, ?) ON CONFLICT (id) DO NOTHING`,
+			id, sqldb.Nanos(expires))
+		return err
+	})
+}
+
+func (s sqlTokenStore) IsAccessTokenRevoked(id string) (bool, error) {
+	var count int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM revoked_tokens WHERE id = ?`, id).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/x/bsonx"
+	"time"
+)
+
+var ErrTokenNotFound = errors.New("refresh token not found")
+var ErrTokenReused = errors.New("refresh token was already used")
+
+// RefreshToken is stored by hash, so leaked database contents can't be used to sign in.
+// All tokens issued by rotation of the same login share the session id.
+type RefreshToken struct {
+	Hash     string    `bson:"hash"`
+	Username string    `bson:"username"`
+	Session  string    `bson:"session"`
+	Used     bool      `bson:"used"`
+	Expires  time.Time `bson:"expires"`
+}
+
+// TokenStore keeps refresh tokens and revoked access tokens
+type TokenStore interface {
+	SaveRefreshToken(token RefreshToken) error
+	// UseRefreshToken marks the token as used and returns it.
+	// Returns ErrTokenReused if it had been used before, ErrTokenNotFound if it doesn't exist or is expired.
+	UseRefreshToken(hash string) (*RefreshToken, error)
+	RevokeSession(session string) error
+	RevokeAccessToken(id string, expires time.Time) error
+	IsAccessTokenRevoked(id string) (bool, error)
+}
+
+type mongoTokenStore struct {
+	refreshCollection *mongo.Collection
+	revokedCollection *mongo.Collection
+}
+
+func NewMongoTokenStore(url, databaseName, refreshCollectionName, revokedCollectionName string, timeout time.Duration) (TokenStore, error) {
+	client, err := mongo.NewClient(options.Client().ApplyURI(url))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err = client.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = client.Ping(ctx, readpref.Primary())
+	if err != nil {
+		return nil, err
+	}
+	refreshCollection := client.Database(databaseName).Collection(refreshCollectionName)
+	_, err = refreshCollection.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys:    bsonx.Doc{{"hash", bsonx.Int32(1)}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bsonx.Doc{{"session", bsonx.Int32(1)}},
+		},
+		{
+			Keys:    bsonx.Doc{{"expires", bsonx.Int32(1)}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	revokedCollection := client.Database(databaseName).Collection(revokedCollectionName)
+	_, err = revokedCollection.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys:    bsonx.Doc{{"id", bsonx.Int32(1)}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			// Revoked tokens are only remembered until they would expire anyway
+			Keys:    bsonx.Doc{{"expires", bsonx.Int32(1)}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mongoTokenStore{
+		refreshCollection: refreshCollection,
+		revokedCollection: revokedCollection,
+	}, nil
+}
+
+func (s mongoTokenStore) SaveRefreshToken(token RefreshToken) error {
+	_, err := s.refreshCollection.InsertOne(context.TODO(), token)
+	return err
+}
+
+func (s mongoTokenStore) UseRefreshToken(hash string) (*RefreshToken, error) {
+	res := s.refreshCollection.FindOneAndUpdate(context.TODO(),
+		bson.D{{"hash", hash}, {"used", false}, {"expires", bson.D{{"$gt", time.Now()}}}},
+		bson.D{{"$set", bson.D{{"used", true}}}})
+	if res.Err() == mongo.ErrNoDocuments {
+		used := s.refreshCollection.FindOne(context.TODO(), bson.D{{"hash", hash}, {"used", true}})
+		if used.Err() == nil {
+			var token RefreshToken
+			if err := used.Decode(&token); err != nil {
+				return nil, err
+			}
+			return &token, ErrTokenReused
+		}
+		return nil, ErrTokenNotFound
+	}
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+	var token RefreshToken
+	err := res.Decode(&token)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (s mongoTokenStore) RevokeSession(session string) error {
+	_, err := s.refreshCollection.DeleteMany(context.TODO(), bson.D{{"session", session}})
+	return err
+}
+
+func (s mongoTokenStore) RevokeAccessToken(id string, expires time.Time) error {
+	_, err := s.revokedCollection.UpdateOne(context.TODO(),
+		bson.D{{"id", id}},
+		bson.D{{"$set", bson.D{{"id", id}, {"expires", expires}}}},
+		options.Update().SetUpsert(true))
+	return err
+}
+
+func (s mongoTokenStore) IsAccessTokenRevoked(id string) (bool, error) {
+	count, err := s.revokedCollection.CountDocuments(context.TODO(), bson.D{{"id", id}})
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/segmentio/ksuid"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	slUtils "shoppinglist-server/src/utils"
+	"time"
+)
+
+const accessCookieName = "jwt"
+const refreshCookieName = "refresh"
+
+// refreshCookiePath limits the refresh token to the endpoints that need it
+const refreshCookiePath = "/v1/user/"
+
+// TokenIssuer signs access tokens and rotates refresh tokens
+type TokenIssuer struct {
+	secret     []byte
+	cookie     CookieOptions
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	store      TokenStore
+}
+
+func NewTokenIssuer(secret []byte, cookie CookieOptions, accessTTL, refreshTTL time.Duration, store TokenStore) *TokenIssuer {
+	return &TokenIssuer{
+		secret:     secret,
+		cookie:     cookie,
+		accessTTL:  accessTTL,
+		refreshTTL: refreshTTL,
+		store:      store,
+	}
+}
+
+// TokenFromCookie extracts the access token from the request cookie
+func TokenFromCookie(r *http.Request) (string, error) {
+	cookie, err := r.Cookie(accessCookieName)
+	if err != nil {
+		return "", err
+	}
+	token, err := url.QueryUnescape(cookie.Value)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (t *TokenIssuer) setCookie(w http.ResponseWriter, name, value, path string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   t.cookie.Domain,
+		Secure:   t.cookie.Secure,
+		HttpOnly: true,
+		SameSite: t.cookie.SameSite,
+		MaxAge:   maxAge,
+	})
+}
+
+// issue sets cookies with a new access token and a new refresh token of the session
+func (t *TokenIssuer) issue(w http.ResponseWriter, username, session string) error {
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"username": username,
+		"iat":      now.Unix(),
+		"exp":      now.Add(t.accessTTL).Unix(),
+		"jti":      ksuid.New().String(),
+	})
+	tokenString, err := token.SignedString(t.secret)
+	if err != nil {
+		return err
+	}
+	random := make([]byte, 32)
+	if _, err = rand.Read(random); err != nil {
+		return err
+	}
+	refresh := base64.RawURLEncoding.EncodeToString(random)
+	err = t.store.SaveRefreshToken(RefreshToken{
+		Hash:     hashRefreshToken(refresh),
+		Username: username,
+		Session:  session,
+		Expires:  now.Add(t.refreshTTL),
+	})
+	if err != nil {
+		return err
+	}
+	t.setCookie(w, accessCookieName, url.QueryEscape(tokenString), "/", 0)
+	t.setCookie(w, refreshCookieName, refresh, refreshCookiePath, int(t.refreshTTL.Seconds()))
+	return nil
+}
+
+// startSession issues tokens after the user has provided correct credentials
+func (t *TokenIssuer) startSession(w http.ResponseWriter, username string) error {
+	return t.issue(w, username, ksuid.New().String())
+}
+
+func (t *TokenIssuer) clearCookies(w http.ResponseWriter) {
+	t.setCookie(w, accessCookieName, "", "/", -1)
+	t.setCookie(w, refreshCookieName, "", refreshCookiePath, -1)
+}
+
+func unauthorized(w http.ResponseWriter, message string) {
+	w.WriteHeader(http.StatusUnauthorized)
+	_, _ = w.Write(slUtils.NewWrappedError(message))
+}
+
+type refreshHandler struct {
+	tokens *TokenIssuer
+}
+
+func (h refreshHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	cookie, err := request.Cookie(refreshCookieName)
+	if err != nil {
+		unauthorized(writer, "no refresh token")
+		return
+	}
+	token, err := h.tokens.store.UseRefreshToken(hashRefreshToken(cookie.Value))
+	if err == ErrTokenReused {
+		// Somebody else has a copy of the token, so neither copy can be trusted
+		log.Warningln("Refresh token of", token.Username, "was reused, revoking session", token.Session)
+		if err = h.tokens.store.RevokeSession(token.Session); err != nil {
+			log.Errorln(err)
+		}
+		h.tokens.clearCookies(writer)
+		unauthorized(writer, "session was revoked")
+		return
+	}
+	if err == ErrTokenNotFound {
+		h.tokens.clearCookies(writer)
+		unauthorized(writer, "invalid refresh token")
+		return
+	}
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		_, _ = writer.Write(slUtils.WrapError(err))
+		return
+	}
+	err = h.tokens.issue(writer, token.Username, token.Session)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		_, _ = writer.Write(slUtils.WrapError(err))
+	}
+}
+
+type logoutHandler struct {
+	tokens *TokenIssuer
+}
+
+func (h logoutHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if tokenString, err := TokenFromCookie(request); err == nil {
+		token, err := jwt.Parse(tokenString, h.tokens.keyFunc)
+		// Expired tokens are revoked as well, other tokens may be forged
+		if err == nil || onlyExpired(err) {
+			if err = h.tokens.revokeAccessToken(token); err != nil {
+				log.Errorln(err)
+			}
+		}
+	}
+	if cookie, err := request.Cookie(refreshCookieName); err == nil {
+		token, err := h.tokens.store.UseRefreshToken(hashRefreshToken(cookie.Value))
+		if token != nil {
+			err = h.tokens.store.RevokeSession(token.Session)
+		}
+		if err != nil && err != ErrTokenNotFound {
+			log.Errorln(err)
+		}
+	}
+	h.tokens.clearCookies(writer)
+}
+
+func (t *TokenIssuer) keyFunc(token *jwt.Token) (interface{}, error) {
+	if token.Method != jwt.SigningMethodHS256 {
+		return nil, errors.New("unexpected signing method")
+	}
+	return t.secret, nil
+}
+
+func onlyExpired(err error) bool {
+	validationErr, ok := err.(*jwt.ValidationError)
+	return ok && validationErr.Errors == jwt.ValidationErrorExpired
+}
+
+func (t *TokenIssuer) revokeAccessToken(token *jwt.Token) error {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil
+	}
+	id, hasId := claims["jti"].(string)
+	exp, hasExp := claims["exp"].(float64)
+	if !hasId || !hasExp {
+		// Such tokens are rejected anyway
+		return nil
+	}
+	return t.store.RevokeAccessToken(id, time.Unix(int64(exp), 0))
+}
+
+// CheckRevoked must run after the JWT middleware.
+// It rejects tokens without expiration, issued before expiration was introduced, and tokens revoked by logout.
+func (t *TokenIssuer) CheckRevoked(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	token, ok := r.Context().Value("user").(*jwt.Token)
+	if !ok {
+		unauthorized(w, "missing token")
+		return
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		unauthorized(w, "invalid token")
+		return
+	}
+	id, hasId := claims["jti"].(string)
+	_, hasExp := claims["exp"].(float64)
+	if !hasId || !hasExp {
+		unauthorized(w, "token has no expiration, sign in again")
+		return
+	}
+	revoked, err := t.store.IsAccessTokenRevoked(id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(slUtils.WrapError(err))
+		return
+	}
+	if revoked {
+		unauthorized(w, "token was revoked")
+		return
+	}
+	next(w, r)
+}
+
+func NewRefreshHandler(tokens *TokenIssuer) http.Handler {
+	return refreshHandler{tokens: tokens}
+}
+
+func NewLogoutHandler(tokens *TokenIssuer) http.Handler {
+	return logoutHandler{tokens: tokens}
+}
@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"context"
+	"github.com/dgrijalva/jwt-go"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newTestIssuer(accessTTL time.Duration) *TokenIssuer {
+	return NewTokenIssuer([]byte("secret"), CookieOptions{}, accessTTL, time.Hour, NewMemoryTokenStore())
+}
+
+// responseCookie returns the value of the cookie set by the response
+func responseCookie(t *testing.T, w *httptest.ResponseRecorder, name string) string {
+	t.Helper()
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie.Value
+		}
+	}
+	t.Fatalf("response has no %s cookie", name)
+	return ""
+}
+
+func refresh(tokens *TokenIssuer, refreshToken string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/v1/user/refresh", nil)
+	r.AddCookie(&http.Cookie{Name: refreshCookieName, Value: refreshToken})
+	w := httptest.NewRecorder()
+	NewRefreshHandler(tokens).ServeHTTP(w, r)
+	return w
+}
+
+func startTestSession(t *testing.T, tokens *TokenIssuer) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	if err := tokens.startSession(w, "katya"); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// tokenId returns the jti claim of the access token set by the response
+func tokenId(t *testing.T, tokens *TokenIssuer, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	tokenString, err := url.QueryUnescape(responseCookie(t, w, accessCookieName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Parse(tokenString, tokens.keyFunc)
+	if err != nil && !onlyExpired(err) {
+		t.Fatal(err)
+	}
+	return token.Claims.(jwt.MapClaims)["jti"].(string)
+}
+
+func TestRefreshRotatesTokens(t *testing.T) {
+	tokens := newTestIssuer(time.Minute)
+	first := responseCookie(t, startTestSession(t, tokens), refreshCookieName)
+
+	w := refresh(tokens, first)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d", w.Code)
+	}
+	second := responseCookie(t, w, refreshCookieName)
+	if second == first {
+		t.Fatal("refresh token is not rotated")
+	}
+	w = refresh(tokens, second)
+	if w.Code != http.StatusOK {
+		t.Fatalf("rotated token got status %d", w.Code)
+	}
+	if w = refresh(tokens, "unknown"); w.Code != http.StatusUnauthorized {
+		t.Errorf("unknown token got status %d", w.Code)
+	}
+}
+
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	tokens := newTestIssuer(time.Minute)
+	other := responseCookie(t, startTestSession(t, tokens), refreshCookieName)
+	first := responseCookie(t, startTestSession(t, tokens), refreshCookieName)
+	second := responseCookie(t, refresh(tokens, first), refreshCookieName)
+
+	// The stolen copy of the first token is used after the owner has rotated it
+	w := refresh(tokens, first)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("reused token got status %d", w.Code)
+	}
+	if responseCookie(t, w, refreshCookieName) != "" {
+		t.Error("refresh cookie is not cleared")
+	}
+	if w = refresh(tokens, second); w.Code != http.StatusUnauthorized {
+		t.Errorf("token of the revoked session got status %d", w.Code)
+	}
+	if w = refresh(tokens, other); w.Code != http.StatusOK {
+		t.Errorf("token of another session got status %d", w.Code)
+	}
+}
+
+func TestLogoutRevokesExpiredToken(t *testing.T) {
+	tokens := newTestIssuer(-time.Minute)
+	session := startTestSession(t, tokens)
+	id := tokenId(t, tokens, session)
+
+	r := httptest.NewRequest("POST", "/v1/user/logout", nil)
+	r.AddCookie(&http.Cookie{Name: accessCookieName, Value: responseCookie(t, session, accessCookieName)})
+	r.AddCookie(&http.Cookie{Name: refreshCookieName, Value: responseCookie(t, session, refreshCookieName)})
+	NewLogoutHandler(tokens).ServeHTTP(httptest.NewRecorder(), r)
+	revoked, err := tokens.store.IsAccessTokenRevoked(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !revoked {
+		t.Error("expired token is not revoked")
+	}
+	if w := refresh(tokens, responseCookie(t, session, refreshCookieName)); w.Code != http.StatusUnauthorized {
+		t.Errorf("refresh after logout got status %d", w.Code)
+	}
+}
+
+func TestCheckRevoked(t *testing.T) {
+	tokens := newTestIssuer(time.Minute)
+	if err := tokens.store.RevokeAccessToken("revoked", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	exp := float64(time.Now().Add(time.Minute).Unix())
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		status int
+	}{
+		{"valid", jwt.MapClaims{"username": "katya", "exp": exp, "jti": "valid"}, http.StatusOK},
+		{"no expiration", jwt.MapClaims{"username": "katya", "jti": "valid"}, http.StatusUnauthorized},
+		{"no id", jwt.MapClaims{"username": "katya", "exp": exp}, http.StatusUnauthorized},
+		{"revoked", jwt.MapClaims{"username": "katya", "exp": exp, "jti": "revoked"}, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, test.claims)
+			r := httptest.NewRequest("GET", "/v1/lists/owned", nil)
+			r = r.WithContext(context.WithValue(r.Context(), "user", token))
+			w := httptest.NewRecorder()
+			called := false
+			tokens.CheckRevoked(w, r, func(http.ResponseWriter, *http.Request) {
+				called = true
+			})
+			if w.Code != test.status || called != (test.status == http.StatusOK) {
+				t.Errorf("got status %d, next called %v", w.Code, called)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"shoppinglist-server/src/logic"
+)
+
+// runCommand runs an administrative command instead of the server and returns the exit code
+func runCommand(service *logic.Service, args []string) int {
+	switch args[0] {
+	case "check":
+		return runCheck(service, args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q, available commands: check\n", args[0])
+	return 2
+}
+
+// runCheck reports inconsistencies between lists and access records.
+// It only shows how they would be repaired unless -fix is given.
+func runCheck(service *logic.Service, args []string) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	fix := flags.Bool("fix", false, "repair inconsistencies instead of a dry run")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	issues, err := service.CheckConsistency()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Check failed:", err)
+		return 1
+	}
+	if len(issues) == 0 {
+		fmt.Println("No inconsistencies found")
+		return 0
+	}
+	if !*fix {
+		for _, issue := range issues {
+			fmt.Println(issue)
+		}
+		fmt.Printf("Found %d inconsistencies, run with -fix to repair them\n", len(issues))
+		return 1
+	}
+	for _, issue := range issues {
+		switch err = issue.Fix(); err {
+		case nil:
+			fmt.Println(issue, "- fixed")
+		case logic.ErrAlreadyFixed:
+			fmt.Println(issue, "- already fixed")
+		default:
+			fmt.Println(issue, "- failed:", err)
+		}
+	}
+	// Issues of the same list or user are fixed from the same snapshot, so only a new check tells what is left
+	remaining, err := service.CheckConsistency()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Check after repairing failed:", err)
+		return 1
+	}
+	for _, issue := range remaining {
+		fmt.Println(issue, "- still inconsistent")
+	}
+	if len(remaining) > 0 {
+		fmt.Printf("Found %d inconsistencies, %d remain after repairing\n", len(issues), len(remaining))
+		return 1
+	}
+	fmt.Printf("Repaired %d inconsistencies\n", len(issues))
+	return 0
+}
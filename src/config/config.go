@@ -0,0 +1,373 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Storage backends
+const (
+	StorageMongo    = "mongo"
+	StorageMemory   = "memory"
+	StorageSQLite   = "sqlite"
+	StoragePostgres = "postgres"
+)
+
+// defaultSQLitePath is the database file used by StorageSQLite if no DSN is set
+const defaultSQLitePath = "shoppinglist.db"
+
+// placeholderSecret is the secret the server used to be shipped with, it must never be used
+const placeholderSecret = "SECRET KEY WILL BE HERE"
+
+type Collections struct {
+	Users         string `yaml:"users"`
+	Access        string `yaml:"access"`
+	Lists         string `yaml:"lists"`
+	Requests      string `yaml:"requests"`
+	Notifications string `yaml:"notifications"`
+	Tombstones    string `yaml:"tombstones"`
+	Invites       string `yaml:"invites"`
+	Groups        string `yaml:"groups"`
+	Revisions     string `yaml:"revisions"`
+	ItemOps       string `yaml:"item_ops"`
+	RefreshTokens string `yaml:"refresh_tokens"`
+	RevokedTokens string `yaml:"revoked_tokens"`
+}
+
+type Mongo struct {
+	URI         string      `yaml:"uri"`
+	Database    string      `yaml:"database"`
+	Collections Collections `yaml:"collections"`
+}
+
+// SQL configures StorageSQLite and StoragePostgres.
+// DSN is the database file for SQLite and the connection string for PostgreSQL.
+type SQL struct {
+	DSN string `yaml:"dsn"`
+}
+
+type JWT struct {
+	Secret     string        `yaml:"secret"`
+	SecretFile string        `yaml:"secret_file"`
+	AccessTTL  time.Duration `yaml:"access_ttl"`
+	RefreshTTL time.Duration `yaml:"refresh_ttl"`
+}
+
+type Cookie struct {
+	Domain   string `yaml:"domain"`
+	Secure   bool   `yaml:"secure"`
+	SameSite string `yaml:"same_site"`
+}
+
+// Trash configures how long deleted lists can be restored and how often expired ones are purged
+type Trash struct {
+	Retention     time.Duration `yaml:"retention"`
+	PurgeInterval time.Duration `yaml:"purge_interval"`
+}
+
+type Timeouts struct {
+	Connect time.Duration `yaml:"connect"`
+	Read    time.Duration `yaml:"read"`
+	// Write is 0 by default, because event streams stay open for a long time
+	Write time.Duration `yaml:"write"`
+	Idle  time.Duration `yaml:"idle"`
+}
+
+type Config struct {
+	Port     string `yaml:"port"`
+	LogLevel string `yaml:"log_level"`
+	// Storage is one of StorageMongo, StorageSQLite, StoragePostgres or StorageMemory, which loses all data on restart
+	Storage  string   `yaml:"storage"`
+	Mongo    Mongo    `yaml:"mongo"`
+	SQL      SQL      `yaml:"sql"`
+	JWT      JWT      `yaml:"jwt"`
+	Cookie   Cookie   `yaml:"cookie"`
+	Timeouts Timeouts `yaml:"timeouts"`
+	Trash    Trash    `yaml:"trash"`
+	// Args are the arguments after flags, the first one is a command to run instead of the server
+	Args []string `yaml:"-"`
+}
+
+func defaults() Config {
+	return Config{
+		Port:     ":8080",
+		LogLevel: "info",
+		Storage:  StorageMongo,
+		Mongo: Mongo{
+			URI:      "mongodb://localhost:27017",
+			Database: "shoppinglist",
+			Collections: Collections{
+				Users:         "users",
+				Access:        "access",
+				Lists:         "lists",
+				Requests:      "requests",
+				Notifications: "notifications",
+				Tombstones:    "tombstones",
+				Invites:       "invites",
+				Groups:        "groups",
+				Revisions:     "revisions",
+				ItemOps:       "item_ops",
+				RefreshTokens: "refresh_tokens",
+				RevokedTokens: "revoked_tokens",
+			},
+		},
+		JWT: JWT{
+			AccessTTL:  15 * time.Minute,
+			RefreshTTL: 30 * 24 * time.Hour,
+		},
+		Cookie: Cookie{
+			SameSite: "default",
+		},
+		Timeouts: Timeouts{
+			Connect: 10 * time.Second,
+			Read:    30 * time.Second,
+			Idle:    2 * time.Minute,
+		},
+		Trash: Trash{
+			Retention:     30 * 24 * time.Hour,
+			PurgeInterval: time.Hour,
+		},
+	}
+}
+
+// Load builds the configuration from defaults, then the config file, then environment variables
+// and finally command line flags, each source overriding the previous ones.
+// The config file is taken from -config flag or SHOPPINGLIST_CONFIG variable.
+func Load(args []string) (*Config, error) {
+	cfg := defaults()
+	flags := flag.NewFlagSet("shoppinglist-server", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("SHOPPINGLIST_CONFIG"), "path to YAML config file")
+	overrides := registerFlags(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Args = flags.Args()
+	if *configFile != "" {
+		if err = loadFile(&cfg, *configFile); err != nil {
+			return nil, err
+		}
+	}
+	if err = loadEnv(&cfg); err != nil {
+		return nil, err
+	}
+	// Only flags that were set explicitly override other sources
+	flags.Visit(func(f *flag.Flag) {
+		if apply, ok := overrides[f.Name]; ok {
+			apply(&cfg)
+		}
+	})
+	if !strings.HasPrefix(cfg.Port, ":") && !strings.Contains(cfg.Port, ":") {
+		cfg.Port = ":" + cfg.Port
+	}
+	if err = cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func loadFile(cfg *Config, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	err = yaml.UnmarshalStrict(data, cfg)
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	return nil
+}
+
+type envSetter func(cfg *Config, value string) error
+
+func stringEnv(field func(cfg *Config) *string) envSetter {
+	return func(cfg *Config, value string) error {
+		*field(cfg) = value
+		return nil
+	}
+}
+
+func boolEnv(field func(cfg *Config) *bool) envSetter {
+	return func(cfg *Config, value string) error {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*field(cfg) = parsed
+		return nil
+	}
+}
+
+func durationEnv(field func(cfg *Config) *time.Duration) envSetter {
+	return func(cfg *Config, value string) error {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*field(cfg) = parsed
+		return nil
+	}
+}
+
+var envVariables = map[string]envSetter{
+	// PORT is kept without prefix, hosting platforms set it
+	"PORT":                                   stringEnv(func(cfg *Config) *string { return &cfg.Port }),
+	"SHOPPINGLIST_LOG_LEVEL":                 stringEnv(func(cfg *Config) *string { return &cfg.LogLevel }),
+	"SHOPPINGLIST_STORAGE":                   stringEnv(func(cfg *Config) *string { return &cfg.Storage }),
+	"SHOPPINGLIST_MONGO_URI":                 stringEnv(func(cfg *Config) *string { return &cfg.Mongo.URI }),
+	"SHOPPINGLIST_MONGO_DATABASE":            stringEnv(func(cfg *Config) *string { return &cfg.Mongo.Database }),
+	"SHOPPINGLIST_COLLECTION_USERS":          stringEnv(func(cfg *Config) *string { return &cfg.Mongo.Collections.Users }),
+	"SHOPPINGLIST_COLLECTION_ACCESS":         stringEnv(func(cfg *Config) *string { return &cfg.Mongo.Collections.Access }),
+	"SHOPPINGLIST_COLLECTION_LISTS":          stringEnv(func(cfg *Config) *string { return &cfg.Mongo.Collections.Lists }),
+	"SHOPPINGLIST_COLLECTION_REQUESTS":       stringEnv(func(cfg *Config) *string { return &cfg.Mongo.Collections.Requests }),
+	"SHOPPINGLIST_COLLECTION_NOTIFICATIONS":  stringEnv(func(cfg *Config) *string { return &cfg.Mongo.Collections.Notifications }),
+	"SHOPPINGLIST_COLLECTION_TOMBSTONES":     stringEnv(func(cfg *Config) *string { return &cfg.Mongo.Collections.Tombstones }),
+	"SHOPPINGLIST_COLLECTION_INVITES":        stringEnv(func(cfg *Config) *string { return &cfg.Mongo.Collections.Invites }),
+	"SHOPPINGLIST_COLLECTION_GROUPS":         stringEnv(func(cfg *Config) *string { return &cfg.Mongo.Collections.Groups }),
+	"SHOPPINGLIST_COLLECTION_REVISIONS":      stringEnv(func(cfg *Config) *string { return &cfg.Mongo.Collections.Revisions }),
+	"SHOPPINGLIST_COLLECTION_ITEM_OPS":       stringEnv(func(cfg *Config) *string { return &cfg.Mongo.Collections.ItemOps }),
+	"SHOPPINGLIST_COLLECTION_REFRESH_TOKENS": stringEnv(func(cfg *Config) *string { return &cfg.Mongo.Collections.RefreshTokens }),
+	"SHOPPINGLIST_COLLECTION_REVOKED_TOKENS": stringEnv(func(cfg *Config) *string { return &cfg.Mongo.Collections.RevokedTokens }),
+	"SHOPPINGLIST_SQL_DSN":                   stringEnv(func(cfg *Config) *string { return &cfg.SQL.DSN }),
+	"SHOPPINGLIST_JWT_SECRET":                stringEnv(func(cfg *Config) *string { return &cfg.JWT.Secret }),
+	"SHOPPINGLIST_JWT_SECRET_FILE":           stringEnv(func(cfg *Config) *string { return &cfg.JWT.SecretFile }),
+	"SHOPPINGLIST_JWT_ACCESS_TTL":            durationEnv(func(cfg *Config) *time.Duration { return &cfg.JWT.AccessTTL }),
+	"SHOPPINGLIST_JWT_REFRESH_TTL":           durationEnv(func(cfg *Config) *time.Duration { return &cfg.JWT.RefreshTTL }),
+	"SHOPPINGLIST_COOKIE_DOMAIN":             stringEnv(func(cfg *Config) *string { return &cfg.Cookie.Domain }),
+	"SHOPPINGLIST_COOKIE_SECURE":             boolEnv(func(cfg *Config) *bool { return &cfg.Cookie.Secure }),
+	"SHOPPINGLIST_COOKIE_SAME_SITE":          stringEnv(func(cfg *Config) *string { return &cfg.Cookie.SameSite }),
+	"SHOPPINGLIST_TIMEOUT_CONNECT":           durationEnv(func(cfg *Config) *time.Duration { return &cfg.Timeouts.Connect }),
+	"SHOPPINGLIST_TIMEOUT_READ":              durationEnv(func(cfg *Config) *time.Duration { return &cfg.Timeouts.Read }),
+	"SHOPPINGLIST_TIMEOUT_WRITE":             durationEnv(func(cfg *Config) *time.Duration { return &cfg.Timeouts.Write }),
+	"SHOPPINGLIST_TIMEOUT_IDLE":              durationEnv(func(cfg *Config) *time.Duration { return &cfg.Timeouts.Idle }),
+	"SHOPPINGLIST_TRASH_RETENTION":           durationEnv(func(cfg *Config) *time.Duration { return &cfg.Trash.Retention }),
+	"SHOPPINGLIST_TRASH_PURGE_INTERVAL":      durationEnv(func(cfg *Config) *time.Duration { return &cfg.Trash.PurgeInterval }),
+}
+
+func loadEnv(cfg *Config) error {
+	for name, set := range envVariables {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := set(cfg, value); err != nil {
+			return fmt.Errorf("invalid value of %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// registerFlags defines command line flags and returns functions applying their values by flag name
+func registerFlags(flags *flag.FlagSet) map[string]func(cfg *Config) {
+	port := flags.String("port", "", "address or port to listen on")
+	logLevel := flags.String("log-level", "", "log level: debug, info, warning or error")
+	storage := flags.String("storage", "", "storage backend: mongo, sqlite, postgres or memory")
+	mongoURI := flags.String("mongo-uri", "", "MongoDB connection string")
+	mongoDatabase := flags.String("mongo-database", "", "MongoDB database name")
+	refreshTokens := flags.String("refresh-tokens-collection", "", "MongoDB collection of refresh tokens")
+	revokedTokens := flags.String("revoked-tokens-collection", "", "MongoDB collection of revoked access tokens")
+	sqlDSN := flags.String("sql-dsn", "", "SQLite database file or PostgreSQL connection string")
+	secretFile := flags.String("jwt-secret-file", "", "file containing the secret used to sign tokens")
+	accessTTL := flags.Duration("access-ttl", 0, "lifetime of access tokens")
+	refreshTTL := flags.Duration("refresh-ttl", 0, "lifetime of refresh tokens")
+	cookieDomain := flags.String("cookie-domain", "", "domain of the authentication cookie")
+	cookieSecure := flags.Bool("cookie-secure", false, "send the authentication cookie only over HTTPS")
+	cookieSameSite := flags.String("cookie-same-site", "", "SameSite mode of the authentication cookie: default, lax, strict or none")
+	connectTimeout := flags.Duration("connect-timeout", 0, "database connection timeout")
+	readTimeout := flags.Duration("read-timeout", 0, "HTTP read timeout")
+	writeTimeout := flags.Duration("write-timeout", 0, "HTTP write timeout, 0 disables it")
+	idleTimeout := flags.Duration("idle-timeout", 0, "HTTP keep-alive timeout")
+	trashRetention := flags.Duration("trash-retention", 0, "how long deleted lists can be restored")
+	purgeInterval := flags.Duration("purge-interval", 0, "how often expired lists are purged from the trash")
+	// There is no flag for the secret itself, so it doesn't show up in the process list
+	return map[string]func(cfg *Config){
+		"port":                      func(cfg *Config) { cfg.Port = *port },
+		"log-level":                 func(cfg *Config) { cfg.LogLevel = *logLevel },
+		"storage":                   func(cfg *Config) { cfg.Storage = *storage },
+		"mongo-uri":                 func(cfg *Config) { cfg.Mongo.URI = *mongoURI },
+		"mongo-database":            func(cfg *Config) { cfg.Mongo.Database = *mongoDatabase },
+		"refresh-tokens-collection": func(cfg *Config) { cfg.Mongo.Collections.RefreshTokens = *refreshTokens },
+		"revoked-tokens-collection": func(cfg *Config) { cfg.Mongo.Collections.RevokedTokens = *revokedTokens },
+		"sql-dsn":                   func(cfg *Config) { cfg.SQL.DSN = *sqlDSN },
+		"jwt-secret-file":           func(cfg *Config) { cfg.JWT.SecretFile = *secretFile },
+		"access-ttl":                func(cfg *Config) { cfg.JWT.AccessTTL = *accessTTL },
+		"refresh-ttl":               func(cfg *Config) { cfg.JWT.RefreshTTL = *refreshTTL },
+		"cookie-domain":             func(cfg *Config) { cfg.Cookie.Domain = *cookieDomain },
+		"cookie-secure":             func(cfg *Config) { cfg.Cookie.Secure = *cookieSecure },
+		"cookie-same-site":          func(cfg *Config) { cfg.Cookie.SameSite = *cookieSameSite },
+		"connect-timeout":           func(cfg *Config) { cfg.Timeouts.Connect = *connectTimeout },
+		"read-timeout":              func(cfg *Config) { cfg.Timeouts.Read = *readTimeout },
+		"write-timeout":             func(cfg *Config) { cfg.Timeouts.Write = *writeTimeout },
+		"idle-timeout":              func(cfg *Config) { cfg.Timeouts.Idle = *idleTimeout },
+		"trash-retention":           func(cfg *Config) { cfg.Trash.Retention = *trashRetention },
+		"purge-interval":            func(cfg *Config) { cfg.Trash.PurgeInterval = *purgeInterval },
+	}
+}
+
+func (cfg *Config) validate() error {
+	switch cfg.Storage {
+	case StorageMongo, StorageMemory:
+	case StorageSQLite:
+		if cfg.SQL.DSN == "" {
+			cfg.SQL.DSN = defaultSQLitePath
+		}
+	case StoragePostgres:
+		if cfg.SQL.DSN == "" {
+			return errors.New("PostgreSQL storage needs a connection string, use SHOPPINGLIST_SQL_DSN or -sql-dsn")
+		}
+	default:
+		return fmt.Errorf("unknown storage %q", cfg.Storage)
+	}
+	if _, err := cfg.SameSite(); err != nil {
+		return err
+	}
+	if cfg.JWT.AccessTTL <= 0 || cfg.JWT.RefreshTTL <= 0 {
+		return errors.New("token lifetimes must be positive")
+	}
+	if cfg.Trash.Retention <= 0 || cfg.Trash.PurgeInterval <= 0 {
+		return errors.New("trash retention and purge interval must be positive")
+	}
+	_, err := cfg.SecretKey()
+	return err
+}
+
+// SecretKey returns the key used to sign tokens, read from the secret file if it is set
+func (cfg *Config) SecretKey() ([]byte, error) {
+	secret := cfg.JWT.Secret
+	if cfg.JWT.SecretFile != "" {
+		data, err := ioutil.ReadFile(cfg.JWT.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read JWT secret: %v", err)
+		}
+		secret = strings.TrimSpace(string(data))
+	}
+	if secret == "" {
+		return nil, errors.New("JWT secret is not set, use SHOPPINGLIST_JWT_SECRET or jwt.secret_file")
+	}
+	if secret == placeholderSecret {
+		return nil, errors.New("JWT secret is still the placeholder, set a real one")
+	}
+	return []byte(secret), nil
+}
+
+func (cfg *Config) SameSite() (http.SameSite, error) {
+	switch strings.ToLower(cfg.Cookie.SameSite) {
+	case "", "default":
+		return http.SameSiteDefaultMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, fmt.Errorf("unknown cookie SameSite mode %q", cfg.Cookie.SameSite)
+}
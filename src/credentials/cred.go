@@ -3,31 +3,47 @@ package credentials
 import (
 	"context"
 	"crypto/md5"
+	"crypto/subtle"
 	"errors"
+	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"go.mongodb.org/mongo-driver/x/bsonx"
+	"golang.org/x/crypto/bcrypt"
 	"time"
 )
 
+// passwordCost is the bcrypt work factor of new password hashes
+const passwordCost = 12
+
+var errInvalidCredentials = errors.New("invalid credentials")
+
 type CredController interface {
 	Login(username, password string) error
 	Register(username, password string) error
 }
 
+type userRecord struct {
+	Username string `bson:"username"`
+	// Hash is a bcrypt hash with encoded salt and cost
+	Hash string `bson:"hash,omitempty"`
+	// LegacyPassword is an unsalted MD5 of the password, it is replaced with Hash on the next login
+	LegacyPassword []byte `bson:"password,omitempty"`
+}
+
 type mongoController struct {
 	cancel     context.CancelFunc
 	collection *mongo.Collection
 }
 
-func NewMongoDBCredentials(url, databaseName, collectionName string) (CredController, error) {
+func NewMongoDBCredentials(url, databaseName, collectionName string, timeout time.Duration) (CredController, error) {
 	client, err := mongo.NewClient(options.Client().ApplyURI(url))
 	if err != nil {
 		return nil, err
 	}
-	ctx, contextCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, contextCancel := context.WithTimeout(context.Background(), timeout)
 	err = client.Connect(ctx)
 	if err != nil {
 		return nil, err
@@ -52,22 +68,77 @@ func NewMongoDBCredentials(url, databaseName, collectionName string) (CredContro
 }
 
 func (mc mongoController) Login(username, password string) error {
-	res := mc.collection.FindOne(context.TODO(), bson.D{{"username", username}, {"password", hashPassword(password)}})
+	res := mc.collection.FindOne(context.TODO(), bson.D{{"username", username}})
 	if res.Err() != nil {
-		return errors.New("invalid credentials")
+		return errInvalidCredentials
+	}
+	var user userRecord
+	err := res.Decode(&user)
+	if err != nil {
+		return err
+	}
+	legacy, err := checkPassword(user, password)
+	if err != nil {
+		return err
+	}
+	// The password is known only now, so it's the only chance to replace the legacy hash
+	if legacy {
+		if err = mc.upgradeLegacyHash(username, user.LegacyPassword, password); err != nil {
+			log.Error("Failed to upgrade password hash of ", username, ": ", err)
+		}
 	}
 	return nil
 }
 
-func (mc mongoController) Register(username, password string) error {
+func (mc mongoController) upgradeLegacyHash(username string, legacyHash []byte, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = mc.collection.UpdateOne(context.TODO(),
+		bson.D{{"username", username}, {"password", legacyHash}},
+		bson.D{{"$set", bson.D{{"hash", hash}}}, {"$unset", bson.D{{"password", ""}}}})
+	return err
+}
 
-	_, err := mc.collection.InsertOne(context.TODO(), bson.D{{"username", username}, {"password", hashPassword(password)}})
+func (mc mongoController) Register(username, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = mc.collection.InsertOne(context.TODO(), userRecord{Username: username, Hash: hash})
 	if err != nil {
-		return errors.New("invalid credentials")
+		return errInvalidCredentials
 	}
 	return nil
 }
 
-func hashPassword(password string) [16]byte {
-	return md5.Sum([]byte(password))
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// checkPassword checks the password of the user, legacy reports whether the user has only a legacy hash yet
+func checkPassword(user userRecord, password string) (legacy bool, err error) {
+	if user.Hash != "" {
+		if bcrypt.CompareHashAndPassword([]byte(user.Hash), []byte(password)) != nil {
+			return false, errInvalidCredentials
+		}
+		return false, nil
+	}
+	if !checkLegacyPassword(user.LegacyPassword, password) {
+		return false, errInvalidCredentials
+	}
+	return true, nil
+}
+
+func checkLegacyPassword(legacyHash []byte, password string) bool {
+	if len(legacyHash) != md5.Size {
+		return false
+	}
+	sum := md5.Sum([]byte(password))
+	return subtle.ConstantTimeCompare(legacyHash, sum[:]) == 1
 }
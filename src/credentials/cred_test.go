@@ -0,0 +1,36 @@
+package credentials
+
+import (
+	"crypto/md5"
+	"testing"
+)
+
+func TestLoginUpgradesLegacyHash(t *testing.T) {
+	cred := NewMemoryCredentials()
+	mc := cred.(*memoryController)
+	sum := md5.Sum([]byte("secret"))
+	mc.users["katya"] = userRecord{Username: "katya", LegacyPassword: sum[:]}
+
+	if err := cred.Login("katya", "wrong"); err != errInvalidCredentials {
+		t.Fatalf("wrong password returned %v", err)
+	}
+	if mc.users["katya"].Hash != "" {
+		t.Fatal("failed login has upgraded the hash")
+	}
+	if err := cred.Login("katya", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	user := mc.users["katya"]
+	if user.Hash == "" || user.LegacyPassword != nil {
+		t.Fatalf("legacy hash is not replaced: %+v", user)
+	}
+	if legacy, err := checkPassword(user, "secret"); err != nil || legacy {
+		t.Errorf("upgraded hash doesn't match the password, legacy %v, error %v", legacy, err)
+	}
+	if err := cred.Login("katya", "secret"); err != nil {
+		t.Errorf("login after the upgrade returned %v", err)
+	}
+	if err := cred.Login("katya", "wrong"); err != errInvalidCredentials {
+		t.Errorf("wrong password after the upgrade returned %v", err)
+	}
+}
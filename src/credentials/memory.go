@@ -0,0 +1,65 @@
+package credentials
+
+import (
+	"bytes"
+	log "github.com/sirupsen/logrus"
+	"sync"
+)
+
+type memoryController struct {
+	mutex sync.RWMutex
+	users map[string]userRecord
+}
+
+// NewMemoryCredentials keeps users in the process, they are lost on restart
+func NewMemoryCredentials() CredController {
+	return &memoryController{users: make(map[string]userRecord)}
+}
+
+func (mc *memoryController) Login(username, password string) error {
+	mc.mutex.RLock()
+	user, ok := mc.users[username]
+	mc.mutex.RUnlock()
+	if !ok {
+		return errInvalidCredentials
+	}
+	legacy, err := checkPassword(user, password)
+	if err != nil {
+		return err
+	}
+	// The password is known only now, so it's the only chance to replace the legacy hash
+	if legacy {
+		if err = mc.upgradeLegacyHash(username, user.LegacyPassword, password); err != nil {
+			log.Error("Failed to upgrade password hash of ", username, ": ", err)
+		}
+	}
+	return nil
+}
+
+func (mc *memoryController) upgradeLegacyHash(username string, legacyHash []byte, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	// The hash is left alone if the user has been changed meanwhile, as the update of MongoDB does
+	if user, ok := mc.users[username]; ok && bytes.Equal(user.LegacyPassword, legacyHash) {
+		mc.users[username] = userRecord{Username: username, Hash: hash}
+	}
+	return nil
+}
+
+func (mc *memoryController) Register(username, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	if _, ok := mc.users[username]; ok {
+		return errInvalidCredentials
+	}
+	mc.users[username] = userRecord{Username: username, Hash: hash}
+	return nil
+}
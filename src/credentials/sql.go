@@ -0,0 +1,38 @@
+package credentials
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"shoppinglist-server/src/sqldb"
+)
+
+type sqlController struct {
+	db *sqldb.DB
+}
+
+func NewSQLCredentials(db *sqldb.DB) CredController {
+	return sqlController{db: db}
+}
+
+func (sc sqlController) Login(username, password string) error {
+	var hash string
+	err := sc.db.QueryRow(`SELECT hash FROM users WHERE username = ?`, username).Scan(&hash)
+	if err != nil {
+		return errInvalidCredentials
+	}
+	if hash == "" || bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return errInvalidCredentials
+	}
+	return nil
+}
+
+func (sc sqlController) Register(username, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = sc.db.Exec(`INSERT INTO users (username, hash) VALUES (?, ?)`, username, hash)
+	if err != nil {
+		return errInvalidCredentials
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package logic
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// saga records how to undo completed steps of a multi-step write
+type saga struct {
+	// compensate is false in transactions, which are rolled back by the storage
+	compensate    bool
+	compensations []func() error
+}
+
+// step runs do and remembers undo, which reverts it, if do has succeeded. undo may be nil for the last step.
+func (sg *saga) step(do, undo func() error) error {
+	if err := do(); err != nil {
+		return err
+	}
+	if sg.compensate && undo != nil {
+		sg.compensations = append(sg.compensations, undo)
+	}
+	return nil
+}
+
+func (sg *saga) rollback() {
+	for i := len(sg.compensations) - 1; i >= 0; i-- {
+		if err := sg.compensations[i](); err != nil {
+			log.Error("Failed to revert a partial write, storage may be inconsistent: ", err)
+		}
+	}
+}
+
+// atomically runs f so that either all of its writes survive or none of them.
+// It runs in a transaction if the storage supports them, otherwise completed steps are reverted if f fails.
+// f may be run several times in a transaction, so it must have no other side effects.
+func (s *Service) atomically(f func(st *Storage, sg *saga) error) error {
+	if s.transactions != nil {
+		return s.transactions.inTransaction(func(tx *Storage) error {
+			return f(tx, &saga{})
+		})
+	}
+	sg := &saga{compensate: true}
+	err := f(s.Storage, sg)
+	if err != nil {
+		sg.rollback()
+	}
+	return err
+}
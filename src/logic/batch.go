@@ -0,0 +1,106 @@
+package logic
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// maxBatchSize is how many lists a batch request may contain
+const maxBatchSize = 100
+
+var errBatchTooLarge = errors.New("too many lists in the batch")
+
+// batchResult is the outcome for one list of a batch.
+// Status is the HTTP status a request for that list alone would have got.
+type batchResult struct {
+	Id     string `json:"id"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	List   *list  `json:"list,omitempty"`
+	// Clock is the clock of merged operations, it is only set by batches of operations
+	Clock int64 `json:"clock,omitempty"`
+}
+
+// listOps are operations to merge into the list
+type listOps struct {
+	Id  string   `json:"id"`
+	Ops []itemOp `json:"ops"`
+}
+
+func failedResult(id string, err error) batchResult {
+	result := batchResult{Id: id, Error: err.Error()}
+	switch err {
+	case errNoPermission:
+		// The user is signed in, they just may not do this with the list
+		result.Status = http.StatusForbidden
+	case errNotFound:
+		// The list has been deleted since it was authorized
+		result.Status = http.StatusNotFound
+	case errInvalidOp, errEmptyItemName:
+		result.Status = http.StatusBadRequest
+	case errVersionMismatch:
+		result.Status = http.StatusPreconditionFailed
+	case errMergeContended:
+		result.Status = http.StatusConflict
+	default:
+		log.Errorln(err)
+		result.Status = http.StatusInternalServerError
+	}
+	return result
+}
+
+// authorizeBatchList checks that the user has the permission for one list of a batch
+func (s *Service) authorizeBatchList(username, id string, required permission) error {
+	authorized, err := s.hasAccessToList(username, id, required)
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		log.Warningln("User", username, "tried to access list", id, "without permission")
+		return errNoPermission
+	}
+	return nil
+}
+
+// batchGetLists loads the lists, each of them is loaded only if the user may read it
+func (s *Service) batchGetLists(username string, ids []string) ([]batchResult, error) {
+	if len(ids) > maxBatchSize {
+		return nil, errBatchTooLarge
+	}
+	results := make([]batchResult, 0, len(ids))
+	for _, id := range ids {
+		if err := s.authorizeBatchList(username, id, permRead); err != nil {
+			results = append(results, failedResult(id, err))
+			continue
+		}
+		listRec, err := s.loadList(id)
+		if err != nil {
+			results = append(results, failedResult(id, err))
+			continue
+		}
+		results = append(results, batchResult{Id: id, Status: http.StatusOK, List: listRec})
+	}
+	return results, nil
+}
+
+// batchMergeOps merges operations into each list the user may edit, lists are merged independently of each other
+func (s *Service) batchMergeOps(username string, batch []listOps) ([]batchResult, error) {
+	if len(batch) > maxBatchSize {
+		return nil, errBatchTooLarge
+	}
+	results := make([]batchResult, 0, len(batch))
+	for _, element := range batch {
+		if err := s.authorizeBatchList(username, element.Id, permEdit); err != nil {
+			results = append(results, failedResult(element.Id, err))
+			continue
+		}
+		merged, err := s.mergeOps(username, element.Id, element.Ops)
+		if err != nil {
+			results = append(results, failedResult(element.Id, err))
+			continue
+		}
+		results = append(results, batchResult{Id: element.Id, Status: http.StatusOK, List: merged.List, Clock: merged.Clock})
+	}
+	return results, nil
+}
@@ -0,0 +1,116 @@
+package logic
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func batchOpsBody(batch ...listOps) string {
+	body, _ := json.Marshal(batchOpsReq{Lists: batch})
+	return string(body)
+}
+
+func TestBatchGetLists(t *testing.T) {
+	s := newTestService(t, "katya", "vasya")
+	own := createTestList(t, s, "katya", `{"name":"Groceries","content":"Milk"}`)
+	shared := createTestList(t, s, "vasya", `{"name":"Party"}`)
+	shareTestList(t, s, "vasya", "katya", shared, roleViewer)
+	foreign := createTestList(t, s, "vasya", `{"name":"Secret"}`)
+
+	body := `{"ids":["` + own + `","` + shared + `","` + foreign + `","nonexistent"]}`
+	var results []batchResult
+	decode(t, serve(s.HandleBatchGetLists, "katya", "POST", "/v1/lists/batch/get", body), &results)
+	want := []struct {
+		id     string
+		status int
+	}{
+		{own, http.StatusOK},
+		{shared, http.StatusOK},
+		{foreign, http.StatusForbidden},
+		{"nonexistent", http.StatusForbidden},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("got results %+v", results)
+	}
+	for i, result := range results {
+		if result.Id != want[i].id || result.Status != want[i].status {
+			t.Errorf("got result %+v, want status %d for %s", result, want[i].status, want[i].id)
+		}
+		if (result.List != nil) != (result.Status == http.StatusOK) {
+			t.Errorf("got list %+v with status %d", result.List, result.Status)
+		}
+	}
+	if results[0].List.OriginalName != "Groceries" || results[2].Error != errNoPermission.Error() {
+		t.Errorf("got results %+v", results)
+	}
+}
+
+func TestBatchMergeOps(t *testing.T) {
+	s := newTestService(t, "katya", "vasya")
+	own := createTestList(t, s, "katya", `{"name":"Groceries"}`)
+	viewed := createTestList(t, s, "vasya", `{"name":"Party"}`)
+	shareTestList(t, s, "vasya", "katya", viewed, roleViewer)
+	invalid := createTestList(t, s, "katya", `{"name":"Hardware"}`)
+
+	add := itemOp{ClientId: "phone", Clock: 1, Kind: opAdd, ItemId: "milk", Fields: opFields{Name: stringField("Milk")}}
+	body := batchOpsBody(
+		listOps{Id: own, Ops: []itemOp{add}},
+		listOps{Id: viewed, Ops: []itemOp{add}},
+		listOps{Id: invalid, Ops: []itemOp{{ClientId: "phone", Clock: 1, Kind: "rename", ItemId: "milk"}}},
+	)
+	w := serve(s.HandleBatchMergeOps, "katya", "POST", "/v1/lists/batch/ops", body)
+	expectStatus(t, w, http.StatusOK)
+	var results []batchResult
+	decode(t, w, &results)
+	if len(results) != 3 {
+		t.Fatalf("got results %+v", results)
+	}
+	if results[0].Status != http.StatusOK || results[0].Clock != 1 || results[0].List == nil {
+		t.Errorf("got result %+v for an editable list", results[0])
+	}
+	if results[1].Status != http.StatusForbidden || results[2].Status != http.StatusBadRequest {
+		t.Errorf("got results %+v, want 403 for the viewed list and 400 for the invalid operation", results[1:])
+	}
+	if names := strings.Join(itemNames(getTestList(t, s, "katya", own).Items), ","); names != "Milk" {
+		t.Errorf("got items %s", names)
+	}
+	if items := getTestList(t, s, "vasya", viewed).Items; len(items) != 0 {
+		t.Errorf("viewer changed the list: %+v", items)
+	}
+}
+
+func TestBatchTooLarge(t *testing.T) {
+	s := newTestService(t, "katya")
+	ids := make([]string, maxBatchSize+1)
+	batch := make([]listOps, maxBatchSize+1)
+	for i := range ids {
+		ids[i] = "list"
+		batch[i] = listOps{Id: "list"}
+	}
+	body, _ := json.Marshal(batchGetReq{Ids: ids})
+	w := serve(s.HandleBatchGetLists, "katya", "POST", "/v1/lists/batch/get", string(body))
+	expectStatus(t, w, http.StatusBadRequest)
+	w = serve(s.HandleBatchMergeOps, "katya", "POST", "/v1/lists/batch/ops", batchOpsBody(batch...))
+	expectStatus(t, w, http.StatusBadRequest)
+}
+
+func TestFailedResultStatuses(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{errNoPermission, http.StatusForbidden},
+		{errNotFound, http.StatusNotFound},
+		{errInvalidOp, http.StatusBadRequest},
+		{errEmptyItemName, http.StatusBadRequest},
+		{errVersionMismatch, http.StatusPreconditionFailed},
+		{errMergeContended, http.StatusConflict},
+	}
+	for _, test := range tests {
+		if result := failedResult("list", test.err); result.Status != test.status || result.Error != test.err.Error() {
+			t.Errorf("got %+v for %v, want status %d", result, test.err, test.status)
+		}
+	}
+}
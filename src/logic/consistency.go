@@ -0,0 +1,245 @@
+package logic
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Kinds of inconsistencies between lists and access records
+const (
+	IssueOrphanedLink    = "orphaned_link"
+	IssueMismatchedOwner = "mismatched_owner"
+	IssueDuplicateLink   = "duplicate_link"
+	IssueStaleName       = "stale_display_name"
+	IssueMissingLink     = "missing_link"
+	IssueDanglingGuest   = "dangling_guest"
+	IssueDuplicateGuest  = "duplicate_guest"
+)
+
+// ErrAlreadyFixed is returned by Fix if the inconsistency is gone already, for example fixed along with another one
+var ErrAlreadyFixed = errors.New("already fixed")
+
+// Inconsistency is a mismatch between a list and an access record, which Fix repairs
+type Inconsistency struct {
+	Kind     string
+	Username string
+	ListId   string
+	Problem  string
+	Repair   string
+	fix      func() error
+}
+
+func (i Inconsistency) String() string {
+	return fmt.Sprintf("%s: %s; %s", i.Kind, i.Problem, i.Repair)
+}
+
+func (i Inconsistency) Fix() error {
+	err := i.fix()
+	if err == errNotFound || err == errDuplicate {
+		return ErrAlreadyFixed
+	}
+	return err
+}
+
+func countLinks(links []listLink) map[string]int {
+	counts := make(map[string]int, len(links))
+	for _, link := range links {
+		counts[link.Id]++
+	}
+	return counts
+}
+
+func hasGuest(listRec *list, username string) bool {
+	for _, guest := range listRec.Guests {
+		if guest == username {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckConsistency compares all access records with all lists and returns every inconsistency between them.
+// Lists are the source of truth for owners and for names of links without an alias,
+// a guest is only kept if both the list and the guest agree.
+// It works on a snapshot, so it should be run while nobody modifies lists.
+func (s *Service) CheckConsistency() ([]Inconsistency, error) {
+	lists, err := s.lists.All()
+	if err != nil {
+		return nil, err
+	}
+	records, err := s.access.All()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(lists, func(i, j int) bool { return lists[i].Id < lists[j].Id })
+	sort.Slice(records, func(i, j int) bool { return records[i].Username < records[j].Username })
+	listsById := make(map[string]*list, len(lists))
+	for i := range lists {
+		listsById[lists[i].Id] = &lists[i]
+	}
+	recordsByUsername := make(map[string]*accessRecord, len(records))
+	for i := range records {
+		recordsByUsername[records[i].Username] = &records[i]
+	}
+	issues := make([]Inconsistency, 0)
+	for _, record := range records {
+		issues = append(issues, s.checkLinks(record.Username, record.OwnedLists, true, listsById)...)
+		issues = append(issues, s.checkLinks(record.Username, record.SharedLists, false, listsById)...)
+	}
+	for i := range lists {
+		issues = append(issues, s.checkMembers(&lists[i], recordsByUsername)...)
+	}
+	return issues, nil
+}
+
+// checkLinks checks owned or shared links of the user against the lists they point to
+func (s *Service) checkLinks(username string, links []listLink, owned bool, listsById map[string]*list) []Inconsistency {
+	kind := "shared"
+	remove, add := s.access.RemoveShared, s.access.AddShared
+	if owned {
+		kind = "owned"
+		remove, add = s.access.RemoveOwned, s.access.AddOwned
+	}
+	issues := make([]Inconsistency, 0)
+	counts := countLinks(links)
+	for _, link := range links {
+		count := counts[link.Id]
+		if count == 0 {
+			continue
+		}
+		// Other occurrences are skipped, fixes below handle all of them
+		counts[link.Id] = 0
+		link := link
+		issue := Inconsistency{Username: username, ListId: link.Id}
+		removeLink := func() error {
+			return remove(username, link.Id)
+		}
+		listRec, ok := listsById[link.Id]
+		switch {
+		case !ok:
+			issue.Kind = IssueOrphanedLink
+			issue.Problem = fmt.Sprintf("%s has %s list %s which doesn't exist", username, kind, link.Id)
+			issue.Repair = "remove the link"
+			issue.fix = removeLink
+		case owned && listRec.Owner != username:
+			issue.Kind = IssueMismatchedOwner
+			issue.Problem = fmt.Sprintf("%s has owned list %s which is owned by %s", username, link.Id, listRec.Owner)
+			issue.Repair = "remove the link"
+			issue.fix = removeLink
+		case !owned && listRec.Owner == username:
+			issue.Kind = IssueMismatchedOwner
+			issue.Problem = fmt.Sprintf("%s has shared list %s which they own", username, link.Id)
+			issue.Repair = "remove the link"
+			issue.fix = removeLink
+		case !owned && !hasGuest(listRec, username):
+			issue.Kind = IssueOrphanedLink
+			issue.Problem = fmt.Sprintf("%s has shared list %s but is not its guest", username, link.Id)
+			issue.Repair = "remove the link"
+			issue.fix = removeLink
+		case count > 1:
+			kept := listLink{Id: link.Id, DisplayName: listRec.OriginalName}
+			if link.Aliased {
+				kept = link
+			}
+			issue.Kind = IssueDuplicateLink
+			issue.Problem = fmt.Sprintf("%s has %s list %s %d times", username, kind, link.Id, count)
+			issue.Repair = fmt.Sprintf("keep one link named %q", kept.DisplayName)
+			issue.fix = func() error {
+				if err := removeLink(); err != nil {
+					return err
+				}
+				return add(username, kept)
+			}
+		case !link.Aliased && link.DisplayName != listRec.OriginalName:
+			name := listRec.OriginalName
+			issue.Kind = IssueStaleName
+			issue.Problem = fmt.Sprintf("%s has %s list %s named %q instead of %q", username, kind, link.Id, link.DisplayName, name)
+			issue.Repair = "rename the link"
+			issue.fix = func() error {
+				return s.access.SetDisplayName(username, link.Id, name)
+			}
+		default:
+			continue
+		}
+		issues = append(issues, issue)
+	}
+	return issues
+}
+
+// checkMembers checks that the owner and guests of the list have links to it
+func (s *Service) checkMembers(listRec *list, recordsByUsername map[string]*accessRecord) []Inconsistency {
+	issues := make([]Inconsistency, 0)
+	id, owner, name := listRec.Id, listRec.Owner, listRec.OriginalName
+	ownerRecord, ok := recordsByUsername[owner]
+	if !ok {
+		issues = append(issues, Inconsistency{
+			Kind:     IssueMissingLink,
+			Username: owner,
+			ListId:   id,
+			Problem:  fmt.Sprintf("owner %s of list %s has no access record", owner, id),
+			Repair:   "create the record with the link",
+			fix: func() error {
+				return s.access.Insert(accessRecord{
+					Username:    owner,
+					OwnedLists:  []listLink{{Id: id, DisplayName: name}},
+					SharedLists: make([]listLink, 0, 1),
+				})
+			},
+		})
+	} else if findLink(ownerRecord.OwnedLists, id) == nil {
+		issues = append(issues, Inconsistency{
+			Kind:     IssueMissingLink,
+			Username: owner,
+			ListId:   id,
+			Problem:  fmt.Sprintf("owner %s has no link to list %s", owner, id),
+			Repair:   "add the link",
+			fix: func() error {
+				return s.access.AddOwned(owner, listLink{Id: id, DisplayName: name})
+			},
+		})
+	}
+	counts := make(map[string]int, len(listRec.Guests))
+	for _, guest := range listRec.Guests {
+		counts[guest]++
+	}
+	for _, guest := range listRec.Guests {
+		count := counts[guest]
+		if count == 0 {
+			continue
+		}
+		counts[guest] = 0
+		guest := guest
+		issue := Inconsistency{Username: guest, ListId: id}
+		removeGuest := func() error {
+			return s.lists.RemoveGuest(id, guest)
+		}
+		guestRecord, ok := recordsByUsername[guest]
+		switch {
+		case guest == owner:
+			issue.Kind = IssueDanglingGuest
+			issue.Problem = fmt.Sprintf("owner %s is a guest of their list %s", guest, id)
+			issue.Repair = "remove the guest"
+			issue.fix = removeGuest
+		case !ok || findLink(guestRecord.SharedLists, id) == nil:
+			issue.Kind = IssueDanglingGuest
+			issue.Problem = fmt.Sprintf("guest %s of list %s has no link to it", guest, id)
+			issue.Repair = "remove the guest"
+			issue.fix = removeGuest
+		case count > 1:
+			issue.Kind = IssueDuplicateGuest
+			issue.Problem = fmt.Sprintf("%s is a guest of list %s %d times", guest, id, count)
+			issue.Repair = "keep one"
+			issue.fix = func() error {
+				if err := removeGuest(); err != nil {
+					return err
+				}
+				return s.lists.AddGuest(id, guest, listRec.roleOf(guest))
+			}
+		default:
+			continue
+		}
+		issues = append(issues, issue)
+	}
+	return issues
+}
@@ -2,7 +2,7 @@ package logic
 
 import (
 	"context"
-	"errors"
+	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -11,46 +11,339 @@ import (
 	"time"
 )
 
-var listCollection *mongo.Collection
-var accessCollection *mongo.Collection
+type mongoLists struct {
+	ctx        context.Context
+	collection *mongo.Collection
+}
+
+type mongoAccess struct {
+	ctx        context.Context
+	collection *mongo.Collection
+}
+
+type mongoRequests struct {
+	ctx        context.Context
+	collection *mongo.Collection
+}
+
+type mongoNotifications struct {
+	ctx        context.Context
+	collection *mongo.Collection
+}
 
-func InitDB(url, dbName, accessCollectionName, listCollectionName string) error {
+type mongoTombstones struct {
+	ctx        context.Context
+	collection *mongo.Collection
+}
+
+type mongoInvites struct {
+	ctx        context.Context
+	collection *mongo.Collection
+}
+
+type mongoGroups struct {
+	ctx        context.Context
+	collection *mongo.Collection
+}
+
+type mongoRevisions struct {
+	ctx        context.Context
+	collection *mongo.Collection
+}
+
+type mongoItemOps struct {
+	ctx        context.Context
+	collection *mongo.Collection
+}
+
+// Collections holds names of the collections used by the package
+type Collections struct {
+	Access        string
+	Lists         string
+	Requests      string
+	Notifications string
+	Tombstones    string
+	Invites       string
+	Groups        string
+	Revisions     string
+	ItemOps       string
+}
+
+func NewMongoStorage(url, dbName string, collections Collections, timeout time.Duration) (*Storage, error) {
 	client, err := mongo.NewClient(options.Client().ApplyURI(url))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 	err = client.Connect(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = client.Ping(ctx, readpref.Primary())
 	if err != nil {
-		return err
+		return nil, err
 	}
-	listCollection = client.Database(dbName).Collection(listCollectionName)
-	_, err = listCollection.Indexes().CreateOne(context.TODO(),
-		mongo.IndexModel{
+	listCollection := client.Database(dbName).Collection(collections.Lists)
+	_, err = listCollection.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
 			Keys:    bsonx.Doc{{"id", bsonx.Int32(1)}},
 			Options: options.Index().SetUnique(true),
-		})
+		},
+		{
+			// Only public lists have a token
+			Keys:    bsonx.Doc{{"public_token", bsonx.Int32(1)}},
+			Options: options.Index().SetUnique(true).SetSparse(true),
+		},
+		{
+			Keys: bsonx.Doc{{"groups.group_id", bsonx.Int32(1)}},
+		},
+		{
+			// Only lists in the trash have it
+			Keys:    bsonx.Doc{{"deleted", bsonx.Int32(1)}},
+			Options: options.Index().SetSparse(true),
+		},
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	accessCollection = client.Database(dbName).Collection(accessCollectionName)
+	accessCollection := client.Database(dbName).Collection(collections.Access)
 	_, err = accessCollection.Indexes().CreateOne(context.TODO(),
 		mongo.IndexModel{
 			Keys:    bsonx.Doc{{"username", bsonx.Int32(1)}},
 			Options: options.Index().SetUnique(true),
 		})
 	if err != nil {
+		return nil, err
+	}
+	requestCollection := client.Database(dbName).Collection(collections.Requests)
+	_, err = requestCollection.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys:    bsonx.Doc{{"id", bsonx.Int32(1)}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			// Only one pending request per guest and list
+			Keys:    bsonx.Doc{{"list_id", bsonx.Int32(1)}, {"guest", bsonx.Int32(1)}},
+			Options: options.Index().SetUnique(true),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	notificationCollection := client.Database(dbName).Collection(collections.Notifications)
+	_, err = notificationCollection.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys:    bsonx.Doc{{"id", bsonx.Int32(1)}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bsonx.Doc{{"username", bsonx.Int32(1)}, {"created", bsonx.Int32(-1)}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	tombstoneCollection := client.Database(dbName).Collection(collections.Tombstones)
+	_, err = tombstoneCollection.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys: bsonx.Doc{{"username", bsonx.Int32(1)}, {"removed", bsonx.Int32(1)}},
+		},
+		{
+			Keys:    bsonx.Doc{{"removed", bsonx.Int32(1)}},
+			Options: options.Index().SetExpireAfterSeconds(int32(tombstoneRetention.Seconds())),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	inviteCollection := client.Database(dbName).Collection(collections.Invites)
+	_, err = inviteCollection.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys:    bsonx.Doc{{"token", bsonx.Int32(1)}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bsonx.Doc{{"list_id", bsonx.Int32(1)}},
+		},
+		{
+			// Expired invites are removed, ones without expiry are kept
+			Keys:    bsonx.Doc{{"expires", bsonx.Int32(1)}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	groupCollection := client.Database(dbName).Collection(collections.Groups)
+	_, err = groupCollection.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys:    bsonx.Doc{{"id", bsonx.Int32(1)}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bsonx.Doc{{"members.username", bsonx.Int32(1)}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	revisionCollection := client.Database(dbName).Collection(collections.Revisions)
+	_, err = revisionCollection.Indexes().CreateOne(context.TODO(),
+		mongo.IndexModel{
+			Keys:    bsonx.Doc{{"list_id", bsonx.Int32(1)}, {"version", bsonx.Int32(-1)}},
+			Options: options.Index().SetUnique(true),
+		})
+	if err != nil {
+		return nil, err
+	}
+	itemOpCollection := client.Database(dbName).Collection(collections.ItemOps)
+	_, err = itemOpCollection.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys:    bsonx.Doc{{"list_id", bsonx.Int32(1)}, {"client_id", bsonx.Int32(1)}, {"clock", bsonx.Int32(1)}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bsonx.Doc{{"list_id", bsonx.Int32(1)}, {"clock", bsonx.Int32(1)}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	repos := mongoCollections{
+		lists:         listCollection,
+		access:        accessCollection,
+		requests:      requestCollection,
+		notifications: notificationCollection,
+		tombstones:    tombstoneCollection,
+		invites:       inviteCollection,
+		groups:        groupCollection,
+		revisions:     revisionCollection,
+		itemOps:       itemOpCollection,
+	}
+	storage := repos.bind(context.Background())
+	transactions, err := supportsTransactions(client)
+	if err != nil {
+		return nil, err
+	}
+	if transactions {
+		storage.transactions = mongoTransactions{client: client, collections: repos}
+	} else {
+		log.Warning("MongoDB is not a replica set, multi-document writes fall back to compensations")
+	}
+	return storage, nil
+}
+
+type mongoCollections struct {
+	lists         *mongo.Collection
+	access        *mongo.Collection
+	requests      *mongo.Collection
+	notifications *mongo.Collection
+	tombstones    *mongo.Collection
+	invites       *mongo.Collection
+	groups        *mongo.Collection
+	revisions     *mongo.Collection
+	itemOps       *mongo.Collection
+}
+
+// bind returns repositories running their operations in ctx, which may carry a session
+func (c mongoCollections) bind(ctx context.Context) *Storage {
+	return &Storage{
+		lists:         mongoLists{ctx: ctx, collection: c.lists},
+		access:        mongoAccess{ctx: ctx, collection: c.access},
+		requests:      mongoRequests{ctx: ctx, collection: c.requests},
+		notifications: mongoNotifications{ctx: ctx, collection: c.notifications},
+		tombstones:    mongoTombstones{ctx: ctx, collection: c.tombstones},
+		invites:       mongoInvites{ctx: ctx, collection: c.invites},
+		groups:        mongoGroups{ctx: ctx, collection: c.groups},
+		revisions:     mongoRevisions{ctx: ctx, collection: c.revisions},
+		itemOps:       mongoItemOps{ctx: ctx, collection: c.itemOps},
+	}
+}
+
+// supportsTransactions checks if the server is a replica set member or mongos, standalone servers have no transactions
+func supportsTransactions(client *mongo.Client) (bool, error) {
+	var status struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	err := client.Database("admin").RunCommand(context.TODO(), bson.D{{"isMaster", 1}}).Decode(&status)
+	if err != nil {
+		return false, err
+	}
+	return status.SetName != "" || status.Msg == "isdbgrid", nil
+}
+
+type mongoTransactions struct {
+	client      *mongo.Client
+	collections mongoCollections
+}
+
+func (t mongoTransactions) inTransaction(f func(tx *Storage) error) error {
+	return t.client.UseSession(context.Background(), func(sc mongo.SessionContext) error {
+		_, err := sc.WithTransaction(sc, func(sc mongo.SessionContext) (interface{}, error) {
+			return nil, f(t.collections.bind(sc))
+		})
 		return err
+	})
+}
+
+// duplicateKeyCode is the code of errors MongoDB returns when a write violates a unique index
+const duplicateKeyCode = 11000
+
+// isDuplicateKey reports whether err is a violation of a unique index
+func isDuplicateKey(err error) bool {
+	switch e := err.(type) {
+	case mongo.WriteException:
+		for _, writeErr := range e.WriteErrors {
+			if writeErr.Code == duplicateKeyCode {
+				return true
+			}
+		}
+	case mongo.CommandError:
+		return e.Code == duplicateKeyCode
 	}
-	return nil
+	return false
 }
 
-func getAccessByUsername(username string) (*accessRecord, error) {
-	res := accessCollection.FindOne(context.TODO(), bson.D{{"username", username}})
+// notTrashed matches lists which are not in the trash, null also matches a missing field
+var notTrashed = bson.E{"deleted", nil}
+
+func (r mongoLists) All() ([]list, error) {
+	return r.find(bson.D{notTrashed}, options.Find())
+}
+
+func (r mongoLists) find(filter bson.D, opts *options.FindOptions) ([]list, error) {
+	cursor, err := r.collection.Find(r.ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	lists := make([]list, 0, 1)
+	err = cursor.All(r.ctx, &lists)
+	if err != nil {
+		return nil, err
+	}
+	return lists, nil
+}
+
+func (r mongoAccess) All() ([]accessRecord, error) {
+	cursor, err := r.collection.Find(r.ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	records := make([]accessRecord, 0, 1)
+	err = cursor.All(r.ctx, &records)
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (r mongoAccess) Get(username string) (*accessRecord, error) {
+	res := r.collection.FindOne(r.ctx, bson.D{{"username", username}})
+	if res.Err() == mongo.ErrNoDocuments {
+		return nil, errNotFound
+	}
 	if res.Err() != nil {
 		return nil, res.Err()
 	}
@@ -62,8 +355,11 @@ func getAccessByUsername(username string) (*accessRecord, error) {
 	return &record, nil
 }
 
-func getListById(id string) (*list, error) {
-	res := listCollection.FindOne(context.TODO(), bson.D{{"id", id}})
+func (r mongoLists) Get(id string) (*list, error) {
+	res := r.collection.FindOne(r.ctx, bson.D{{"id", id}, notTrashed})
+	if res.Err() == mongo.ErrNoDocuments {
+		return nil, errNotFound
+	}
 	if res.Err() != nil {
 		return nil, res.Err()
 	}
@@ -75,86 +371,801 @@ func getListById(id string) (*list, error) {
 	return &listRec, nil
 }
 
-func updateList(id, content string) error {
-	res, err := listCollection.UpdateOne(context.TODO(), bson.D{{"id", id}}, bson.D{{"$set", bson.D{{"last_changed", time.Now()}, {"content", content}}}})
+// listFilter matches the list with the given id, and only in the given version unless it is anyVersion.
+// Lists created before versioning have no version field and are treated as version 0.
+func listFilter(id string, version int64) bson.D {
+	filter := bson.D{{"id", id}}
+	if version == 0 {
+		filter = append(filter, bson.E{"version", bson.D{{"$in", bson.A{0, nil}}}})
+	} else if version != anyVersion {
+		filter = append(filter, bson.E{"version", version})
+	}
+	return filter
+}
+
+// modify applies update to the list matched by filter, bumping its version.
+// Returns the new version or errVersionMismatch if nothing matched.
+func (r mongoLists) modify(filter, update bson.D) (int64, error) {
+	filter = append(filter, notTrashed)
+	update = append(update, bson.E{"$inc", bson.D{{"version", 1}}})
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetProjection(bson.D{{"version", 1}})
+	res := r.collection.FindOneAndUpdate(r.ctx, filter, update, opts)
+	if res.Err() == mongo.ErrNoDocuments {
+		return 0, errVersionMismatch
+	}
+	if res.Err() != nil {
+		return 0, res.Err()
+	}
+	var versioned struct {
+		Version int64 `bson:"version"`
+	}
+	err := res.Decode(&versioned)
+	if err != nil {
+		return 0, err
+	}
+	return versioned.Version, nil
+}
+
+func (r mongoLists) SetItems(id string, items []item, version int64) (int64, error) {
+	return r.modify(listFilter(id, version), bson.D{
+		{"$set", bson.D{{"last_changed", time.Now()}, {"items", items}}},
+		{"$unset", bson.D{{"content", ""}}},
+	})
+}
+
+func (r mongoLists) PushItem(id string, it item, version int64) (int64, error) {
+	return r.modify(listFilter(id, version), bson.D{
+		{"$set", bson.D{{"last_changed", time.Now()}}},
+		{"$push", bson.D{{"items", it}}},
+	})
+}
+
+func (r mongoLists) UpdateItem(id, itemId string, changes itemChanges, st stamp, version int64) (int64, error) {
+	fields := bson.D{{"last_changed", time.Now()}}
+	if changes.Name != nil {
+		fields = append(fields, bson.E{"items.$.name", *changes.Name}, bson.E{"items.$.stamps.name", st})
+	}
+	if changes.Quantity != nil {
+		fields = append(fields, bson.E{"items.$.quantity", *changes.Quantity}, bson.E{"items.$.stamps.quantity", st})
+	}
+	if changes.Unit != nil {
+		fields = append(fields, bson.E{"items.$.unit", *changes.Unit}, bson.E{"items.$.stamps.unit", st})
+	}
+	if changes.Checked != nil {
+		fields = append(fields, bson.E{"items.$.checked", *changes.Checked}, bson.E{"items.$.stamps.checked", st})
+	}
+	if changes.Note != nil {
+		fields = append(fields, bson.E{"items.$.note", *changes.Note}, bson.E{"items.$.stamps.note", st})
+	}
+	filter := append(listFilter(id, version), bson.E{"items.id", itemId})
+	return r.modify(filter, bson.D{{"$set", fields}})
+}
+
+func (r mongoLists) Rename(id, name string, version int64) (int64, error) {
+	return r.modify(listFilter(id, version), bson.D{
+		{"$set", bson.D{{"name", name}, {"last_changed", time.Now()}}},
+	})
+}
+
+func (r mongoLists) PullItem(id, itemId string, version int64) (int64, error) {
+	filter := append(listFilter(id, version), bson.E{"items.id", itemId})
+	return r.modify(filter, bson.D{
+		{"$set", bson.D{{"last_changed", time.Now()}}},
+		{"$pull", bson.D{{"items", bson.D{{"id", itemId}}}}},
+	})
+}
+
+func (r mongoLists) Insert(listRec list) error {
+	_, err := r.collection.InsertOne(r.ctx, listRec)
 	if err != nil {
 		return err
 	}
-	if res.ModifiedCount != 1 {
-		return errors.New("couldn't modify selected list")
+	return nil
+}
+
+func (r mongoLists) Remove(id string, version int64) error {
+	res, err := r.collection.DeleteOne(r.ctx, listFilter(id, version))
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount != 1 {
+		return errVersionMismatch
 	}
 	return nil
 }
 
-func insertListInDB(listRec list) error {
-	_, err := listCollection.InsertOne(context.TODO(), listRec)
+func (r mongoAccess) Insert(record accessRecord) error {
+	_, err := r.collection.InsertOne(r.ctx, record)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func removeListFromDB(id string) error {
-	res, err := listCollection.DeleteOne(context.TODO(), bson.D{{"id", id}})
+// addLink pushes the link to field of the record unless the user has a link to the list already
+func (r mongoAccess) addLink(username, field string, rec listLink) error {
+	res, err := r.collection.UpdateOne(r.ctx, bson.D{
+		{"username", username},
+		{"owned.id", bson.D{{"$ne", rec.Id}}},
+		{"shared.id", bson.D{{"$ne", rec.Id}}},
+	}, bson.D{{"$push", bson.D{{field, rec}}}})
 	if err != nil {
 		return err
 	}
-	if res.DeletedCount != 1 {
-		return errors.New("no list was deleted")
+	if res.MatchedCount == 1 {
+		return nil
+	}
+	count, err := r.collection.CountDocuments(r.ctx, bson.D{{"username", username}})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errNotFound
+	}
+	return errDuplicate
+}
+
+func (r mongoAccess) AddOwned(username string, rec listLink) error {
+	return r.addLink(username, "owned", rec)
+}
+func (r mongoLists) AddGuest(id, username, role string) error {
+	_, err := r.modify(bson.D{{"id", id}, {"guests", bson.D{{"$ne", username}}}}, bson.D{
+		{"$push", bson.D{{"guests", username}, {"roles", guestRole{Username: username, Role: role}}}},
+		{"$set", bson.D{{"last_changed", time.Now()}}},
+	})
+	if err != errVersionMismatch {
+		return err
+	}
+	count, err := r.collection.CountDocuments(r.ctx, bson.D{{"id", id}})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errNotFound
+	}
+	return errDuplicate
+}
+
+func (r mongoLists) RemoveGuest(id, username string) error {
+	_, err := r.modify(bson.D{{"id", id}}, bson.D{
+		{"$pull", bson.D{{"guests", username}, {"roles", bson.D{{"username", username}}}}},
+		{"$set", bson.D{{"last_changed", time.Now()}}},
+	})
+	if err == errVersionMismatch {
+		return errNotFound
+	}
+	return err
+}
+
+func (r mongoLists) SetOwner(id, owner string) error {
+	_, err := r.modify(bson.D{{"id", id}}, bson.D{
+		{"$set", bson.D{{"owner", owner}, {"last_changed", time.Now()}}},
+	})
+	if err == errVersionMismatch {
+		return errNotFound
+	}
+	return err
+}
+
+func (r mongoLists) SetPublicToken(id, token string) error {
+	update := bson.D{{"$set", bson.D{{"public_token", token}}}}
+	if token == "" {
+		update = bson.D{{"$unset", bson.D{{"public_token", ""}}}}
+	}
+	res, err := r.collection.UpdateOne(r.ctx, bson.D{{"id", id}}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount != 1 {
+		return errNotFound
 	}
 	return nil
 }
 
-func insertAccessRecord(record accessRecord) error {
-	_, err := accessCollection.InsertOne(context.TODO(), record)
+func (r mongoLists) ByPublicToken(token string) (*list, error) {
+	if token == "" {
+		return nil, errNotFound
+	}
+	res := r.collection.FindOne(r.ctx, bson.D{{"public_token", token}, notTrashed})
+	if res.Err() == mongo.ErrNoDocuments {
+		return nil, errNotFound
+	}
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+	var listRec list
+	if err := res.Decode(&listRec); err != nil {
+		return nil, err
+	}
+	return &listRec, nil
+}
+
+func (r mongoLists) SetRole(id, username, role string) error {
+	_, err := r.modify(bson.D{{"id", id}, {"roles.username", username}}, bson.D{
+		{"$set", bson.D{{"roles.$.role", role}, {"last_changed", time.Now()}}},
+	})
+	if err != errVersionMismatch {
+		return err
+	}
+	// Guests added before roles existed have no role yet
+	_, err = r.modify(bson.D{{"id", id}, {"guests", username}}, bson.D{
+		{"$push", bson.D{{"roles", guestRole{Username: username, Role: role}}}},
+		{"$set", bson.D{{"last_changed", time.Now()}}},
+	})
+	if err == errVersionMismatch {
+		return errNotFound
+	}
+	return err
+}
+
+func (r mongoLists) AddGroup(id string, share groupShare) error {
+	_, err := r.modify(bson.D{{"id", id}, {"groups.group_id", bson.D{{"$ne", share.GroupId}}}}, bson.D{
+		{"$push", bson.D{{"groups", share}}},
+		{"$set", bson.D{{"last_changed", time.Now()}}},
+	})
+	if err != errVersionMismatch {
+		return err
+	}
+	count, err := r.collection.CountDocuments(r.ctx, bson.D{{"id", id}})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errNotFound
+	}
+	return errDuplicate
+}
+
+func (r mongoLists) RemoveGroup(id, groupId string) error {
+	_, err := r.modify(bson.D{{"id", id}, {"groups.group_id", groupId}}, bson.D{
+		{"$pull", bson.D{{"groups", bson.D{{"group_id", groupId}}}}},
+		{"$set", bson.D{{"last_changed", time.Now()}}},
+	})
+	if err == errVersionMismatch {
+		return errNotFound
+	}
+	return err
+}
+
+func (r mongoLists) ByGroup(groupId string) ([]list, error) {
+	return r.find(bson.D{{"groups.group_id", groupId}, notTrashed}, options.Find().SetSort(bson.D{{"id", 1}}))
+}
+
+func (r mongoLists) Trash(id string, deleted time.Time, version int64) (int64, error) {
+	return r.modify(listFilter(id, version), bson.D{
+		{"$set", bson.D{{"deleted", deleted}, {"last_changed", time.Now()}}},
+	})
+}
+
+func (r mongoLists) Restore(id string) (int64, error) {
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetProjection(bson.D{{"version", 1}})
+	res := r.collection.FindOneAndUpdate(r.ctx, bson.D{{"id", id}, {"deleted", bson.D{{"$ne", nil}}}}, bson.D{
+		{"$unset", bson.D{{"deleted", ""}}},
+		{"$set", bson.D{{"last_changed", time.Now()}}},
+		{"$inc", bson.D{{"version", 1}}},
+	}, opts)
+	if res.Err() == mongo.ErrNoDocuments {
+		return 0, errNotFound
+	}
+	if res.Err() != nil {
+		return 0, res.Err()
+	}
+	var versioned struct {
+		Version int64 `bson:"version"`
+	}
+	if err := res.Decode(&versioned); err != nil {
+		return 0, err
+	}
+	return versioned.Version, nil
+}
+
+func (r mongoLists) Trashed(owner string) ([]list, error) {
+	return r.find(bson.D{{"owner", owner}, {"deleted", bson.D{{"$ne", nil}}}}, options.Find().SetSort(bson.D{{"deleted", -1}}))
+}
+
+func (r mongoLists) TrashedBefore(before time.Time) ([]list, error) {
+	return r.find(bson.D{{"deleted", bson.D{{"$lt", before}}}}, options.Find().SetSort(bson.D{{"deleted", 1}}))
+}
+
+func (r mongoAccess) AddShared(username string, rec listLink) error {
+	return r.addLink(username, "shared", rec)
+}
+
+func (r mongoAccess) RemoveOwned(username, id string) error {
+	return r.removeLink(username, "owned", id)
+}
+func (r mongoAccess) RemoveShared(username, id string) error {
+	return r.removeLink(username, "shared", id)
+}
+
+// removeLink pulls the link to the list from field of the record
+func (r mongoAccess) removeLink(username, field, id string) error {
+	res, err := r.collection.UpdateOne(r.ctx, bson.D{{"username", username}}, bson.D{{"$pull", bson.D{{field, bson.D{{"id", id}}}}}})
 	if err != nil {
 		return err
 	}
+	if res.MatchedCount == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (r mongoAccess) SetDisplayName(username, id, name string) error {
+	for _, field := range []string{"owned", "shared"} {
+		_, err := r.collection.UpdateMany(r.ctx,
+			bson.D{{"username", username}, {field + ".id", id}},
+			bson.D{{"$set", bson.D{{field + ".$[link].display", name}}}},
+			options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{
+				bson.D{{"link.id", id}, {"link.aliased", bson.D{{"$ne", true}}}},
+			}}))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r mongoAccess) SetAlias(username, id, name string, aliased bool) error {
+	var matched int64
+	for _, field := range []string{"owned", "shared"} {
+		res, err := r.collection.UpdateOne(r.ctx,
+			bson.D{{"username", username}, {field + ".id", id}},
+			bson.D{{"$set", bson.D{{field + ".$.display", name}, {field + ".$.aliased", aliased}}}})
+		if err != nil {
+			return err
+		}
+		matched += res.MatchedCount
+	}
+	if matched == 0 {
+		return errNotFound
+	}
 	return nil
 }
 
-func updateAccessRecord(record accessRecord) error {
-	_, err := accessCollection.UpdateOne(context.TODO(), bson.D{{"username", record.Username}}, bson.D{{"$set", record}})
+func (r mongoRequests) Insert(req shareRequest) error {
+	_, err := r.collection.InsertOne(r.ctx, req)
+	if isDuplicateKey(err) {
+		return errDuplicate
+	}
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func addToAccessListsOwned(username string, rec listLink) error {
-	res := accessCollection.FindOneAndUpdate(context.TODO(), bson.D{{"username", username}}, bson.D{{"$push", bson.D{{"owned", rec}}}})
+func (r mongoRequests) Get(id string) (*shareRequest, error) {
+	res := r.collection.FindOne(r.ctx, bson.D{{"id", id}})
+	if res.Err() == mongo.ErrNoDocuments {
+		return nil, errNotFound
+	}
 	if res.Err() != nil {
-		return res.Err()
+		return nil, res.Err()
+	}
+	var req shareRequest
+	err := res.Decode(&req)
+	if err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func (r mongoRequests) find(filter bson.D) ([]shareRequest, error) {
+	cursor, err := r.collection.Find(r.ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	requests := make([]shareRequest, 0, 1)
+	err = cursor.All(r.ctx, &requests)
+	if err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
+
+func (r mongoRequests) ByGuest(guest string) ([]shareRequest, error) {
+	return r.find(bson.D{{"guest", guest}})
+}
+
+func (r mongoRequests) ByOwner(owner string) ([]shareRequest, error) {
+	return r.find(bson.D{{"owner", owner}})
+}
+
+func (r mongoRequests) Remove(id string) error {
+	res, err := r.collection.DeleteOne(r.ctx, bson.D{{"id", id}})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount != 1 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (r mongoRequests) RemoveForList(listId string) error {
+	_, err := r.collection.DeleteMany(r.ctx, bson.D{{"list_id", listId}})
+	return err
+}
+
+func (r mongoNotifications) Insert(n notification) error {
+	_, err := r.collection.InsertOne(r.ctx, n)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r mongoNotifications) Find(username string, unreadOnly bool, offset, limit int64) ([]notification, error) {
+	filter := bson.D{{"username", username}}
+	if unreadOnly {
+		filter = append(filter, bson.E{"read", false})
+	}
+	opts := options.Find().SetSort(bson.D{{"created", -1}}).SetSkip(offset).SetLimit(limit)
+	cursor, err := r.collection.Find(r.ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	notifications := make([]notification, 0, 1)
+	err = cursor.All(r.ctx, &notifications)
+	if err != nil {
+		return nil, err
+	}
+	return notifications, nil
+}
+
+func (r mongoNotifications) Count(username string, unreadOnly bool) (int64, error) {
+	filter := bson.D{{"username", username}}
+	if unreadOnly {
+		filter = append(filter, bson.E{"read", false})
+	}
+	return r.collection.CountDocuments(r.ctx, filter)
+}
+
+func (r mongoNotifications) MarkRead(username, id string) error {
+	filter := bson.D{{"username", username}}
+	if id != "" {
+		filter = append(filter, bson.E{"id", id})
+	}
+	res, err := r.collection.UpdateMany(r.ctx, filter, bson.D{{"$set", bson.D{{"read", true}}}})
+	if err != nil {
+		return err
+	}
+	if id != "" && res.MatchedCount != 1 {
+		return errNotificationNotFound
 	}
 	return nil
 }
-func addToListGuests(username, id string) error {
-	res := listCollection.FindOneAndUpdate(context.TODO(), bson.D{{"id", id}}, bson.D{{"$push", bson.D{{"guests", username}}}})
+
+func (r mongoNotifications) Remove(username, id string) error {
+	res, err := r.collection.DeleteOne(r.ctx, bson.D{{"username", username}, {"id", id}})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount != 1 {
+		return errNotificationNotFound
+	}
+	return nil
+}
+
+func (r mongoLists) ChangedSince(ids []string, since time.Time) ([]list, error) {
+	return r.find(bson.D{
+		{"id", bson.D{{"$in", ids}}},
+		{"last_changed", bson.D{{"$gt", since}}},
+		notTrashed,
+	}, options.Find())
+}
+
+func (r mongoTombstones) Insert(id string, usernames []string, removed time.Time) error {
+	if len(usernames) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, 0, len(usernames))
+	for _, username := range usernames {
+		docs = append(docs, tombstone{ListId: id, Username: username, Removed: removed})
+	}
+	_, err := r.collection.InsertMany(r.ctx, docs)
+	return err
+}
+
+func (r mongoTombstones) Since(username string, since time.Time) ([]tombstone, error) {
+	cursor, err := r.collection.Find(r.ctx, bson.D{
+		{"username", username},
+		{"removed", bson.D{{"$gt", since}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	tombstones := make([]tombstone, 0, 1)
+	err = cursor.All(r.ctx, &tombstones)
+	if err != nil {
+		return nil, err
+	}
+	return tombstones, nil
+}
+
+func (r mongoInvites) Insert(inv invite) error {
+	_, err := r.collection.InsertOne(r.ctx, inv)
+	return err
+}
+
+func (r mongoInvites) Get(token string) (*invite, error) {
+	res := r.collection.FindOne(r.ctx, bson.D{{"token", token}})
+	if res.Err() == mongo.ErrNoDocuments {
+		return nil, errNotFound
+	}
 	if res.Err() != nil {
-		return res.Err()
+		return nil, res.Err()
+	}
+	var inv invite
+	if err := res.Decode(&inv); err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+func (r mongoInvites) ByList(listId string) ([]invite, error) {
+	cursor, err := r.collection.Find(r.ctx, bson.D{{"list_id", listId}})
+	if err != nil {
+		return nil, err
+	}
+	invites := make([]invite, 0, 1)
+	err = cursor.All(r.ctx, &invites)
+	if err != nil {
+		return nil, err
+	}
+	return invites, nil
+}
+
+func (r mongoInvites) Use(token string) error {
+	res, err := r.collection.UpdateOne(r.ctx, bson.D{
+		{"token", token},
+		{"$or", bson.A{
+			bson.D{{"max_uses", 0}},
+			bson.D{{"$expr", bson.D{{"$lt", bson.A{"$uses", "$max_uses"}}}}},
+		}},
+	}, bson.D{{"$inc", bson.D{{"uses", 1}}}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount != 1 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (r mongoInvites) Release(token string) error {
+	res, err := r.collection.UpdateOne(r.ctx, bson.D{{"token", token}, {"uses", bson.D{{"$gt", 0}}}},
+		bson.D{{"$inc", bson.D{{"uses", -1}}}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount != 1 {
+		return errNotFound
 	}
 	return nil
 }
 
-func addToAccessListsShared(username string, rec listLink) error {
-	res := accessCollection.FindOneAndUpdate(context.TODO(), bson.D{{"username", username}}, bson.D{{"$push", bson.D{{"shared", rec}}}})
+func (r mongoInvites) Remove(listId, id string) error {
+	res, err := r.collection.DeleteOne(r.ctx, bson.D{{"list_id", listId}, {"id", id}})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount != 1 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (r mongoInvites) RemoveForList(listId string) error {
+	_, err := r.collection.DeleteMany(r.ctx, bson.D{{"list_id", listId}})
+	return err
+}
+
+func (r mongoGroups) Insert(g group) error {
+	_, err := r.collection.InsertOne(r.ctx, g)
+	return err
+}
+
+func (r mongoGroups) Get(id string) (*group, error) {
+	res := r.collection.FindOne(r.ctx, bson.D{{"id", id}})
+	if res.Err() == mongo.ErrNoDocuments {
+		return nil, errNotFound
+	}
 	if res.Err() != nil {
-		return res.Err()
+		return nil, res.Err()
+	}
+	var g group
+	if err := res.Decode(&g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (r mongoGroups) ByMember(username string) ([]group, error) {
+	cursor, err := r.collection.Find(r.ctx, bson.D{{"members.username", username}}, options.Find().SetSort(bson.D{{"id", 1}}))
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]group, 0, 1)
+	err = cursor.All(r.ctx, &groups)
+	if err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func (r mongoGroups) AddMember(id string, member groupMember) error {
+	res, err := r.collection.UpdateOne(r.ctx,
+		bson.D{{"id", id}, {"members.username", bson.D{{"$ne", member.Username}}}},
+		bson.D{{"$push", bson.D{{"members", member}}}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 1 {
+		return nil
+	}
+	count, err := r.collection.CountDocuments(r.ctx, bson.D{{"id", id}})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errNotFound
+	}
+	return errDuplicate
+}
+
+func (r mongoGroups) RemoveMember(id, username string) error {
+	res, err := r.collection.UpdateOne(r.ctx,
+		bson.D{{"id", id}, {"members.username", username}},
+		bson.D{{"$pull", bson.D{{"members", bson.D{{"username", username}}}}}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount != 1 {
+		return errNotFound
 	}
 	return nil
 }
 
-func removeFromAccessListsOwned(username, id string) error {
-	res := accessCollection.FindOneAndUpdate(context.TODO(), bson.D{{"username", username}}, bson.D{{"$pull", bson.D{{"owned", bson.D{{"id", id}}}}}})
+func (r mongoGroups) SetMemberRole(id, username, role string) error {
+	res, err := r.collection.UpdateOne(r.ctx,
+		bson.D{{"id", id}, {"members.username", username}},
+		bson.D{{"$set", bson.D{{"members.$.role", role}}}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount != 1 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (r mongoGroups) Remove(id string) error {
+	res, err := r.collection.DeleteOne(r.ctx, bson.D{{"id", id}})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount != 1 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (r mongoRevisions) Insert(rev revision, keep int) error {
+	_, err := r.collection.InsertOne(r.ctx, rev)
+	if isDuplicateKey(err) {
+		return errDuplicate
+	}
+	if err != nil {
+		return err
+	}
+	// The oldest kept revision is found first, everything before it is dropped
+	opts := options.FindOne().
+		SetSort(bson.D{{"version", -1}}).
+		SetSkip(int64(keep - 1)).
+		SetProjection(bson.D{{"version", 1}})
+	res := r.collection.FindOne(r.ctx, bson.D{{"list_id", rev.ListId}}, opts)
+	if res.Err() == mongo.ErrNoDocuments {
+		return nil
+	}
 	if res.Err() != nil {
 		return res.Err()
 	}
-	return nil
+	var oldest struct {
+		Version int64 `bson:"version"`
+	}
+	if err = res.Decode(&oldest); err != nil {
+		return err
+	}
+	_, err = r.collection.DeleteMany(r.ctx, bson.D{{"list_id", rev.ListId}, {"version", bson.D{{"$lt", oldest.Version}}}})
+	return err
 }
-func removeFromAccessListsShared(username, id string) error {
-	res := accessCollection.FindOneAndUpdate(context.TODO(), bson.D{{"username", username}}, bson.D{{"$pull", bson.D{{"shared", bson.D{{"id", id}}}}}})
+
+func (r mongoRevisions) Get(listId string, version int64) (*revision, error) {
+	res := r.collection.FindOne(r.ctx, bson.D{{"list_id", listId}, {"version", version}})
+	if res.Err() == mongo.ErrNoDocuments {
+		return nil, errNotFound
+	}
+	if res.Err() != nil {
+		return nil, res.Err()
+	}
+	var rev revision
+	if err := res.Decode(&rev); err != nil {
+		return nil, err
+	}
+	return &rev, nil
+}
+
+func (r mongoRevisions) ByList(listId string) ([]revision, error) {
+	cursor, err := r.collection.Find(r.ctx, bson.D{{"list_id", listId}}, options.Find().SetSort(bson.D{{"version", -1}}))
+	if err != nil {
+		return nil, err
+	}
+	revisions := make([]revision, 0, 1)
+	err = cursor.All(r.ctx, &revisions)
+	if err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+func (r mongoRevisions) RemoveForList(listId string) error {
+	_, err := r.collection.DeleteMany(r.ctx, bson.D{{"list_id", listId}})
+	return err
+}
+
+func (r mongoItemOps) Insert(listId string, ops []itemOp, keep int) error {
+	for _, op := range ops {
+		// Operations are upserted, so the ones stored already are left as they are
+		_, err := r.collection.UpdateOne(r.ctx,
+			bson.D{{"list_id", listId}, {"client_id", op.ClientId}, {"clock", op.Clock}},
+			bson.D{{"$setOnInsert", op}},
+			options.Update().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+	}
+	opts := options.FindOne().
+		SetSort(bson.D{{"clock", -1}, {"client_id", -1}}).
+		SetSkip(int64(keep - 1)).
+		SetProjection(bson.D{{"clock", 1}, {"client_id", 1}})
+	res := r.collection.FindOne(r.ctx, bson.D{{"list_id", listId}}, opts)
+	if res.Err() == mongo.ErrNoDocuments {
+		return nil
+	}
 	if res.Err() != nil {
 		return res.Err()
 	}
-	return nil
+	var oldest stamp
+	if err := res.Decode(&oldest); err != nil {
+		return err
+	}
+	// Operations with the same clock as the oldest kept one are ordered by the client id, as their stamps are
+	_, err := r.collection.DeleteMany(r.ctx, bson.D{{"list_id", listId}, {"$or", bson.A{
+		bson.D{{"clock", bson.D{{"$lt", oldest.Clock}}}},
+		bson.D{{"clock", oldest.Clock}, {"client_id", bson.D{{"$lt", oldest.ClientId}}}},
+	}}})
+	return err
+}
+
+func (r mongoItemOps) Since(listId string, since int64) ([]itemOp, error) {
+	cursor, err := r.collection.Find(r.ctx, bson.D{{"list_id", listId}, {"clock", bson.D{{"$gt", since}}}},
+		options.Find().SetSort(bson.D{{"clock", 1}, {"client_id", 1}}))
+	if err != nil {
+		return nil, err
+	}
+	ops := make([]itemOp, 0)
+	err = cursor.All(r.ctx, &ops)
+	if err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+func (r mongoItemOps) RemoveForList(listId string) error {
+	_, err := r.collection.DeleteMany(r.ctx, bson.D{{"list_id", listId}})
+	return err
 }
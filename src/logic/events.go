@@ -0,0 +1,110 @@
+package logic
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	eventListEdited   = "list_edited"
+	eventListDeleted  = "list_deleted"
+	eventGuestAdded   = "guest_added"
+	eventGuestRemoved = "guest_removed"
+	eventRoleChanged  = "role_changed"
+	eventOwnerChanged = "owner_changed"
+	eventGroupAdded   = "group_added"
+	eventGroupRemoved = "group_removed"
+	eventListRenamed  = "list_renamed"
+	eventListRestored = "list_restored"
+)
+
+// subscriberBuffer is how many events a slow subscriber may lag behind before events are dropped for it
+const subscriberBuffer = 32
+
+// ListEvent describes a change of a list. Members are the users who had access to the list when it happened,
+// including members of groups it is shared with.
+type ListEvent struct {
+	Type    string    `json:"type"`
+	ListId  string    `json:"list_id"`
+	Actor   string    `json:"actor"`
+	Version int64     `json:"version"`
+	Time    time.Time `json:"time"`
+	Members []string  `json:"-"`
+}
+
+// EventBroker delivers list events to all subscribers of the server.
+// The in-process implementation can be replaced with one backed by a message broker
+// to fan out events between several server instances.
+type EventBroker interface {
+	Publish(event ListEvent)
+	// Subscribe returns a channel of all published events and a function to stop receiving them
+	Subscribe() (<-chan ListEvent, func())
+}
+
+type localBroker struct {
+	mutex       sync.RWMutex
+	nextId      int
+	subscribers map[int]chan ListEvent
+}
+
+// NewLocalBroker creates a broker that fans out events to subscribers of this process
+func NewLocalBroker() EventBroker {
+	return &localBroker{
+		subscribers: make(map[int]chan ListEvent),
+	}
+}
+
+func (b *localBroker) Publish(event ListEvent) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	for _, ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// Subscriber is too slow, it will have to catch up with a sync
+		}
+	}
+}
+
+func (b *localBroker) Subscribe() (<-chan ListEvent, func()) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	id := b.nextId
+	b.nextId++
+	ch := make(chan ListEvent, subscriberBuffer)
+	b.subscribers[id] = ch
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mutex.Lock()
+			defer b.mutex.Unlock()
+			delete(b.subscribers, id)
+			close(ch)
+		})
+	}
+}
+
+func listMembers(listRec *list) []string {
+	return append([]string{listRec.Owner}, listRec.Guests...)
+}
+
+func (s *Service) publishListEvent(kind, actor string, listRec *list, version int64) {
+	s.events.Publish(ListEvent{
+		Type:    kind,
+		ListId:  listRec.Id,
+		Actor:   actor,
+		Version: version,
+		Time:    time.Now(),
+		Members: append(listMembers(listRec), s.groupMembers(listRec)...),
+	})
+}
+
+// isMember reports whether the event should be delivered to the user
+func (e ListEvent) isMember(username string) bool {
+	for _, member := range e.Members {
+		if member == username {
+			return true
+		}
+	}
+	return false
+}
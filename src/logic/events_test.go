@@ -0,0 +1,60 @@
+package logic
+
+import (
+	"context"
+	"github.com/dgrijalva/jwt-go"
+	"net/http"
+	"net/http/httptest"
+	"shoppinglist-server/src/auth"
+	"strings"
+	"testing"
+	"time"
+)
+
+// streamEvents runs the event stream of the user with the token claims and returns once it has ended
+func streamEvents(t *testing.T, s *Service, claims jwt.MapClaims, wait time.Duration) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/v1/events", nil)
+	r = r.WithContext(context.WithValue(r.Context(), "user", &jwt.Token{Claims: claims}))
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		s.HandleEvents(w, r)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(wait):
+		t.Fatal("event stream has not ended")
+	}
+	return w
+}
+
+func TestEventStreamEndsWhenTokenExpires(t *testing.T) {
+	s := newTestService(t, "katya")
+	claims := jwt.MapClaims{"username": "katya", "jti": "token", "exp": float64(time.Now().Add(time.Second).Unix())}
+	w := streamEvents(t, s, claims, 5*time.Second)
+	expectStatus(t, w, http.StatusOK)
+}
+
+func TestEventStreamEndsWhenTokenIsRevoked(t *testing.T) {
+	s := newTestService(t, "katya")
+	s.eventKeepAlive = 10 * time.Millisecond
+	claims := jwt.MapClaims{"username": "katya", "jti": "token", "exp": float64(time.Now().Add(time.Hour).Unix())}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		if err := s.tokens.(auth.TokenStore).RevokeAccessToken("token", time.Now().Add(time.Hour)); err != nil {
+			t.Error(err)
+		}
+	}()
+	w := streamEvents(t, s, claims, 5*time.Second)
+	if !strings.Contains(w.Body.String(), ": keep-alive") {
+		t.Errorf("got stream %q before the token was revoked", w.Body.String())
+	}
+}
+
+func TestEventStreamNeedsExpiringToken(t *testing.T) {
+	s := newTestService(t, "katya")
+	w := streamEvents(t, s, jwt.MapClaims{"username": "katya"}, time.Second)
+	expectStatus(t, w, http.StatusUnauthorized)
+}
@@ -0,0 +1,408 @@
+package logic
+
+import (
+	"errors"
+	"github.com/segmentio/ksuid"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// Roles of group members, admins manage members and the group itself
+const (
+	groupRoleAdmin  = "admin"
+	groupRoleMember = "member"
+)
+
+var (
+	errGroupNotFound          = errors.New("group not found")
+	errEmptyGroupName         = errors.New("group name must not be empty")
+	errInvalidGroupRole       = errors.New("group role must be admin or member")
+	errNotGroupAdmin          = errors.New("only admins of the group can do this")
+	errNotGroupMember         = errors.New("user is not a member of the group")
+	errAlreadyGroupMember     = errors.New("user is already a member of the group")
+	errLastAdmin              = errors.New("the group must keep at least one admin")
+	errAlreadySharedWithGroup = errors.New("list is already shared with the group")
+	errNotSharedWithGroup     = errors.New("list is not shared with the group")
+)
+
+// group is a household or another set of users sharing lists.
+// Members of a group have access to every list shared with it for as long as they are members.
+type group struct {
+	Id      string        `bson:"id" json:"id"`
+	Name    string        `bson:"name" json:"name"`
+	Members []groupMember `bson:"members" json:"members"`
+	Created time.Time     `bson:"created" json:"created"`
+}
+
+type groupMember struct {
+	Username string    `bson:"username" json:"username"`
+	Role     string    `bson:"role" json:"role"`
+	Joined   time.Time `bson:"joined" json:"joined"`
+}
+
+// groupShare gives members of the group the role in the list
+type groupShare struct {
+	GroupId string `bson:"group_id" json:"group_id"`
+	Role    string `bson:"role" json:"role"`
+}
+
+func validGroupRole(role string) bool {
+	return role == groupRoleAdmin || role == groupRoleMember
+}
+
+// member returns the member of the group with the username, or nil
+func (g *group) member(username string) *groupMember {
+	for i := range g.Members {
+		if g.Members[i].Username == username {
+			return &g.Members[i]
+		}
+	}
+	return nil
+}
+
+func (g *group) admins() int {
+	count := 0
+	for _, member := range g.Members {
+		if member.Role == groupRoleAdmin {
+			count++
+		}
+	}
+	return count
+}
+
+func (g *group) usernames() []string {
+	usernames := make([]string, 0, len(g.Members))
+	for _, member := range g.Members {
+		usernames = append(usernames, member.Username)
+	}
+	return usernames
+}
+
+// groupShare returns how the list is shared with the group, or nil
+func (l *list) groupShare(groupId string) *groupShare {
+	for i := range l.Groups {
+		if l.Groups[i].GroupId == groupId {
+			return &l.Groups[i]
+		}
+	}
+	return nil
+}
+
+// roleIn returns the role of the user in the list, either their own one
+// or the best one given by the groups the list is shared with
+func (s *Service) roleIn(listRec *list, username string) (string, error) {
+	role := listRec.roleOf(username)
+	for _, share := range listRec.Groups {
+		if role != "" && rolePermissions[share.Role] <= rolePermissions[role] {
+			continue
+		}
+		g, err := s.groups.Get(share.GroupId)
+		if err == errNotFound {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if g.member(username) != nil {
+			role = share.Role
+		}
+	}
+	return role, nil
+}
+
+// permitsList reports whether the user may do what the permission allows with the list, directly or through a group
+func (s *Service) permitsList(listRec *list, username string, required permission) (bool, error) {
+	role, err := s.roleIn(listRec, username)
+	if err != nil {
+		return false, err
+	}
+	granted, ok := rolePermissions[role]
+	return ok && granted >= required, nil
+}
+
+// groupMembers returns members of the groups the list is shared with
+func (s *Service) groupMembers(listRec *list) []string {
+	members := make([]string, 0)
+	for _, share := range listRec.Groups {
+		g, err := s.groups.Get(share.GroupId)
+		if err != nil {
+			if err != errNotFound {
+				log.Error("Failed to load group ", share.GroupId, ": ", err)
+			}
+			continue
+		}
+		members = append(members, g.usernames()...)
+	}
+	return members
+}
+
+// loadGroup returns the group if the user is its member, the group is not found for other users
+func (s *Service) loadGroup(username, id string) (*group, error) {
+	g, err := s.groups.Get(id)
+	if err == errNotFound {
+		return nil, errGroupNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if g.member(username) == nil {
+		return nil, errGroupNotFound
+	}
+	return g, nil
+}
+
+// authorizeGroupAdmin loads the group if the user is its admin
+func (s *Service) authorizeGroupAdmin(username, id string) (*group, error) {
+	g, err := s.loadGroup(username, id)
+	if err != nil {
+		return nil, err
+	}
+	if g.member(username).Role != groupRoleAdmin {
+		return nil, errNotGroupAdmin
+	}
+	return g, nil
+}
+
+// createGroup creates a group with the user as its only admin
+func (s *Service) createGroup(username, name string) (string, error) {
+	if name == "" {
+		return "", errEmptyGroupName
+	}
+	now := time.Now()
+	g := group{
+		Id:      ksuid.New().String(),
+		Name:    name,
+		Members: []groupMember{{Username: username, Role: groupRoleAdmin, Joined: now}},
+		Created: now,
+	}
+	if err := s.groups.Insert(g); err != nil {
+		return "", err
+	}
+	return g.Id, nil
+}
+
+func (s *Service) userGroups(username string) ([]group, error) {
+	return s.groups.ByMember(username)
+}
+
+func (s *Service) addGroupMember(admin, id, username, role string) error {
+	if role == "" {
+		role = groupRoleMember
+	}
+	if !validGroupRole(role) {
+		return errInvalidGroupRole
+	}
+	g, err := s.authorizeGroupAdmin(admin, id)
+	if err != nil {
+		return err
+	}
+	_, err = s.access.Get(username)
+	if err == errNotFound {
+		return errUnknownUser
+	}
+	if err != nil {
+		return err
+	}
+	if g.member(username) != nil {
+		return errAlreadyGroupMember
+	}
+	err = s.groups.AddMember(id, groupMember{Username: username, Role: role, Joined: time.Now()})
+	if err == errDuplicate {
+		return errAlreadyGroupMember
+	}
+	return err
+}
+
+// removeGroupMember removes the user from the group on behalf of actor, who is an admin or the user.
+// The group is deleted when its last member leaves.
+func (s *Service) removeGroupMember(actor, id, username string) error {
+	var g *group
+	var err error
+	if actor == username {
+		g, err = s.loadGroup(actor, id)
+	} else {
+		g, err = s.authorizeGroupAdmin(actor, id)
+	}
+	if err != nil {
+		return err
+	}
+	member := g.member(username)
+	if member == nil {
+		return errNotGroupMember
+	}
+	if len(g.Members) == 1 {
+		return s.removeGroup(actor, g)
+	}
+	if member.Role == groupRoleAdmin && g.admins() == 1 {
+		return errLastAdmin
+	}
+	err = s.groups.RemoveMember(id, username)
+	if err == errNotFound {
+		return errNotGroupMember
+	}
+	if err != nil {
+		return err
+	}
+	s.groupAccessRemoved(g.Id, username)
+	return nil
+}
+
+func (s *Service) setGroupMemberRole(admin, id, username, role string) error {
+	if !validGroupRole(role) {
+		return errInvalidGroupRole
+	}
+	g, err := s.authorizeGroupAdmin(admin, id)
+	if err != nil {
+		return err
+	}
+	member := g.member(username)
+	if member == nil {
+		return errNotGroupMember
+	}
+	if member.Role == groupRoleAdmin && role != groupRoleAdmin && g.admins() == 1 {
+		return errLastAdmin
+	}
+	err = s.groups.SetMemberRole(id, username, role)
+	if err == errNotFound {
+		return errNotGroupMember
+	}
+	return err
+}
+
+func (s *Service) deleteGroup(admin, id string) error {
+	g, err := s.authorizeGroupAdmin(admin, id)
+	if err != nil {
+		return err
+	}
+	return s.removeGroup(admin, g)
+}
+
+// removeGroup stops sharing lists with the group and removes it
+func (s *Service) removeGroup(actor string, g *group) error {
+	lists, err := s.lists.ByGroup(g.Id)
+	if err != nil {
+		return err
+	}
+	for i := range lists {
+		if err = s.removeGroupShare(actor, &lists[i], g); err != nil && err != errNotSharedWithGroup {
+			return err
+		}
+	}
+	return s.groups.Remove(g.Id)
+}
+
+// groupAccessRemoved records that the user doesn't see lists of the group anymore
+func (s *Service) groupAccessRemoved(groupId, username string) {
+	lists, err := s.lists.ByGroup(groupId)
+	if err != nil {
+		log.Error("Failed to load lists of group ", groupId, ": ", err)
+		return
+	}
+	for _, listRec := range lists {
+		if err = s.removeAccessTracked(listRec.Id, username); err != nil {
+			log.Error("Failed to record removal of ", listRec.Id, " for ", username, ": ", err)
+		}
+	}
+}
+
+// shareWithGroup gives members of the group the role in the list.
+// The user must be allowed to share the list and be a member of the group.
+func (s *Service) shareWithGroup(username, id, groupId, role string) error {
+	if role == "" {
+		role = defaultGuestRole
+	}
+	if !validGuestRole(role) {
+		return errInvalidRole
+	}
+	listRec, err := s.lists.Get(id)
+	if err == errNotFound {
+		return errNoPermission
+	}
+	if err != nil {
+		return err
+	}
+	permitted, err := s.permitsList(listRec, username, permShare)
+	if err != nil {
+		return err
+	}
+	if !permitted {
+		return errNoPermission
+	}
+	if _, err = s.loadGroup(username, groupId); err != nil {
+		return err
+	}
+	if listRec.groupShare(groupId) != nil {
+		return errAlreadySharedWithGroup
+	}
+	err = s.lists.AddGroup(id, groupShare{GroupId: groupId, Role: role})
+	if err == errDuplicate {
+		return errAlreadySharedWithGroup
+	}
+	if err != nil {
+		return err
+	}
+	if listRec, err := s.lists.Get(id); err == nil {
+		s.publishListEvent(eventGroupAdded, username, listRec, listRec.Version)
+	}
+	return nil
+}
+
+// unshareWithGroup stops sharing the list with the group on behalf of the owner of the list or an admin of the group
+func (s *Service) unshareWithGroup(username, id, groupId string) error {
+	listRec, err := s.lists.Get(id)
+	if err == errNotFound {
+		return errNoPermission
+	}
+	if err != nil {
+		return err
+	}
+	if listRec.groupShare(groupId) == nil {
+		return errNotSharedWithGroup
+	}
+	g, err := s.groups.Get(groupId)
+	if err == errNotFound {
+		// The group is gone, only the owner can clean up
+		g = &group{Id: groupId}
+	} else if err != nil {
+		return err
+	}
+	member := g.member(username)
+	if listRec.Owner != username && (member == nil || member.Role != groupRoleAdmin) {
+		return errNoPermission
+	}
+	return s.removeGroupShare(username, listRec, g)
+}
+
+func (s *Service) removeGroupShare(actor string, listRec *list, g *group) error {
+	err := s.lists.RemoveGroup(listRec.Id, g.Id)
+	if err == errNotFound {
+		return errNotSharedWithGroup
+	}
+	if err != nil {
+		return err
+	}
+	if err = s.removeAccessTracked(listRec.Id, g.usernames()...); err != nil {
+		log.Error("Failed to record removal of ", listRec.Id, " for group ", g.Id, ": ", err)
+	}
+	// Members are taken from before the removal, so members of the group get the event too
+	if updated, err := s.lists.Get(listRec.Id); err == nil {
+		s.publishListEvent(eventGroupRemoved, actor, listRec, updated.Version)
+	}
+	return nil
+}
+
+// groupLists returns links to the lists shared with the group, named as their owners name them
+func (s *Service) groupLists(username, id string) ([]listLink, error) {
+	if _, err := s.loadGroup(username, id); err != nil {
+		return nil, err
+	}
+	lists, err := s.lists.ByGroup(id)
+	if err != nil {
+		return nil, err
+	}
+	links := make([]listLink, 0, len(lists))
+	for _, listRec := range lists {
+		links = append(links, listLink{Id: listRec.Id, DisplayName: listRec.OriginalName})
+	}
+	return links, nil
+}
@@ -2,11 +2,16 @@ package logic
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/dgrijalva/jwt-go"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	"net/http"
 	"shoppinglist-server/src/utils"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func getUsername(r *http.Request) string {
@@ -27,10 +32,10 @@ func accessDenied(w http.ResponseWriter, username, id string) {
 	_, _ = w.Write(utils.NewWrappedError("access denied"))
 }
 
-func HandleGetList(w http.ResponseWriter, r *http.Request) {
+func (s *Service) HandleGetList(w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Query().Get("id")
 	username := getUsername(r)
-	authorized, err := hasAccessToList(username, id)
+	authorized, err := s.hasAccessToList(username, id, permRead)
 	if err != nil {
 		internalError(w, err)
 		return
@@ -39,7 +44,7 @@ func HandleGetList(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write(utils.NewWrappedError("access denied"))
 		return
 	}
-	listRec, err := getListById(id)
+	listRec, err := s.loadList(id)
 	if err != nil {
 		internalError(w, err)
 		return
@@ -49,6 +54,54 @@ func HandleGetList(w http.ResponseWriter, r *http.Request) {
 		internalError(w, err)
 		return
 	}
+	setETag(w, listRec.Version)
+	_, _ = w.Write(result)
+}
+
+func setETag(w http.ResponseWriter, version int64) {
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(version, 10)))
+}
+
+// ifMatchVersion returns the list version from If-Match header, or anyVersion if there is none
+func ifMatchVersion(r *http.Request) (int64, error) {
+	tag := strings.TrimSpace(r.Header.Get("If-Match"))
+	if tag == "" || tag == "*" {
+		return anyVersion, nil
+	}
+	tag = strings.Trim(strings.TrimPrefix(tag, "W/"), "\"")
+	return strconv.ParseInt(tag, 10, 64)
+}
+
+// readIfMatch parses If-Match header, replying with 400 if it is malformed
+func readIfMatch(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	version, err := ifMatchVersion(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(utils.NewWrappedError("invalid If-Match header"))
+		return 0, false
+	}
+	return version, true
+}
+
+type conflictResp struct {
+	Error string `json:"error"`
+	List  *list  `json:"list"`
+}
+
+// preconditionFailed replies with the current state of the list that was modified concurrently
+func (s *Service) preconditionFailed(w http.ResponseWriter, id string) {
+	listRec, err := s.loadList(id)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	result, err := json.Marshal(conflictResp{Error: errVersionMismatch.Error(), List: listRec})
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	setETag(w, listRec.Version)
+	w.WriteHeader(http.StatusPreconditionFailed)
 	_, _ = w.Write(result)
 }
 
@@ -56,16 +109,20 @@ type requestListContent struct {
 	Content string `json:"content"`
 }
 
-func HandleUpdateList(w http.ResponseWriter, r *http.Request) {
+func (s *Service) HandleUpdateList(w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Query().Get("id")
 	username := getUsername(r)
-	authorized, err := hasAccessToList(username, id)
+	authorized, err := s.hasAccessToList(username, id, permEdit)
 	if err != nil {
 		internalError(w, err)
 		return
 	}
 	if !authorized {
-		_, _ = w.Write(utils.NewWrappedError("access denied"))
+		accessDenied(w, username, id)
+		return
+	}
+	version, ok := readIfMatch(w, r)
+	if !ok {
 		return
 	}
 	var reqContent requestListContent
@@ -81,22 +138,24 @@ func HandleUpdateList(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write(utils.NewWrappedError("invalid request body"))
 		return
 	}
-	err = updateList(id, reqContent.Content)
+	newVersion, err := s.editList(username, id, reqContent.Content, version)
 	if err != nil {
-		internalError(w, err)
+		s.listWriteError(w, id, err)
 		return
 	}
+	setETag(w, newVersion)
 }
 
 type requestNamedList struct {
 	Name    string `json:"name"`
 	Content string `json:"content"`
+	Items   []item `json:"items"`
 }
 type idResp struct {
 	Id string `json:"id"`
 }
 
-func HandleCreateList(w http.ResponseWriter, r *http.Request) {
+func (s *Service) HandleCreateList(w http.ResponseWriter, r *http.Request) {
 	username := getUsername(r)
 	var reqNList requestNamedList
 	body, err := ioutil.ReadAll(r.Body)
@@ -111,7 +170,11 @@ func HandleCreateList(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write(utils.NewWrappedError("invalid request body"))
 		return
 	}
-	id, err := createList(username, reqNList.Name, reqNList.Content)
+	items := reqNList.Items
+	if items == nil {
+		items = itemsFromContent(reqNList.Content, nil)
+	}
+	id, err := s.createList(username, reqNList.Name, items)
 	if err != nil {
 		internalError(w, err)
 		return
@@ -120,10 +183,10 @@ func HandleCreateList(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(resp)
 }
 
-func HandleDeleteList(w http.ResponseWriter, r *http.Request) {
+func (s *Service) HandleDeleteList(w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Query().Get("id")
 	username := getUsername(r)
-	authorized, err := hasAccessToList(username, id)
+	authorized, err := s.hasAccessToList(username, id, permRead)
 	if err != nil {
 		internalError(w, err)
 		return
@@ -132,19 +195,27 @@ func HandleDeleteList(w http.ResponseWriter, r *http.Request) {
 		accessDenied(w, username, id)
 		return
 	}
+	version, ok := readIfMatch(w, r)
+	if !ok {
+		return
+	}
 
-	err = unlinkList(username, id)
+	err = s.unlinkList(username, id, version)
+	if err == errNotGuest || err == errGroupAccess {
+		sharingError(w, username, id, err)
+		return
+	}
 	if err != nil {
-		internalError(w, err)
+		s.listWriteError(w, id, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 	return
 }
 
-func HandleGetSharedLists(w http.ResponseWriter, r *http.Request) {
+func (s *Service) HandleGetSharedLists(w http.ResponseWriter, r *http.Request) {
 	username := getUsername(r)
-	lists, err := listSharedLists(username)
+	lists, err := s.listSharedLists(username)
 	if err != nil {
 		internalError(w, err)
 		return
@@ -157,9 +228,9 @@ func HandleGetSharedLists(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(result)
 }
 
-func HandleGetOwnedLists(w http.ResponseWriter, r *http.Request) {
+func (s *Service) HandleGetOwnedLists(w http.ResponseWriter, r *http.Request) {
 	username := getUsername(r)
-	lists, err := listOwnedLists(username)
+	lists, err := s.listOwnedLists(username)
 	if err != nil {
 		internalError(w, err)
 		return
@@ -172,12 +243,83 @@ func HandleGetOwnedLists(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(result)
 }
 
+func (s *Service) HandleGetTrash(w http.ResponseWriter, r *http.Request) {
+	trash, err := s.userTrash(getUsername(r))
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	writeJSON(w, trash)
+}
+
+func (s *Service) HandleRestoreList(w http.ResponseWriter, r *http.Request) {
+	newVersion, err := s.restoreList(getUsername(r), r.URL.Query().Get("id"))
+	if err == errNotInTrash {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write(utils.WrapError(err))
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	setETag(w, newVersion)
+}
+
+type renameReq struct {
+	Name string `json:"name"`
+	// Propagate renames links of guests without an alias as well
+	Propagate bool `json:"propagate"`
+}
+
+func (s *Service) HandleRenameList(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r)
+	id := r.URL.Query().Get("id")
+	version, ok := readIfMatch(w, r)
+	if !ok {
+		return
+	}
+	var request renameReq
+	if !readBody(w, r, &request) {
+		return
+	}
+	newVersion, err := s.renameList(username, id, request.Name, request.Propagate, version)
+	if err == errNotOwner {
+		accessDenied(w, username, id)
+		return
+	}
+	if err != nil {
+		s.listWriteError(w, id, err)
+		return
+	}
+	setETag(w, newVersion)
+}
+
+type aliasReq struct {
+	Alias string `json:"alias"`
+}
+
+func (s *Service) HandleSetAlias(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r)
+	id := r.URL.Query().Get("id")
+	var request aliasReq
+	if !readBody(w, r, &request) {
+		return
+	}
+	if err := s.setAlias(username, id, request.Alias); err != nil {
+		sharingError(w, username, id, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
 type shareReq struct {
 	Id    string `json:"id"`
 	Guest string `json:"guest"`
+	Role  string `json:"role"`
 }
 
-func HandleShareList(w http.ResponseWriter, r *http.Request) {
+func (s *Service) HandleShareList(w http.ResponseWriter, r *http.Request) {
 	username := getUsername(r)
 	var request shareReq
 	body, err := ioutil.ReadAll(r.Body)
@@ -192,9 +334,928 @@ func HandleShareList(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write(utils.NewWrappedError("invalid request body"))
 		return
 	}
-	err = addGuest(username, request.Guest, request.Id)
+	requestId, err := s.requestShare(username, request.Guest, request.Id, request.Role)
+	if err != nil {
+		sharingError(w, username, request.Id, err)
+		return
+	}
+	resp, _ := json.Marshal(idResp{Id: requestId})
+	_, _ = w.Write(resp)
+}
+
+// sharingError writes the response for errors of sharing lists and managing guests
+func sharingError(w http.ResponseWriter, username, id string, err error) {
+	switch err {
+	case errNotOwner, errNoPermission:
+		accessDenied(w, username, id)
+	case errGroupAccess:
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write(utils.WrapError(err))
+	case errNotGuest, errUnknownUser, errNoLink:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write(utils.WrapError(err))
+	case errInvalidRole, errSelfShare, errAlreadyOwner:
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(utils.WrapError(err))
+	case errAlreadyShared, errAlreadyRequested:
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write(utils.WrapError(err))
+	default:
+		internalError(w, err)
+	}
+}
+
+func (s *Service) HandleRevokeGuest(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r)
+	id := r.URL.Query().Get("id")
+	guest := r.URL.Query().Get("guest")
+	if err := s.revokeGuest(username, guest, id); err != nil {
+		sharingError(w, username, id, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Service) HandleSetRole(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r)
+	query := r.URL.Query()
+	id := query.Get("id")
+	if err := s.setGuestRole(username, query.Get("guest"), id, query.Get("role")); err != nil {
+		sharingError(w, username, id, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Service) HandleLeaveList(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r)
+	id := r.URL.Query().Get("id")
+	if err := s.leaveList(username, id); err != nil {
+		sharingError(w, username, id, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+type transferReq struct {
+	Id       string `json:"id"`
+	NewOwner string `json:"new_owner"`
+	// KeepAs is the role the owner keeps, the owner leaves the list if it is empty
+	KeepAs string `json:"keep_as"`
+}
+
+func (s *Service) HandleTransferList(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r)
+	var request transferReq
+	if !readBody(w, r, &request) {
+		return
+	}
+	requestId, err := s.requestTransfer(username, request.NewOwner, request.Id, request.KeepAs)
+	if err != nil {
+		sharingError(w, username, request.Id, err)
+		return
+	}
+	resp, _ := json.Marshal(idResp{Id: requestId})
+	_, _ = w.Write(resp)
+}
+
+type inviteReq struct {
+	Role    string     `json:"role"`
+	Expires *time.Time `json:"expires"`
+	MaxUses int64      `json:"max_uses"`
+}
+
+// inviteError writes the response for errors of invites, other errors are sharing errors
+func inviteError(w http.ResponseWriter, username, id string, err error) {
+	switch err {
+	case errInviteNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write(utils.WrapError(err))
+	case errInviteExpired:
+		w.WriteHeader(http.StatusGone)
+		_, _ = w.Write(utils.WrapError(err))
+	case errInvalidInvite:
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(utils.WrapError(err))
+	default:
+		sharingError(w, username, id, err)
+	}
+}
+
+func (s *Service) HandleCreateInvite(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r)
+	id := r.URL.Query().Get("id")
+	var request inviteReq
+	if !readBody(w, r, &request) {
+		return
+	}
+	inv, err := s.createInvite(username, id, request.Role, request.Expires, request.MaxUses)
+	if err != nil {
+		inviteError(w, username, id, err)
+		return
+	}
+	result, err := json.Marshal(inv)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	_, _ = w.Write(result)
+}
+
+func (s *Service) HandleGetInvites(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r)
+	id := r.URL.Query().Get("id")
+	invites, err := s.listInvites(username, id)
+	if err != nil {
+		inviteError(w, username, id, err)
+		return
+	}
+	result, err := json.Marshal(invites)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	_, _ = w.Write(result)
+}
+
+func (s *Service) HandleRevokeInvite(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r)
+	id := r.URL.Query().Get("id")
+	if err := s.revokeInvite(username, id, r.URL.Query().Get("invite")); err != nil {
+		inviteError(w, username, id, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Service) HandleJoinByInvite(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r)
+	id, err := s.joinByInvite(username, r.URL.Query().Get("token"))
+	if err != nil {
+		inviteError(w, username, id, err)
+		return
+	}
+	resp, _ := json.Marshal(idResp{Id: id})
+	_, _ = w.Write(resp)
+}
+
+type groupReq struct {
+	Name string `json:"name"`
+}
+
+// groupError writes the response for errors of groups, other errors are sharing errors
+func groupError(w http.ResponseWriter, username, id string, err error) {
+	switch err {
+	case errGroupNotFound, errNotGroupMember, errNotSharedWithGroup:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write(utils.WrapError(err))
+	case errNotGroupAdmin:
+		accessDenied(w, username, id)
+	case errEmptyGroupName, errInvalidGroupRole:
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(utils.WrapError(err))
+	case errAlreadyGroupMember, errAlreadySharedWithGroup, errLastAdmin:
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write(utils.WrapError(err))
+	default:
+		sharingError(w, username, id, err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	result, err := json.Marshal(v)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	_, _ = w.Write(result)
+}
+
+func (s *Service) HandleCreateGroup(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r)
+	var request groupReq
+	if !readBody(w, r, &request) {
+		return
+	}
+	id, err := s.createGroup(username, request.Name)
+	if err != nil {
+		groupError(w, username, "", err)
+		return
+	}
+	writeJSON(w, idResp{Id: id})
+}
+
+func (s *Service) HandleGetGroups(w http.ResponseWriter, r *http.Request) {
+	groups, err := s.userGroups(getUsername(r))
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	writeJSON(w, groups)
+}
+
+func (s *Service) HandleGetGroup(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r)
+	id := r.URL.Query().Get("id")
+	g, err := s.loadGroup(username, id)
+	if err != nil {
+		groupError(w, username, id, err)
+		return
+	}
+	writeJSON(w, g)
+}
+
+func (s *Service) HandleGetGroupLists(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r)
+	id := r.URL.Query().Get("id")
+	links, err := s.groupLists(username, id)
+	if err != nil {
+		groupError(w, username, id, err)
+		return
+	}
+	writeJSON(w, links)
+}
+
+// handleGroupAction runs action with the user and the "id" query parameter and writes an empty response if it succeeds
+func (s *Service) handleGroupAction(w http.ResponseWriter, r *http.Request, action func(username, id string) error) {
+	username := getUsername(r)
+	id := r.URL.Query().Get("id")
+	if err := action(username, id); err != nil {
+		groupError(w, username, id, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Service) HandleDeleteGroup(w http.ResponseWriter, r *http.Request) {
+	s.handleGroupAction(w, r, s.deleteGroup)
+}
+
+func (s *Service) HandleLeaveGroup(w http.ResponseWriter, r *http.Request) {
+	s.handleGroupAction(w, r, func(username, id string) error {
+		return s.removeGroupMember(username, id, username)
+	})
+}
+
+func (s *Service) HandleAddGroupMember(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	s.handleGroupAction(w, r, func(username, id string) error {
+		return s.addGroupMember(username, id, query.Get("username"), query.Get("role"))
+	})
+}
+
+func (s *Service) HandleRemoveGroupMember(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	s.handleGroupAction(w, r, func(username, id string) error {
+		return s.removeGroupMember(username, id, query.Get("username"))
+	})
+}
+
+func (s *Service) HandleSetGroupRole(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	s.handleGroupAction(w, r, func(username, id string) error {
+		return s.setGroupMemberRole(username, id, query.Get("username"), query.Get("role"))
+	})
+}
+
+func (s *Service) HandleShareWithGroup(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	s.handleGroupAction(w, r, func(username, id string) error {
+		return s.shareWithGroup(username, id, query.Get("group"), query.Get("role"))
+	})
+}
+
+func (s *Service) HandleUnshareWithGroup(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	s.handleGroupAction(w, r, func(username, id string) error {
+		return s.unshareWithGroup(username, id, query.Get("group"))
+	})
+}
+
+func (s *Service) handlePublicLink(w http.ResponseWriter, r *http.Request, rotate bool) {
+	username := getUsername(r)
+	id := r.URL.Query().Get("id")
+	token, err := s.enablePublicLink(username, id, rotate)
+	if err != nil {
+		sharingError(w, username, id, err)
+		return
+	}
+	resp, _ := json.Marshal(publicLinkResp{Token: token})
+	_, _ = w.Write(resp)
+}
+
+func (s *Service) HandleEnablePublicLink(w http.ResponseWriter, r *http.Request) {
+	s.handlePublicLink(w, r, false)
+}
+
+func (s *Service) HandleRotatePublicLink(w http.ResponseWriter, r *http.Request) {
+	s.handlePublicLink(w, r, true)
+}
+
+func (s *Service) HandleDisablePublicLink(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r)
+	id := r.URL.Query().Get("id")
+	if err := s.disablePublicLink(username, id); err != nil {
+		sharingError(w, username, id, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandlePublicList serves a public list without authentication as JSON, HTML or plain text
+func (s *Service) HandlePublicList(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "html" && format != "text" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(utils.NewWrappedError("format must be one of json, html or text"))
+		return
+	}
+	view, err := s.publicView(r.URL.Query().Get("token"))
+	if err == errPublicListNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write(utils.WrapError(err))
+		return
+	}
 	if err != nil {
 		internalError(w, err)
 		return
 	}
+	w.Header().Set("Cache-Control", "no-store")
+	switch format {
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = writePublicHTML(w, view)
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		err = writePublicText(w, view)
+	default:
+		var result []byte
+		result, err = json.Marshal(view)
+		if err == nil {
+			_, _ = w.Write(result)
+		}
+	}
+	if err != nil {
+		internalError(w, err)
+	}
+}
+
+func requestNotFound(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	_, _ = w.Write(utils.WrapError(errRequestNotFound))
+}
+
+func writeRequests(w http.ResponseWriter, requests []shareRequest, err error) {
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	result, err := json.Marshal(requests)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	_, _ = w.Write(result)
+}
+
+func (s *Service) HandleGetRequests(w http.ResponseWriter, r *http.Request) {
+	requests, err := s.listIncomingRequests(getUsername(r))
+	writeRequests(w, requests, err)
+}
+
+func (s *Service) HandleGetSentRequests(w http.ResponseWriter, r *http.Request) {
+	requests, err := s.listOutgoingRequests(getUsername(r))
+	writeRequests(w, requests, err)
+}
+
+func (s *Service) handleRequestAction(w http.ResponseWriter, r *http.Request, action func(username, requestId string) error) {
+	id := r.URL.Query().Get("id")
+	err := action(getUsername(r), id)
+	if err == errRequestNotFound {
+		requestNotFound(w)
+		return
+	}
+	if err == errNoPermission {
+		// The sender can't share the list anymore
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write(utils.WrapError(err))
+		return
+	}
+	if err == errAlreadyShared || err == errAlreadyOwner {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write(utils.WrapError(err))
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Service) HandleAcceptRequest(w http.ResponseWriter, r *http.Request) {
+	s.handleRequestAction(w, r, s.acceptShareRequest)
+}
+
+func (s *Service) HandleDeclineRequest(w http.ResponseWriter, r *http.Request) {
+	s.handleRequestAction(w, r, s.declineShareRequest)
+}
+
+func (s *Service) HandleCancelRequest(w http.ResponseWriter, r *http.Request) {
+	s.handleRequestAction(w, r, s.cancelShareRequest)
+}
+
+func (s *Service) HandleGetNotifications(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r)
+	query := r.URL.Query()
+	offset, _ := strconv.ParseInt(query.Get("offset"), 10, 64)
+	limit, _ := strconv.ParseInt(query.Get("limit"), 10, 64)
+	unreadOnly := query.Get("unread") == "true"
+	page, err := s.listNotifications(username, unreadOnly, offset, limit)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	result, err := json.Marshal(page)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	_, _ = w.Write(result)
+}
+
+type unreadResp struct {
+	Unread int64 `json:"unread"`
+}
+
+func (s *Service) HandleGetUnreadCount(w http.ResponseWriter, r *http.Request) {
+	unread, err := s.notifications.Count(getUsername(r), true)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	result, _ := json.Marshal(unreadResp{Unread: unread})
+	_, _ = w.Write(result)
+}
+
+func (s *Service) handleNotificationAction(w http.ResponseWriter, r *http.Request, action func(username, id string) error) {
+	id := r.URL.Query().Get("id")
+	err := action(getUsername(r), id)
+	if err == errNotificationNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write(utils.WrapError(err))
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Service) HandleDeleteNotification(w http.ResponseWriter, r *http.Request) {
+	s.handleNotificationAction(w, r, s.notifications.Remove)
+}
+
+func (s *Service) HandleMarkNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	s.handleNotificationAction(w, r, s.notifications.MarkRead)
+}
+
+// readBody decodes JSON request body into v, replying with 400 if it is malformed
+func readBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		internalError(w, err)
+		return false
+	}
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		log.Warnln(err)
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(utils.NewWrappedError("invalid request body"))
+		return false
+	}
+	return true
+}
+
+// authorizeList returns the user and the list from the "id" query parameter,
+// replying with an error if the user doesn't have the required permission for the list
+func (s *Service) authorizeList(w http.ResponseWriter, r *http.Request, required permission) (string, string, bool) {
+	id := r.URL.Query().Get("id")
+	username := getUsername(r)
+	authorized, err := s.hasAccessToList(username, id, required)
+	if err != nil {
+		internalError(w, err)
+		return "", "", false
+	}
+	if !authorized {
+		accessDenied(w, username, id)
+		return "", "", false
+	}
+	return username, id, true
+}
+
+func (s *Service) listWriteError(w http.ResponseWriter, id string, err error) {
+	switch err {
+	case errVersionMismatch:
+		s.preconditionFailed(w, id)
+	case errItemNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write(utils.WrapError(err))
+	case errEmptyItemName, errEmptyListName, errInvalidOp:
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(utils.WrapError(err))
+	case errMergeContended:
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write(utils.WrapError(err))
+	default:
+		internalError(w, err)
+	}
+}
+
+func (s *Service) HandleAddItem(w http.ResponseWriter, r *http.Request) {
+	username, id, ok := s.authorizeList(w, r, permEdit)
+	if !ok {
+		return
+	}
+	version, ok := readIfMatch(w, r)
+	if !ok {
+		return
+	}
+	var changes itemChanges
+	if !readBody(w, r, &changes) {
+		return
+	}
+	itemId, newVersion, err := s.addItem(username, id, changes, version)
+	if err != nil {
+		s.listWriteError(w, id, err)
+		return
+	}
+	setETag(w, newVersion)
+	resp, _ := json.Marshal(idResp{Id: itemId})
+	_, _ = w.Write(resp)
+}
+
+func (s *Service) HandleEditItem(w http.ResponseWriter, r *http.Request) {
+	username, id, ok := s.authorizeList(w, r, permEdit)
+	if !ok {
+		return
+	}
+	version, ok := readIfMatch(w, r)
+	if !ok {
+		return
+	}
+	var changes itemChanges
+	if !readBody(w, r, &changes) {
+		return
+	}
+	newVersion, err := s.editItem(username, id, r.URL.Query().Get("item"), changes, version)
+	if err != nil {
+		s.listWriteError(w, id, err)
+		return
+	}
+	setETag(w, newVersion)
+}
+
+type checkReq struct {
+	Checked bool `json:"checked"`
+}
+
+func (s *Service) HandleCheckItem(w http.ResponseWriter, r *http.Request) {
+	username, id, ok := s.authorizeList(w, r, permEdit)
+	if !ok {
+		return
+	}
+	version, ok := readIfMatch(w, r)
+	if !ok {
+		return
+	}
+	var request checkReq
+	if !readBody(w, r, &request) {
+		return
+	}
+	newVersion, err := s.checkItem(username, id, r.URL.Query().Get("item"), request.Checked, version)
+	if err != nil {
+		s.listWriteError(w, id, err)
+		return
+	}
+	setETag(w, newVersion)
+}
+
+type reorderReq struct {
+	Order []string `json:"order"`
+}
+
+func (s *Service) HandleReorderItems(w http.ResponseWriter, r *http.Request) {
+	username, id, ok := s.authorizeList(w, r, permEdit)
+	if !ok {
+		return
+	}
+	version, ok := readIfMatch(w, r)
+	if !ok {
+		return
+	}
+	var request reorderReq
+	if !readBody(w, r, &request) {
+		return
+	}
+	newVersion, err := s.reorderItems(username, id, request.Order, version)
+	if err != nil {
+		s.listWriteError(w, id, err)
+		return
+	}
+	setETag(w, newVersion)
+}
+
+func (s *Service) HandleDeleteItem(w http.ResponseWriter, r *http.Request) {
+	username, id, ok := s.authorizeList(w, r, permEdit)
+	if !ok {
+		return
+	}
+	version, ok := readIfMatch(w, r)
+	if !ok {
+		return
+	}
+	newVersion, err := s.deleteItem(username, id, r.URL.Query().Get("item"), version)
+	if err != nil {
+		s.listWriteError(w, id, err)
+		return
+	}
+	setETag(w, newVersion)
+}
+
+type mergeReq struct {
+	Ops []itemOp `json:"ops"`
+}
+
+func (s *Service) HandleMergeOps(w http.ResponseWriter, r *http.Request) {
+	username, id, ok := s.authorizeList(w, r, permEdit)
+	if !ok {
+		return
+	}
+	var request mergeReq
+	if !readBody(w, r, &request) {
+		return
+	}
+	merged, err := s.mergeOps(username, id, request.Ops)
+	if err != nil {
+		s.listWriteError(w, id, err)
+		return
+	}
+	setETag(w, merged.List.Version)
+	writeJSON(w, merged)
+}
+
+func (s *Service) HandleGetOps(w http.ResponseWriter, r *http.Request) {
+	_, id, ok := s.authorizeList(w, r, permRead)
+	if !ok {
+		return
+	}
+	var since int64
+	if value := r.URL.Query().Get("since"); value != "" {
+		var err error
+		since, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write(utils.NewWrappedError("invalid since"))
+			return
+		}
+	}
+	ops, err := s.listOps(id, since)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	writeJSON(w, ops)
+}
+
+type batchGetReq struct {
+	Ids []string `json:"ids"`
+}
+
+type batchOpsReq struct {
+	Lists []listOps `json:"lists"`
+}
+
+func (s *Service) HandleBatchGetLists(w http.ResponseWriter, r *http.Request) {
+	var request batchGetReq
+	if !readBody(w, r, &request) {
+		return
+	}
+	results, err := s.batchGetLists(getUsername(r), request.Ids)
+	if err == errBatchTooLarge {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(utils.WrapError(err))
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	writeJSON(w, results)
+}
+
+func (s *Service) HandleBatchMergeOps(w http.ResponseWriter, r *http.Request) {
+	var request batchOpsReq
+	if !readBody(w, r, &request) {
+		return
+	}
+	results, err := s.batchMergeOps(getUsername(r), request.Lists)
+	if err == errBatchTooLarge {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(utils.WrapError(err))
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	writeJSON(w, results)
+}
+
+// readRevision parses the "version" query parameter, replying with 400 if it is malformed
+func readRevision(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	version, err := strconv.ParseInt(r.URL.Query().Get("version"), 10, 64)
+	if err != nil || version <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(utils.WrapError(errInvalidRevision))
+		return 0, false
+	}
+	return version, true
+}
+
+func revisionNotFound(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	_, _ = w.Write(utils.WrapError(errRevisionNotFound))
+}
+
+func (s *Service) HandleGetRevisions(w http.ResponseWriter, r *http.Request) {
+	_, id, ok := s.authorizeList(w, r, permRead)
+	if !ok {
+		return
+	}
+	revisions, err := s.listRevisions(id)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	writeJSON(w, revisions)
+}
+
+func (s *Service) HandleGetRevision(w http.ResponseWriter, r *http.Request) {
+	_, id, ok := s.authorizeList(w, r, permRead)
+	if !ok {
+		return
+	}
+	version, ok := readRevision(w, r)
+	if !ok {
+		return
+	}
+	view, err := s.getRevision(id, version)
+	if err == errRevisionNotFound {
+		revisionNotFound(w)
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	writeJSON(w, view)
+}
+
+func (s *Service) HandleRevertList(w http.ResponseWriter, r *http.Request) {
+	username, id, ok := s.authorizeList(w, r, permEdit)
+	if !ok {
+		return
+	}
+	target, ok := readRevision(w, r)
+	if !ok {
+		return
+	}
+	version, ok := readIfMatch(w, r)
+	if !ok {
+		return
+	}
+	newVersion, err := s.revertList(username, id, target, version)
+	if err == errRevisionNotFound {
+		revisionNotFound(w)
+		return
+	}
+	if err != nil {
+		s.listWriteError(w, id, err)
+		return
+	}
+	setETag(w, newVersion)
+}
+
+func (s *Service) HandleSync(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r)
+	changes, err := s.syncChanges(username, r.URL.Query().Get("cursor"))
+	if err == errInvalidCursor {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(utils.WrapError(err))
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	result, err := json.Marshal(changes)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	_, _ = w.Write(result)
+}
+
+const defaultEventKeepAlive = 30 * time.Second
+
+// tokenLifetime returns the id and the expiration of the access token of the request
+func tokenLifetime(r *http.Request) (string, time.Time, bool) {
+	claims := r.Context().Value("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	id, hasId := claims["jti"].(string)
+	exp, hasExp := claims["exp"].(float64)
+	return id, time.Unix(int64(exp), 0), hasId && hasExp
+}
+
+// HandleEvents streams list events as Server-Sent Events.
+// With "id" query parameter only events of that list are sent, otherwise events of all lists of the user.
+func (s *Service) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r)
+	tokenId, expires, ok := tokenLifetime(r)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write(utils.NewWrappedError("token has no expiration, sign in again"))
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id != "" {
+		authorized, err := s.hasAccessToList(username, id, permRead)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if !authorized {
+			accessDenied(w, username, id)
+			return
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		internalError(w, errors.New("streaming is not supported"))
+		return
+	}
+	events, unsubscribe := s.events.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// The stream outlives the check of the token by the middleware, so it ends when the token expires or is revoked.
+	// Clients reconnect with a refreshed token.
+	expired := time.NewTimer(time.Until(expires))
+	defer expired.Stop()
+	keepAlive := time.NewTicker(s.eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-expired.C:
+			return
+		case <-keepAlive.C:
+			revoked, err := s.tokens.IsAccessTokenRevoked(tokenId)
+			if err != nil {
+				log.Errorln(err)
+			}
+			if revoked {
+				return
+			}
+			_, err = w.Write([]byte(": keep-alive\n\n"))
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if (id != "" && event.ListId != id) || !event.isMember(username) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Errorln(err)
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
 }
@@ -0,0 +1,233 @@
+package logic
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/dgrijalva/jwt-go"
+	"net/http"
+	"net/http/httptest"
+	"shoppinglist-server/src/auth"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestService returns a service over the in-memory storage with the users registered
+func newTestService(t *testing.T, usernames ...string) *Service {
+	s := NewService(NewMemoryStorage(), NewLocalBroker(), auth.NewMemoryTokenStore(), time.Hour)
+	for _, username := range usernames {
+		err := s.access.Insert(accessRecord{
+			Username:    username,
+			OwnedLists:  make([]listLink, 0, 1),
+			SharedLists: make([]listLink, 0, 1),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+// serve calls the handler as the user, signed in the way the JWT middleware does it.
+// Headers are given as pairs of names and values.
+func serve(handler http.HandlerFunc, username, method, target, body string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	token := &jwt.Token{Claims: jwt.MapClaims{"username": username}}
+	r = r.WithContext(context.WithValue(r.Context(), "user", token))
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+	}
+}
+
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("got status %d with %q, want %d", w.Code, w.Body.String(), status)
+	}
+}
+
+func createTestList(t *testing.T, s *Service, username, body string) string {
+	t.Helper()
+	w := serve(s.HandleCreateList, username, "POST", "/v1/list/create", body)
+	expectStatus(t, w, http.StatusOK)
+	var resp idResp
+	decode(t, w, &resp)
+	return resp.Id
+}
+
+func getTestList(t *testing.T, s *Service, username, id string) *list {
+	t.Helper()
+	w := serve(s.HandleGetList, username, "GET", "/v1/list/get?id="+id, "")
+	expectStatus(t, w, http.StatusOK)
+	var listRec list
+	decode(t, w, &listRec)
+	return &listRec
+}
+
+// shareTestList shares the list with the guest, who accepts the request
+func shareTestList(t *testing.T, s *Service, owner, guest, id, role string) {
+	t.Helper()
+	body, _ := json.Marshal(shareReq{Id: id, Guest: guest, Role: role})
+	w := serve(s.HandleShareList, owner, "POST", "/v1/list/share", string(body))
+	expectStatus(t, w, http.StatusOK)
+	var resp idResp
+	decode(t, w, &resp)
+	w = serve(s.HandleAcceptRequest, guest, "POST", "/v1/requests/accept?id="+resp.Id, "")
+	expectStatus(t, w, http.StatusOK)
+}
+
+func itemNames(items []item) []string {
+	names := make([]string, 0, len(items))
+	for _, it := range items {
+		names = append(names, it.Name)
+	}
+	return names
+}
+
+func TestCreateAndGetList(t *testing.T) {
+	s := newTestService(t, "katya")
+	id := createTestList(t, s, "katya", `{"name":"Groceries","items":[{"name":"Milk","quantity":2},{"name":"Bread"}]}`)
+
+	w := serve(s.HandleGetList, "katya", "GET", "/v1/list/get?id="+id, "")
+	expectStatus(t, w, http.StatusOK)
+	if etag := w.Header().Get("ETag"); etag != `"1"` {
+		t.Errorf("got ETag %s, want \"1\"", etag)
+	}
+	var listRec list
+	decode(t, w, &listRec)
+	if listRec.OriginalName != "Groceries" || listRec.Owner != "katya" || listRec.Version != 1 {
+		t.Errorf("got list %+v", listRec)
+	}
+	if names := strings.Join(itemNames(listRec.Items), ","); names != "Milk,Bread" || listRec.Items[0].Quantity != 2 {
+		t.Errorf("got items %+v", listRec.Items)
+	}
+
+	var owned []listLink
+	decode(t, serve(s.HandleGetOwnedLists, "katya", "GET", "/v1/lists/owned", ""), &owned)
+	if len(owned) != 1 || owned[0].Id != id || owned[0].DisplayName != "Groceries" {
+		t.Errorf("got owned lists %+v", owned)
+	}
+}
+
+func TestCreateListFromContent(t *testing.T) {
+	s := newTestService(t, "katya")
+	id := createTestList(t, s, "katya", `{"name":"Groceries","content":"Milk\n\nBread\n"}`)
+	listRec := getTestList(t, s, "katya", id)
+	if names := strings.Join(itemNames(listRec.Items), ","); names != "Milk,Bread" {
+		t.Errorf("got items %s", names)
+	}
+}
+
+func TestCreateListRejectsInvalidBody(t *testing.T) {
+	s := newTestService(t, "katya")
+	w := serve(s.HandleCreateList, "katya", "POST", "/v1/list/create", `{"name":`)
+	expectStatus(t, w, http.StatusBadRequest)
+}
+
+func TestEditList(t *testing.T) {
+	s := newTestService(t, "katya")
+	id := createTestList(t, s, "katya", `{"name":"Groceries","items":[{"name":"Milk","quantity":2}]}`)
+
+	w := serve(s.HandleUpdateList, "katya", "POST", "/v1/list/update?id="+id, `{"content":"Milk\nEggs"}`, "If-Match", `"1"`)
+	expectStatus(t, w, http.StatusOK)
+	if etag := w.Header().Get("ETag"); etag != `"2"` {
+		t.Errorf("got ETag %s, want \"2\"", etag)
+	}
+	listRec := getTestList(t, s, "katya", id)
+	if names := strings.Join(itemNames(listRec.Items), ","); names != "Milk,Eggs" {
+		t.Errorf("got items %s", names)
+	}
+	// Items kept by the new content keep their attributes
+	if listRec.Items[0].Quantity != 2 {
+		t.Errorf("milk lost its quantity: %+v", listRec.Items[0])
+	}
+}
+
+func TestEditListWithStaleVersion(t *testing.T) {
+	s := newTestService(t, "katya")
+	id := createTestList(t, s, "katya", `{"name":"Groceries","content":"Milk"}`)
+	w := serve(s.HandleUpdateList, "katya", "POST", "/v1/list/update?id="+id, `{"content":"Milk\nEggs"}`, "If-Match", `"1"`)
+	expectStatus(t, w, http.StatusOK)
+
+	w = serve(s.HandleUpdateList, "katya", "POST", "/v1/list/update?id="+id, `{"content":"Bread"}`, "If-Match", `"1"`)
+	expectStatus(t, w, http.StatusPreconditionFailed)
+	if etag := w.Header().Get("ETag"); etag != `"2"` {
+		t.Errorf("got ETag %s, want \"2\"", etag)
+	}
+	var conflict conflictResp
+	decode(t, w, &conflict)
+	if conflict.Error != errVersionMismatch.Error() || conflict.List == nil || conflict.List.Version != 2 {
+		t.Fatalf("got conflict %+v", conflict)
+	}
+	if names := strings.Join(itemNames(conflict.List.Items), ","); names != "Milk,Eggs" {
+		t.Errorf("conflict has items %s, want the current ones", names)
+	}
+	if names := strings.Join(itemNames(getTestList(t, s, "katya", id).Items), ","); names != "Milk,Eggs" {
+		t.Errorf("stale edit has changed the list to %s", names)
+	}
+
+	w = serve(s.HandleUpdateList, "katya", "POST", "/v1/list/update?id="+id, `{"content":"Bread"}`, "If-Match", "three")
+	expectStatus(t, w, http.StatusBadRequest)
+}
+
+func TestEditListWithoutAccess(t *testing.T) {
+	s := newTestService(t, "katya", "vasya")
+	id := createTestList(t, s, "katya", `{"name":"Groceries","content":"Milk"}`)
+
+	w := serve(s.HandleUpdateList, "vasya", "POST", "/v1/list/update?id="+id, `{"content":"Beer"}`)
+	expectStatus(t, w, http.StatusUnauthorized)
+	w = serve(s.HandleGetList, "vasya", "GET", "/v1/list/get?id="+id, "")
+	if strings.Contains(w.Body.String(), "Milk") || !strings.Contains(w.Body.String(), "access denied") {
+		t.Errorf("user without access got %q", w.Body.String())
+	}
+}
+
+func TestDeleteList(t *testing.T) {
+	s := newTestService(t, "katya", "vasya")
+	id := createTestList(t, s, "katya", `{"name":"Groceries","content":"Milk"}`)
+	shareTestList(t, s, "katya", "vasya", id, roleEditor)
+	version := getTestList(t, s, "katya", id).Version
+
+	w := serve(s.HandleDeleteList, "katya", "POST", "/v1/list/delete?id="+id, "", "If-Match", `"1"`)
+	expectStatus(t, w, http.StatusPreconditionFailed)
+	getTestList(t, s, "vasya", id)
+
+	w = serve(s.HandleDeleteList, "katya", "POST", "/v1/list/delete?id="+id, "", "If-Match", strconv.Quote(strconv.FormatInt(version, 10)))
+	expectStatus(t, w, http.StatusOK)
+	for _, username := range []string{"katya", "vasya"} {
+		w = serve(s.HandleGetList, username, "GET", "/v1/list/get?id="+id, "")
+		if !strings.Contains(w.Body.String(), "access denied") {
+			t.Errorf("%s still gets the deleted list: %q", username, w.Body.String())
+		}
+	}
+	var owned, shared []listLink
+	decode(t, serve(s.HandleGetOwnedLists, "katya", "GET", "/v1/lists/owned", ""), &owned)
+	decode(t, serve(s.HandleGetSharedLists, "vasya", "GET", "/v1/lists/shared", ""), &shared)
+	if len(owned) != 0 || len(shared) != 0 {
+		t.Errorf("links are left after deletion: owned %+v, shared %+v", owned, shared)
+	}
+}
+
+func TestGuestDeletingListLeavesIt(t *testing.T) {
+	s := newTestService(t, "katya", "vasya")
+	id := createTestList(t, s, "katya", `{"name":"Groceries","content":"Milk"}`)
+	shareTestList(t, s, "katya", "vasya", id, roleEditor)
+
+	w := serve(s.HandleDeleteList, "vasya", "POST", "/v1/list/delete?id="+id, "")
+	expectStatus(t, w, http.StatusOK)
+	listRec := getTestList(t, s, "katya", id)
+	if len(listRec.Guests) != 0 {
+		t.Errorf("guest is still in the list: %+v", listRec.Guests)
+	}
+}
@@ -0,0 +1,178 @@
+package logic
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"github.com/segmentio/ksuid"
+	"time"
+)
+
+var (
+	errInviteNotFound = errors.New("invite not found")
+	errInviteExpired  = errors.New("invite has expired or has been used up")
+	errInvalidInvite  = errors.New("expiry must be in the future and max uses must not be negative")
+)
+
+// invite lets any user who knows the token join the list with the role.
+// It never expires if Expires is nil and may be used any number of times if MaxUses is 0.
+type invite struct {
+	Id      string     `bson:"id" json:"id"`
+	Token   string     `bson:"token" json:"token"`
+	ListId  string     `bson:"list_id" json:"list_id"`
+	Creator string     `bson:"creator" json:"creator"`
+	Role    string     `bson:"role" json:"role"`
+	Created time.Time  `bson:"created" json:"created"`
+	Expires *time.Time `bson:"expires" json:"expires"`
+	MaxUses int64      `bson:"max_uses" json:"max_uses"`
+	Uses    int64      `bson:"uses" json:"uses"`
+}
+
+func (inv *invite) active(now time.Time) bool {
+	return (inv.Expires == nil || now.Before(*inv.Expires)) && (inv.MaxUses == 0 || inv.Uses < inv.MaxUses)
+}
+
+// newToken returns a random URL-safe token which cannot be guessed
+func newToken() (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+// authorizeInvites loads the list if the user may manage its invites
+func (s *Service) authorizeInvites(username, id string) (*list, error) {
+	listRec, err := s.lists.Get(id)
+	if err == errNotFound {
+		return nil, errNoPermission
+	}
+	if err != nil {
+		return nil, err
+	}
+	permitted, err := s.permitsList(listRec, username, permShare)
+	if err != nil {
+		return nil, err
+	}
+	if !permitted {
+		return nil, errNoPermission
+	}
+	return listRec, nil
+}
+
+func (s *Service) createInvite(username, id, role string, expires *time.Time, maxUses int64) (*invite, error) {
+	if role == "" {
+		role = defaultGuestRole
+	}
+	if !validGuestRole(role) {
+		return nil, errInvalidRole
+	}
+	now := time.Now()
+	if (expires != nil && !expires.After(now)) || maxUses < 0 {
+		return nil, errInvalidInvite
+	}
+	if _, err := s.authorizeInvites(username, id); err != nil {
+		return nil, err
+	}
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	inv := invite{
+		Id:      ksuid.New().String(),
+		Token:   token,
+		ListId:  id,
+		Creator: username,
+		Role:    role,
+		Created: now,
+		Expires: expires,
+		MaxUses: maxUses,
+	}
+	if err = s.invites.Insert(inv); err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+// listInvites returns invites of the list which can still be used
+func (s *Service) listInvites(username, id string) ([]invite, error) {
+	if _, err := s.authorizeInvites(username, id); err != nil {
+		return nil, err
+	}
+	invites, err := s.invites.ByList(id)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	active := make([]invite, 0, len(invites))
+	for _, inv := range invites {
+		if inv.active(now) {
+			active = append(active, inv)
+		}
+	}
+	return active, nil
+}
+
+func (s *Service) revokeInvite(username, id, inviteId string) error {
+	if _, err := s.authorizeInvites(username, id); err != nil {
+		return err
+	}
+	err := s.invites.Remove(id, inviteId)
+	if err == errNotFound {
+		return errInviteNotFound
+	}
+	return err
+}
+
+// joinByInvite adds the user to the list of the invite and returns the list id
+func (s *Service) joinByInvite(username, token string) (string, error) {
+	inv, err := s.invites.Get(token)
+	if err == errNotFound {
+		return "", errInviteNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if !inv.active(time.Now()) {
+		return "", errInviteExpired
+	}
+	listRec, err := s.lists.Get(inv.ListId)
+	if err == errNotFound {
+		return "", errInviteNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if err = s.checkNewGuest(listRec, inv.Creator, username); err != nil {
+		return "", err
+	}
+	err = s.atomically(func(st *Storage, sg *saga) error {
+		// The use is counted first, so concurrent joins can't exceed max uses
+		err := sg.step(func() error {
+			err := st.invites.Use(token)
+			if err == errNotFound {
+				return errInviteExpired
+			}
+			return err
+		}, func() error {
+			return st.invites.Release(token)
+		})
+		if err != nil {
+			return err
+		}
+		return addGuestSteps(st, sg, listRec, username, inv.Role)
+	})
+	if err == errDuplicate {
+		return "", errAlreadyShared
+	}
+	if err == errNotFound {
+		// The list has been deleted meanwhile
+		return "", errInviteNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	s.publishGuestAdded(username, inv.ListId)
+	s.notify([]string{inv.Creator}, notificationInviteUsed, username, inv.ListId, listRec.OriginalName)
+	return inv.ListId, nil
+}
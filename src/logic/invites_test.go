@@ -0,0 +1,33 @@
+package logic
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestFailedJoinGivesInviteUseBack(t *testing.T) {
+	s := newTestService(t, "katya", "vasya", "masha", "petya")
+	id := createTestList(t, s, "katya", `{"name":"Groceries"}`)
+	var inv invite
+	decode(t, serve(s.HandleCreateInvite, "katya", "POST", "/v1/list/invites/create?id="+id, `{"max_uses":1}`), &inv)
+	// A link left without the guest in the list makes adding the guest fail after the use is counted
+	if err := s.access.AddShared("vasya", listLink{Id: id, DisplayName: "Groceries"}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(s.HandleJoinByInvite, "vasya", "POST", "/v1/invites/join?token="+inv.Token, "")
+	expectStatus(t, w, http.StatusConflict)
+	var invites []invite
+	decode(t, serve(s.HandleGetInvites, "katya", "GET", "/v1/list/invites?id="+id, ""), &invites)
+	if len(invites) != 1 || invites[0].Uses != 0 {
+		t.Fatalf("failed join has used up the invite: %+v", invites)
+	}
+
+	w = serve(s.HandleJoinByInvite, "masha", "POST", "/v1/invites/join?token="+inv.Token, "")
+	expectStatus(t, w, http.StatusOK)
+	w = serve(s.HandleJoinByInvite, "petya", "POST", "/v1/invites/join?token="+inv.Token, "")
+	expectStatus(t, w, http.StatusGone)
+	if guests := getTestList(t, s, "katya", id).Guests; len(guests) != 1 || guests[0] != "masha" {
+		t.Errorf("got guests %v, want masha", guests)
+	}
+}
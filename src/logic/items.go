@@ -0,0 +1,296 @@
+package logic
+
+import (
+	"errors"
+	"github.com/segmentio/ksuid"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errItemNotFound = errors.New("item not found")
+var errEmptyItemName = errors.New("item name can't be empty")
+
+type item struct {
+	Id       string  `bson:"id" json:"id"`
+	Name     string  `bson:"name" json:"name"`
+	Quantity float64 `bson:"quantity" json:"quantity"`
+	Unit     string  `bson:"unit" json:"unit"`
+	Checked  bool    `bson:"checked" json:"checked"`
+	Note     string  `bson:"note" json:"note"`
+	Position int     `bson:"position" json:"position"`
+
+	// Stamps are set by merged operations and direct writes, the latest one wins for each field
+	Stamps itemStamps `bson:"stamps,omitempty" json:"-"`
+}
+
+// itemChanges holds the fields of an item that should be modified, nil fields are left as is
+type itemChanges struct {
+	Name     *string  `json:"name"`
+	Quantity *float64 `json:"quantity"`
+	Unit     *string  `json:"unit"`
+	Checked  *bool    `json:"checked"`
+	Note     *string  `json:"note"`
+}
+
+func newItem(name string, position int) item {
+	return item{
+		Id:       ksuid.New().String(),
+		Name:     name,
+		Position: position,
+	}
+}
+
+func sortItems(items []item) {
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Position < items[j].Position
+	})
+}
+
+// itemsFromContent converts legacy free-text content into items, one per non-empty line.
+// Items of previous that have the same name are kept with their attributes.
+func itemsFromContent(content string, previous []item) []item {
+	known := make(map[string]item, len(previous))
+	for _, it := range previous {
+		known[it.Name] = it
+	}
+	items := make([]item, 0, 1)
+	for _, line := range strings.Split(content, "\n") {
+		name := strings.TrimSpace(line)
+		if name == "" {
+			continue
+		}
+		it, ok := known[name]
+		if ok {
+			delete(known, name)
+		} else {
+			it = newItem(name, 0)
+		}
+		it.Position = len(items)
+		items = append(items, it)
+	}
+	return items
+}
+
+// contentFromItems renders items as legacy free-text content for old clients
+func contentFromItems(items []item) string {
+	names := make([]string, 0, len(items))
+	for _, it := range items {
+		names = append(names, it.Name)
+	}
+	return strings.Join(names, "\n")
+}
+
+// loadList returns a list with its items in order. Content is filled in as a compatibility view of the items.
+// Items of a legacy list are only built from its content, the list is migrated by the first write.
+func (s *Service) loadList(id string) (*list, error) {
+	listRec, err := s.lists.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if isLegacyList(listRec) {
+		listRec.Items = legacyItems(listRec)
+	}
+	presentList(listRec)
+	return listRec, nil
+}
+
+// loadListForEdit loads the list for a write of single items and checks that it is in the expected version.
+// Items of a legacy list are stored first, so the write finds them. It returns the version the write expects.
+func (s *Service) loadListForEdit(id string, version int64) (*list, int64, error) {
+	listRec, err := s.lists.Get(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err = checkVersion(listRec, version); err != nil {
+		return nil, 0, err
+	}
+	if isLegacyList(listRec) {
+		listRec.Items = legacyItems(listRec)
+		listRec.Version, err = s.lists.SetItems(id, listRec.Items, listRec.Version)
+		if err != nil {
+			return nil, 0, err
+		}
+		if version != anyVersion {
+			version = listRec.Version
+		}
+	}
+	presentList(listRec)
+	return listRec, version, nil
+}
+
+func isLegacyList(listRec *list) bool {
+	return len(listRec.Items) == 0 && listRec.Content != ""
+}
+
+// legacyItems builds items from the content of a legacy list. Their ids are derived from the list,
+// so items read before the list is migrated keep their ids.
+func legacyItems(listRec *list) []item {
+	items := itemsFromContent(listRec.Content, nil)
+	for i := range items {
+		items[i].Id = listRec.Id + "-" + strconv.Itoa(i)
+	}
+	return items
+}
+
+// presentList puts items of a migrated list in order and fills in the compatibility view
+func presentList(listRec *list) {
+	if listRec.Items == nil {
+		listRec.Items = make([]item, 0)
+	}
+	sortItems(listRec.Items)
+	listRec.Content = contentFromItems(listRec.Items)
+}
+
+func hasItem(listRec *list, itemId string) bool {
+	for _, it := range listRec.Items {
+		if it.Id == itemId {
+			return true
+		}
+	}
+	return false
+}
+
+// loadListForItem loads the list like loadListForEdit and makes sure it contains the item
+func (s *Service) loadListForItem(id, itemId string, version int64) (*list, int64, error) {
+	listRec, version, err := s.loadListForEdit(id, version)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !hasItem(listRec, itemId) {
+		return nil, 0, errItemNotFound
+	}
+	return listRec, version, nil
+}
+
+func (s *Service) addItem(username, id string, changes itemChanges, version int64) (string, int64, error) {
+	listRec, version, err := s.loadListForEdit(id, version)
+	if err != nil {
+		return "", 0, err
+	}
+	if changes.Name == nil || strings.TrimSpace(*changes.Name) == "" {
+		return "", 0, errEmptyItemName
+	}
+	position := 0
+	for _, it := range listRec.Items {
+		if it.Position >= position {
+			position = it.Position + 1
+		}
+	}
+	st, err := s.serverStamp(listRec)
+	if err != nil {
+		return "", 0, err
+	}
+	newIt := newItem(strings.TrimSpace(*changes.Name), position)
+	applyItemChanges(&newIt, changes)
+	newIt.Stamps.stampAll(st)
+	newVersion, err := s.lists.PushItem(id, newIt, version)
+	if err != nil {
+		return "", 0, err
+	}
+	s.listEdited(username, listRec, newVersion)
+	return newIt.Id, newVersion, nil
+}
+
+func applyItemChanges(it *item, changes itemChanges) {
+	if changes.Name != nil {
+		it.Name = strings.TrimSpace(*changes.Name)
+	}
+	if changes.Quantity != nil {
+		it.Quantity = *changes.Quantity
+	}
+	if changes.Unit != nil {
+		it.Unit = *changes.Unit
+	}
+	if changes.Checked != nil {
+		it.Checked = *changes.Checked
+	}
+	if changes.Note != nil {
+		it.Note = *changes.Note
+	}
+}
+
+func (s *Service) editItem(username, id, itemId string, changes itemChanges, version int64) (int64, error) {
+	listRec, version, err := s.loadListForItem(id, itemId, version)
+	if err != nil {
+		return 0, err
+	}
+	if changes.Name != nil {
+		name := strings.TrimSpace(*changes.Name)
+		if name == "" {
+			return 0, errEmptyItemName
+		}
+		changes.Name = &name
+	}
+	st, err := s.serverStamp(listRec)
+	if err != nil {
+		return 0, err
+	}
+	newVersion, err := s.lists.UpdateItem(id, itemId, changes, st, version)
+	if err != nil {
+		return 0, err
+	}
+	s.listEdited(username, listRec, newVersion)
+	return newVersion, nil
+}
+
+func (s *Service) checkItem(username, id, itemId string, checked bool, version int64) (int64, error) {
+	return s.editItem(username, id, itemId, itemChanges{Checked: &checked}, version)
+}
+
+// reorderItems places items in the given order, items missing from order keep their relative order after them
+func (s *Service) reorderItems(username, id string, order []string, version int64) (int64, error) {
+	listRec, err := s.loadList(id)
+	if err != nil {
+		return 0, err
+	}
+	if err = checkVersion(listRec, version); err != nil {
+		return 0, err
+	}
+	byId := make(map[string]item, len(listRec.Items))
+	for _, it := range listRec.Items {
+		byId[it.Id] = it
+	}
+	items := make([]item, 0, len(listRec.Items))
+	for _, itemId := range order {
+		it, ok := byId[itemId]
+		if !ok {
+			return 0, errItemNotFound
+		}
+		delete(byId, itemId)
+		items = append(items, it)
+	}
+	for _, it := range listRec.Items {
+		if _, ok := byId[it.Id]; ok {
+			items = append(items, it)
+		}
+	}
+	for i := range items {
+		items[i].Position = i
+	}
+	st, err := s.serverStamp(listRec)
+	if err != nil {
+		return 0, err
+	}
+	stampItems(items, listRec.Items, st)
+	// Reordering is computed from the loaded list, so it must not overwrite concurrent changes
+	newVersion, err := s.lists.SetItems(id, items, listRec.Version)
+	if err != nil {
+		return 0, err
+	}
+	s.listEdited(username, listRec, newVersion)
+	return newVersion, nil
+}
+
+func (s *Service) deleteItem(username, id, itemId string, version int64) (int64, error) {
+	listRec, version, err := s.loadListForItem(id, itemId, version)
+	if err != nil {
+		return 0, err
+	}
+	newVersion, err := s.lists.PullItem(id, itemId, version)
+	if err != nil {
+		return 0, err
+	}
+	s.listEdited(username, listRec, newVersion)
+	return newVersion, nil
+}
@@ -0,0 +1,102 @@
+package logic
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// insertLegacyList stores a list from before items, which has only free-text content
+func insertLegacyList(t *testing.T, s *Service, owner, id, content string) {
+	t.Helper()
+	err := s.lists.Insert(list{
+		Id:           id,
+		OriginalName: "Groceries",
+		Owner:        owner,
+		Content:      content,
+		Version:      1,
+		LastChanged:  time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.access.AddOwned(owner, listLink{Id: id, DisplayName: "Groceries"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadingLegacyListDoesNotChangeIt(t *testing.T) {
+	s := newTestService(t, "katya")
+	insertLegacyList(t, s, "katya", "legacy", "Milk\nBread")
+	if err := s.lists.SetPublicToken("legacy", "token"); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := s.lists.Get("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := getTestList(t, s, "katya", "legacy")
+	view, err := s.publicView("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := getTestList(t, s, "katya", "legacy")
+	if names := strings.Join(itemNames(first.Items), ","); names != "Milk,Bread" {
+		t.Fatalf("got items %s", names)
+	}
+	if first.Version != 1 || second.Version != 1 || len(view.Items) != 2 {
+		t.Errorf("got versions %d and %d, public items %+v", first.Version, second.Version, view.Items)
+	}
+	for i := range first.Items {
+		if first.Items[i].Id != second.Items[i].Id || first.Items[i].Id != view.Items[i].Id {
+			t.Errorf("item %d has ids %s, %s and %s", i, first.Items[i].Id, second.Items[i].Id, view.Items[i].Id)
+		}
+	}
+	after, err := s.lists.Get("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Version != stored.Version || !after.LastChanged.Equal(stored.LastChanged) || len(after.Items) != 0 {
+		t.Errorf("reading has changed the stored list to %+v", after)
+	}
+}
+
+func TestEditingLegacyListMigratesIt(t *testing.T) {
+	s := newTestService(t, "katya")
+	insertLegacyList(t, s, "katya", "legacy", "Milk\nBread")
+	bread := getTestList(t, s, "katya", "legacy").Items[1]
+
+	w := serve(s.HandleCheckItem, "katya", "POST", "/v1/list/items/check?id=legacy&item="+bread.Id, `{"checked":true}`,
+		"If-Match", `"1"`)
+	expectStatus(t, w, http.StatusOK)
+	stored, err := s.lists.Get("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if etag := strconv.Quote(strconv.FormatInt(stored.Version, 10)); w.Header().Get("ETag") != etag {
+		t.Errorf("got ETag %s, want %s", w.Header().Get("ETag"), etag)
+	}
+	if len(stored.Items) != 2 || stored.Items[1].Id != bread.Id || !stored.Items[1].Checked {
+		t.Errorf("got stored items %+v", stored.Items)
+	}
+
+	w = serve(s.HandleAddItem, "katya", "POST", "/v1/list/items/add?id=legacy", `{"name":"Eggs"}`,
+		"If-Match", strconv.Quote(strconv.FormatInt(stored.Version, 10)))
+	expectStatus(t, w, http.StatusOK)
+	if names := strings.Join(itemNames(getTestList(t, s, "katya", "legacy").Items), ","); names != "Milk,Bread,Eggs" {
+		t.Errorf("got items %s", names)
+	}
+}
+
+func TestAddingToLegacyListKeepsContent(t *testing.T) {
+	s := newTestService(t, "katya")
+	insertLegacyList(t, s, "katya", "legacy", "Milk")
+	w := serve(s.HandleAddItem, "katya", "POST", "/v1/list/items/add?id=legacy", `{"name":"Eggs"}`, "If-Match", `"1"`)
+	expectStatus(t, w, http.StatusOK)
+	if names := strings.Join(itemNames(getTestList(t, s, "katya", "legacy").Items), ","); names != "Milk,Eggs" {
+		t.Errorf("got items %s", names)
+	}
+}
@@ -4,21 +4,48 @@ import (
 	"errors"
 	"github.com/segmentio/ksuid"
 	log "github.com/sirupsen/logrus"
+	"strings"
 	"time"
 )
 
+// anyVersion disables the version check of list modifications
+const anyVersion int64 = -1
+
+var (
+	errVersionMismatch = errors.New("list was modified by someone else")
+	errNotOwner        = errors.New("only the owner of the list can do this")
+	errNotGuest        = errors.New("user is not a guest of the list")
+	errEmptyListName   = errors.New("list name can't be empty")
+	errNoLink          = errors.New("user has no link to the list")
+	errGroupAccess     = errors.New("list is shared with the user through a group, leave the group instead")
+)
+
 type list struct {
-	Id           string    `bson:"id" json:"id"`
-	Owner        string    `bson:"owner" json:"owner"`
-	Guests       []string  `bson:"guests" json:"guests"`
-	OriginalName string    `bson:"name"`
-	LastChanged  time.Time `bson:"last_changed" json:"last_changed"`
-	Content      string    `bson:"content" json:"content"`
+	Id     string   `bson:"id" json:"id"`
+	Owner  string   `bson:"owner" json:"owner"`
+	Guests []string `bson:"guests" json:"guests"`
+	// Roles of guests, guests without one have defaultGuestRole
+	Roles []guestRole `bson:"roles" json:"roles"`
+	// Groups the list is shared with, their members have access without being guests
+	Groups       []groupShare `bson:"groups" json:"groups"`
+	OriginalName string       `bson:"name"`
+	LastChanged  time.Time    `bson:"last_changed" json:"last_changed"`
+	Version      int64        `bson:"version" json:"version"`
+	Items        []item       `bson:"items" json:"items"`
+	// PublicToken lets anyone read the list without an account, it is empty if the list is not public
+	PublicToken string `bson:"public_token,omitempty" json:"-"`
+	// Deleted is when the list was moved to the trash, it is nil for lists in use
+	Deleted *time.Time `bson:"deleted,omitempty" json:"-"`
+	// Content is only stored by lists created before items were introduced,
+	// otherwise it is a read-only view of Items for older clients
+	Content string `bson:"content,omitempty" json:"content"`
 }
 
+// listLink is how a user sees a list. DisplayName follows the name of the list unless the user has set an alias.
 type listLink struct {
 	Id          string `bson:"id" json:"id"`
 	DisplayName string `bson:"display" json:"display_name"`
+	Aliased     bool   `bson:"aliased,omitempty" json:"aliased"`
 }
 
 type accessRecord struct {
@@ -27,130 +54,444 @@ type accessRecord struct {
 	SharedLists []listLink `bson:"shared" json:"shared_lists"`
 }
 
-func hasAccessToList(username, id string) (bool, error) {
-	accessRec, err := getAccessByUsername(username)
-	if err != nil {
-		return false, err
-	}
-	for _, listLn := range accessRec.OwnedLists {
-		if listLn.Id == id {
-			return true, nil
-		}
-	}
-	for _, listLn := range accessRec.SharedLists {
-		if listLn.Id == id {
-			return true, nil
-		}
-	}
-	return false, nil
-}
-
-func createList(username, name, content string) (string, error) {
+func (s *Service) createList(username, name string, items []item) (string, error) {
 	id := ksuid.New().String()
+	for i := range items {
+		items[i].Id = ksuid.New().String()
+		items[i].Position = i
+	}
 	newList := list{
 		Id:           id,
 		Owner:        username,
 		Guests:       make([]string, 0, 1),
+		Roles:        make([]guestRole, 0, 1),
+		Groups:       make([]groupShare, 0),
 		OriginalName: name,
 		LastChanged:  time.Now(),
-		Content:      content,
+		Version:      1,
+		Items:        items,
 	}
-	err := insertListInDB(newList)
-	if err != nil {
-		return "", err
-	}
-	err = addToAccessListsOwned(username, listLink{
-		Id:          id,
-		DisplayName: name,
+	err := s.atomically(func(st *Storage, sg *saga) error {
+		err := sg.step(func() error {
+			return st.lists.Insert(newList)
+		}, func() error {
+			return st.lists.Remove(id, anyVersion)
+		})
+		if err != nil {
+			return err
+		}
+		return sg.step(func() error {
+			return st.access.AddOwned(username, listLink{
+				Id:          id,
+				DisplayName: name,
+			})
+		}, func() error {
+			return st.access.RemoveOwned(username, id)
+		})
 	})
 	if err != nil {
 		return "", err
 	}
+	s.recordRevision(username, id, newList.Version, 0)
 	return id, nil
 }
 
-func unlinkList(username, id string) error {
-	accessRec, err := getAccessByUsername(username)
+func checkVersion(listRec *list, version int64) error {
+	if version != anyVersion && listRec.Version != version {
+		return errVersionMismatch
+	}
+	return nil
+}
+
+func (s *Service) unlinkList(username, id string, version int64) error {
+	accessRec, err := s.access.Get(username)
 	if err != nil {
 		return err
 	}
 	for _, listLn := range accessRec.OwnedLists {
 		if listLn.Id == id {
-			err = deleteList(id)
-			if err != nil {
-				log.Error("Owner \"", username, "\" has unlinked list ", id, "but it is not removed:", err)
-			}
-			err := removeFromAccessListsOwned(username, id)
+			return s.deleteList(id, version)
+		}
+	}
+	// Guests without a link leave the list as well
+	return s.leaveList(username, id)
+}
+
+// addGuest gives the guest access to the list with the role, if the user who has shared it may still share it
+func (s *Service) addGuest(sharer, guest, id, role string) error {
+	listRec, err := s.lists.Get(id)
+	if err == errNotFound {
+		return errNoPermission
+	}
+	if err != nil {
+		return err
+	}
+	if err = s.checkNewGuest(listRec, sharer, guest); err != nil {
+		return err
+	}
+	err = s.atomically(func(st *Storage, sg *saga) error {
+		return addGuestSteps(st, sg, listRec, guest, role)
+	})
+	if err == errDuplicate {
+		// Someone has added the guest meanwhile
+		return errAlreadyShared
+	}
+	if err != nil {
+		return err
+	}
+	s.publishGuestAdded(guest, id)
+	return nil
+}
+
+// checkNewGuest checks that the sharer may still share the list and the guest has no access to it yet
+func (s *Service) checkNewGuest(listRec *list, sharer, guest string) error {
+	permitted, err := s.permitsList(listRec, sharer, permShare)
+	if err != nil {
+		return err
+	}
+	if !permitted {
+		return errNoPermission
+	}
+	if listRec.roleOf(guest) != "" {
+		return errAlreadyShared
+	}
+	return nil
+}
+
+// addGuestSteps links the list to the guest and adds the guest to the list in the saga
+func addGuestSteps(st *Storage, sg *saga, listRec *list, guest, role string) error {
+	id := listRec.Id
+	link := listLink{Id: id, DisplayName: listRec.OriginalName}
+	err := sg.step(func() error {
+		return st.access.AddShared(guest, link)
+	}, func() error {
+		return st.access.RemoveShared(guest, id)
+	})
+	if err != nil {
+		return err
+	}
+	return sg.step(func() error {
+		return st.lists.AddGuest(id, guest, role)
+	}, func() error {
+		return st.lists.RemoveGuest(id, guest)
+	})
+}
+
+func (s *Service) publishGuestAdded(guest, id string) {
+	if listRec, err := s.lists.Get(id); err == nil {
+		s.publishListEvent(eventGuestAdded, guest, listRec, listRec.Version)
+	}
+}
+
+// revokeGuest takes access to the list away from one of its guests on behalf of the owner
+func (s *Service) revokeGuest(owner, guest, id string) error {
+	listRec, err := s.lists.Get(id)
+	if err == errNotFound {
+		return errNotOwner
+	}
+	if err != nil {
+		return err
+	}
+	if listRec.Owner != owner {
+		return errNotOwner
+	}
+	if err = s.removeGuest(owner, guest, id, listRec); err != nil {
+		return err
+	}
+	s.notify([]string{guest}, notificationAccessRevoked, owner, id, listRec.OriginalName)
+	return nil
+}
+
+// leaveList removes the shared list from the guest and the guest from the list
+func (s *Service) leaveList(username, id string) error {
+	listRec, err := s.lists.Get(id)
+	if err != nil && err != errNotFound {
+		return err
+	}
+	if err == errNotFound {
+		// The link is orphaned, it is still removed
+		listRec = nil
+	}
+	err = s.removeGuest(username, username, id, listRec)
+	if err == errNotGuest {
+		return s.notGuestError(username, listRec)
+	}
+	if err != nil {
+		return err
+	}
+	if listRec != nil {
+		s.notify([]string{listRec.Owner}, notificationGuestLeft, username, id, listRec.OriginalName)
+	}
+	return nil
+}
+
+// notGuestError explains why the user can't leave the list they are not a guest of,
+// members of a group the list is shared with have to leave the group
+func (s *Service) notGuestError(username string, listRec *list) error {
+	if listRec == nil {
+		return errNotGuest
+	}
+	role, err := s.roleIn(listRec, username)
+	if err != nil {
+		return err
+	}
+	if role != "" && role != roleOwner {
+		return errGroupAccess
+	}
+	return errNotGuest
+}
+
+// removeGuest removes the guest from the list and the list from shared lists of the guest on behalf of actor.
+// listRec is nil if the list doesn't exist anymore.
+func (s *Service) removeGuest(actor, guest, id string, listRec *list) error {
+	guestAccess, err := s.access.Get(guest)
+	if err != nil && err != errNotFound {
+		return err
+	}
+	var link *listLink
+	if guestAccess != nil {
+		link = findLink(guestAccess.SharedLists, id)
+	}
+	isGuest := listRec != nil && hasGuest(listRec, guest)
+	if link == nil && !isGuest {
+		return errNotGuest
+	}
+	err = s.atomically(func(st *Storage, sg *saga) error {
+		if link != nil {
+			err := sg.step(func() error {
+				return st.access.RemoveShared(guest, id)
+			}, func() error {
+				return st.access.AddShared(guest, *link)
+			})
 			if err != nil {
 				return err
 			}
+		}
+		if !isGuest {
 			return nil
 		}
+		role := listRec.roleOf(guest)
+		return sg.step(func() error {
+			return st.lists.RemoveGuest(id, guest)
+		}, func() error {
+			return st.lists.AddGuest(id, guest, role)
+		})
+	})
+	if err != nil {
+		return err
 	}
-	for _, listLn := range accessRec.SharedLists {
-		if listLn.Id == id {
-			err := removeFromAccessListsShared(username, id)
-			return err
+	if err = s.removeAccessTracked(id, guest); err != nil {
+		log.Error("Failed to record removal of ", id, " for ", guest, ": ", err)
+	}
+	if listRec != nil {
+		// Members are taken from before the removal, so the guest gets the event too
+		if updated, err := s.lists.Get(id); err == nil {
+			s.publishListEvent(eventGuestRemoved, actor, listRec, updated.Version)
+		}
+	}
+	return nil
+}
+
+// findLink returns the link to the list among links, or nil
+func findLink(links []listLink, id string) *listLink {
+	for i := range links {
+		if links[i].Id == id {
+			return &links[i]
 		}
 	}
-	return errors.New("")
+	return nil
 }
-func addGuest(owner, guest, id string) error {
-	accessRec, err := getAccessByUsername(owner)
+
+// deleteList moves the list to the trash of its owner and removes links of the owner and guests to it.
+// The list stays restorable until the trash is purged.
+func (s *Service) deleteList(id string, version int64) error {
+	list, err := s.lists.Get(id)
 	if err != nil {
 		return err
 	}
-	for _, listLn := range accessRec.OwnedLists {
-		if listLn.Id == id {
-			err = addToAccessListsShared(guest, listLn)
+	if err = checkVersion(list, version); err != nil {
+		return err
+	}
+	err = s.atomically(func(st *Storage, sg *saga) error {
+		// Links are read before any write, so they can be restored
+		guestLinks := make(map[string]listLink, len(list.Guests))
+		for _, guest := range list.Guests {
+			guestAccess, err := st.access.Get(guest)
 			if err != nil {
 				return err
 			}
-			err = addToListGuests(guest, id)
+			if link := findLink(guestAccess.SharedLists, id); link != nil {
+				guestLinks[guest] = *link
+			}
+		}
+		ownerAccess, err := st.access.Get(list.Owner)
+		if err != nil {
+			return err
+		}
+		ownerLink := findLink(ownerAccess.OwnedLists, id)
+		for guest, link := range guestLinks {
+			guest, link := guest, link
+			err = sg.step(func() error {
+				return st.access.RemoveShared(guest, id)
+			}, func() error {
+				return st.access.AddShared(guest, link)
+			})
 			if err != nil {
 				return err
 			}
-			return nil
 		}
+		if ownerLink != nil {
+			err = sg.step(func() error {
+				return st.access.RemoveOwned(list.Owner, id)
+			}, func() error {
+				return st.access.AddOwned(list.Owner, *ownerLink)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		// The list is trashed last, so the links can be restored if it has been modified meanwhile
+		return sg.step(func() error {
+			_, err := st.lists.Trash(id, time.Now(), version)
+			return err
+		}, nil)
+	})
+	if err != nil {
+		return err
 	}
-	return errors.New("access denied")
+	removedFrom := append(listMembers(list), s.groupMembers(list)...)
+	if err = s.removeAccessTracked(id, removedFrom...); err != nil {
+		log.Error("Failed to record removal of ", id, ": ", err)
+	}
+	if err = s.requests.RemoveForList(id); err != nil {
+		log.Error("Failed to remove pending requests for ", id, ": ", err)
+	}
+	s.notify(list.Guests, notificationListDeleted, list.Owner, id, list.OriginalName)
+	s.publishListEvent(eventListDeleted, list.Owner, list, list.Version)
+	return nil
 }
 
-func deleteList(id string) error {
-	list, err := getListById(id)
+// editList replaces all items of the list with the ones described by legacy content
+func (s *Service) editList(username, id, content string, version int64) (int64, error) {
+	listRec, err := s.loadList(id)
+	if err != nil {
+		return 0, err
+	}
+	if err = checkVersion(listRec, version); err != nil {
+		return 0, err
+	}
+	st, err := s.serverStamp(listRec)
+	if err != nil {
+		return 0, err
+	}
+	items := itemsFromContent(content, listRec.Items)
+	stampItems(items, listRec.Items, st)
+	// New items keep attributes of the loaded ones, so concurrent changes must not be overwritten
+	newVersion, err := s.lists.SetItems(id, items, listRec.Version)
+	if err != nil {
+		return 0, err
+	}
+	s.listEdited(username, listRec, newVersion)
+	return newVersion, nil
+}
+
+// listEdited records the new revision of the list and tells its members that username has changed it
+func (s *Service) listEdited(username string, listRec *list, newVersion int64) {
+	s.recordRevision(username, listRec.Id, newVersion, 0)
+	s.notify(listMembers(listRec), notificationListEdited, username, listRec.Id, listRec.OriginalName)
+	s.publishListEvent(eventListEdited, username, listRec, newVersion)
+}
+
+// renameList renames the list on behalf of the owner, whose link follows the new name unless it has an alias.
+// With propagate links of guests without an alias follow it too, otherwise guests keep the old name as their alias.
+func (s *Service) renameList(username, id, name string, propagate bool, version int64) (int64, error) {
+	if strings.TrimSpace(name) == "" {
+		return 0, errEmptyListName
+	}
+	listRec, err := s.lists.Get(id)
+	if err == errNotFound {
+		return 0, errNotOwner
+	}
+	if err != nil {
+		return 0, err
+	}
+	if listRec.Owner != username {
+		return 0, errNotOwner
+	}
+	newVersion, err := s.lists.Rename(id, name, version)
+	if err != nil {
+		return 0, err
+	}
+	s.recordRevision(username, id, newVersion, 0)
+	if err = s.access.SetDisplayName(username, id, name); err != nil {
+		log.Error("Failed to rename the link of ", username, " to ", id, ": ", err)
+	}
+	for _, guest := range listRec.Guests {
+		if propagate {
+			err = s.access.SetDisplayName(guest, id, name)
+		} else {
+			err = s.keepDisplayName(guest, id)
+		}
+		if err != nil {
+			log.Error("Failed to update the link of ", guest, " to ", id, ": ", err)
+		}
+	}
+	s.notify(listRec.Guests, notificationListRenamed, username, id, name)
+	s.publishListEvent(eventListRenamed, username, listRec, newVersion)
+	return newVersion, nil
+}
+
+// keepDisplayName turns the current name of the link into an alias, so it doesn't follow renames
+func (s *Service) keepDisplayName(username, id string) error {
+	accessRec, err := s.access.Get(username)
 	if err != nil {
 		return err
 	}
-	err = removeListFromDB(id)
+	link := findLink(accessRec.SharedLists, id)
+	if link == nil || link.Aliased {
+		return nil
+	}
+	return s.access.SetAlias(username, id, link.DisplayName, true)
+}
+
+// setAlias names the list for the user only, an empty alias makes the link follow the name of the list again
+func (s *Service) setAlias(username, id, alias string) error {
+	listRec, err := s.lists.Get(id)
+	if err == errNotFound {
+		return errNoLink
+	}
 	if err != nil {
 		return err
 	}
-	for _, guest := range list.Guests {
-		if err = removeFromAccessListsShared(guest, id); err != nil {
-			log.Error("Failed to remove ", id, " from shared list of ", guest, ": ", err)
-		}
+	if strings.TrimSpace(alias) == "" {
+		err = s.access.SetAlias(username, id, listRec.OriginalName, false)
+	} else {
+		err = s.access.SetAlias(username, id, alias, true)
 	}
-	return nil
+	if err == errNotFound {
+		return errNoLink
+	}
+	return err
 }
 
-func listOwnedLists(username string) ([]listLink, error) {
-	acc, err := getAccessByUsername(username)
+func (s *Service) listOwnedLists(username string) ([]listLink, error) {
+	acc, err := s.access.Get(username)
 	if err != nil {
 		return nil, err
 	}
 	return acc.OwnedLists, nil
 }
 
-func listSharedLists(username string) ([]listLink, error) {
-	acc, err := getAccessByUsername(username)
+func (s *Service) listSharedLists(username string) ([]listLink, error) {
+	acc, err := s.access.Get(username)
 	if err != nil {
 		return nil, err
 	}
 	return acc.SharedLists, nil
 }
 
-func InitNewUser(username string) error {
-	return insertAccessRecord(accessRecord{
+func (s *Service) InitNewUser(username string) error {
+	return s.access.Insert(accessRecord{
 		Username:    username,
 		OwnedLists:  make([]listLink, 0, 1),
 		SharedLists: make([]listLink, 0, 1),
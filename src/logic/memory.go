@@ -0,0 +1,1000 @@
+package logic
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory repositories keep everything in the process, they are meant for development and tests.
+// Records are copied on the way in and out, so callers can't modify the stored state.
+
+type memoryLists struct {
+	mu    sync.RWMutex
+	lists map[string]list
+}
+
+type memoryAccess struct {
+	mu      sync.RWMutex
+	records map[string]accessRecord
+}
+
+type memoryRequests struct {
+	mu       sync.RWMutex
+	requests []shareRequest
+}
+
+type memoryNotifications struct {
+	mu            sync.RWMutex
+	notifications []notification
+}
+
+type memoryTombstones struct {
+	mu         sync.RWMutex
+	tombstones []tombstone
+}
+
+type memoryInvites struct {
+	mu      sync.RWMutex
+	invites []invite
+}
+
+type memoryGroups struct {
+	mu     sync.RWMutex
+	groups map[string]group
+}
+
+type memoryItemOps struct {
+	mu  sync.RWMutex
+	ops map[string][]itemOp
+}
+
+type memoryRevisions struct {
+	mu        sync.RWMutex
+	revisions map[string][]revision
+}
+
+func NewMemoryStorage() *Storage {
+	return &Storage{
+		lists:         &memoryLists{lists: make(map[string]list)},
+		access:        &memoryAccess{records: make(map[string]accessRecord)},
+		requests:      &memoryRequests{},
+		notifications: &memoryNotifications{},
+		tombstones:    &memoryTombstones{},
+		invites:       &memoryInvites{},
+		groups:        &memoryGroups{groups: make(map[string]group)},
+		revisions:     &memoryRevisions{revisions: make(map[string][]revision)},
+		itemOps:       &memoryItemOps{ops: make(map[string][]itemOp)},
+	}
+}
+
+func copyList(listRec list) list {
+	listRec.Guests = append(make([]string, 0, len(listRec.Guests)), listRec.Guests...)
+	listRec.Roles = append(make([]guestRole, 0, len(listRec.Roles)), listRec.Roles...)
+	listRec.Groups = append(make([]groupShare, 0, len(listRec.Groups)), listRec.Groups...)
+	listRec.Items = append(make([]item, 0, len(listRec.Items)), listRec.Items...)
+	return listRec
+}
+
+func copyAccessRecord(record accessRecord) accessRecord {
+	record.OwnedLists = append(make([]listLink, 0, len(record.OwnedLists)), record.OwnedLists...)
+	record.SharedLists = append(make([]listLink, 0, len(record.SharedLists)), record.SharedLists...)
+	return record
+}
+
+func (r *memoryLists) Get(id string) (*list, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	listRec, ok := r.lists[id]
+	if !ok || listRec.Deleted != nil {
+		return nil, errNotFound
+	}
+	listRec = copyList(listRec)
+	return &listRec, nil
+}
+
+func (r *memoryLists) Insert(listRec list) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.lists[listRec.Id]; ok {
+		return errDuplicate
+	}
+	r.lists[listRec.Id] = copyList(listRec)
+	return nil
+}
+
+func (r *memoryLists) Remove(id string, version int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	listRec, ok := r.lists[id]
+	if !ok || (version != anyVersion && listRec.Version != version) {
+		return errVersionMismatch
+	}
+	delete(r.lists, id)
+	return nil
+}
+
+// modify applies change to a copy of the list if it is in the given version and stores it with the next version.
+// change returns false if the list doesn't match.
+func (r *memoryLists) modify(id string, version int64, change func(listRec *list) bool) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	listRec, ok := r.lists[id]
+	if !ok || listRec.Deleted != nil || (version != anyVersion && listRec.Version != version) {
+		return 0, errVersionMismatch
+	}
+	listRec = copyList(listRec)
+	if !change(&listRec) {
+		return 0, errVersionMismatch
+	}
+	listRec.LastChanged = time.Now()
+	listRec.Version++
+	r.lists[id] = listRec
+	return listRec.Version, nil
+}
+
+func (r *memoryLists) SetItems(id string, items []item, version int64) (int64, error) {
+	return r.modify(id, version, func(listRec *list) bool {
+		listRec.Items = append([]item(nil), items...)
+		listRec.Content = ""
+		return true
+	})
+}
+
+func (r *memoryLists) PushItem(id string, it item, version int64) (int64, error) {
+	return r.modify(id, version, func(listRec *list) bool {
+		listRec.Items = append(listRec.Items, it)
+		return true
+	})
+}
+
+func (r *memoryLists) UpdateItem(id, itemId string, changes itemChanges, st stamp, version int64) (int64, error) {
+	return r.modify(id, version, func(listRec *list) bool {
+		for i := range listRec.Items {
+			if listRec.Items[i].Id != itemId {
+				continue
+			}
+			it := &listRec.Items[i]
+			if changes.Name != nil {
+				it.Name = *changes.Name
+			}
+			if changes.Quantity != nil {
+				it.Quantity = *changes.Quantity
+			}
+			if changes.Unit != nil {
+				it.Unit = *changes.Unit
+			}
+			if changes.Checked != nil {
+				it.Checked = *changes.Checked
+			}
+			if changes.Note != nil {
+				it.Note = *changes.Note
+			}
+			it.Stamps.stampChanges(changes, st)
+			return true
+		}
+		return false
+	})
+}
+
+func (r *memoryLists) PullItem(id, itemId string, version int64) (int64, error) {
+	return r.modify(id, version, func(listRec *list) bool {
+		for i := range listRec.Items {
+			if listRec.Items[i].Id == itemId {
+				listRec.Items = append(listRec.Items[:i], listRec.Items[i+1:]...)
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (r *memoryLists) Rename(id, name string, version int64) (int64, error) {
+	return r.modify(id, version, func(listRec *list) bool {
+		listRec.OriginalName = name
+		return true
+	})
+}
+
+func (r *memoryLists) AddGuest(id, username, role string) error {
+	duplicate := false
+	_, err := r.modify(id, anyVersion, func(listRec *list) bool {
+		if hasGuest(listRec, username) {
+			duplicate = true
+			return false
+		}
+		listRec.Guests = append(listRec.Guests, username)
+		listRec.Roles = append(withoutRole(listRec.Roles, username), guestRole{Username: username, Role: role})
+		return true
+	})
+	if duplicate {
+		return errDuplicate
+	}
+	if err == errVersionMismatch {
+		return errNotFound
+	}
+	return err
+}
+
+func (r *memoryLists) RemoveGuest(id, username string) error {
+	_, err := r.modify(id, anyVersion, func(listRec *list) bool {
+		guests := listRec.Guests[:0]
+		for _, guest := range listRec.Guests {
+			if guest != username {
+				guests = append(guests, guest)
+			}
+		}
+		listRec.Guests = guests
+		listRec.Roles = withoutRole(listRec.Roles, username)
+		return true
+	})
+	if err == errVersionMismatch {
+		return errNotFound
+	}
+	return err
+}
+
+func (r *memoryLists) SetOwner(id, owner string) error {
+	_, err := r.modify(id, anyVersion, func(listRec *list) bool {
+		listRec.Owner = owner
+		return true
+	})
+	if err == errVersionMismatch {
+		return errNotFound
+	}
+	return err
+}
+
+func (r *memoryLists) SetPublicToken(id, token string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	listRec, ok := r.lists[id]
+	if !ok {
+		return errNotFound
+	}
+	listRec.PublicToken = token
+	r.lists[id] = listRec
+	return nil
+}
+
+func (r *memoryLists) ByPublicToken(token string) (*list, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, listRec := range r.lists {
+		if token != "" && listRec.PublicToken == token && listRec.Deleted == nil {
+			listRec = copyList(listRec)
+			return &listRec, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func withoutRole(roles []guestRole, username string) []guestRole {
+	result := make([]guestRole, 0, len(roles))
+	for _, role := range roles {
+		if role.Username != username {
+			result = append(result, role)
+		}
+	}
+	return result
+}
+
+func (r *memoryLists) SetRole(id, username, role string) error {
+	_, err := r.modify(id, anyVersion, func(listRec *list) bool {
+		if !hasGuest(listRec, username) {
+			return false
+		}
+		listRec.Roles = append(withoutRole(listRec.Roles, username), guestRole{Username: username, Role: role})
+		return true
+	})
+	if err == errVersionMismatch {
+		return errNotFound
+	}
+	return err
+}
+
+func (r *memoryLists) AddGroup(id string, share groupShare) error {
+	duplicate := false
+	_, err := r.modify(id, anyVersion, func(listRec *list) bool {
+		if listRec.groupShare(share.GroupId) != nil {
+			duplicate = true
+			return false
+		}
+		listRec.Groups = append(listRec.Groups, share)
+		return true
+	})
+	if duplicate {
+		return errDuplicate
+	}
+	if err == errVersionMismatch {
+		return errNotFound
+	}
+	return err
+}
+
+func (r *memoryLists) RemoveGroup(id, groupId string) error {
+	_, err := r.modify(id, anyVersion, func(listRec *list) bool {
+		groups := make([]groupShare, 0, len(listRec.Groups))
+		for _, share := range listRec.Groups {
+			if share.GroupId != groupId {
+				groups = append(groups, share)
+			}
+		}
+		if len(groups) == len(listRec.Groups) {
+			return false
+		}
+		listRec.Groups = groups
+		return true
+	})
+	if err == errVersionMismatch {
+		return errNotFound
+	}
+	return err
+}
+
+func (r *memoryLists) ByGroup(groupId string) ([]list, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	lists := make([]list, 0, 1)
+	for _, listRec := range r.lists {
+		if listRec.groupShare(groupId) != nil && listRec.Deleted == nil {
+			lists = append(lists, copyList(listRec))
+		}
+	}
+	sort.Slice(lists, func(i, j int) bool { return lists[i].Id < lists[j].Id })
+	return lists, nil
+}
+
+func (r *memoryLists) ChangedSince(ids []string, since time.Time) ([]list, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	lists := make([]list, 0, 1)
+	for _, id := range ids {
+		listRec, ok := r.lists[id]
+		if ok && listRec.Deleted == nil && listRec.LastChanged.After(since) {
+			lists = append(lists, copyList(listRec))
+		}
+	}
+	return lists, nil
+}
+
+func (r *memoryLists) All() ([]list, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	lists := make([]list, 0, len(r.lists))
+	for _, listRec := range r.lists {
+		if listRec.Deleted == nil {
+			lists = append(lists, copyList(listRec))
+		}
+	}
+	return lists, nil
+}
+
+func (r *memoryLists) Trash(id string, deleted time.Time, version int64) (int64, error) {
+	return r.modify(id, version, func(listRec *list) bool {
+		listRec.Deleted = &deleted
+		return true
+	})
+}
+
+func (r *memoryLists) Restore(id string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	listRec, ok := r.lists[id]
+	if !ok || listRec.Deleted == nil {
+		return 0, errNotFound
+	}
+	listRec.Deleted = nil
+	listRec.LastChanged = time.Now()
+	listRec.Version++
+	r.lists[id] = listRec
+	return listRec.Version, nil
+}
+
+// trashed returns copies of lists in the trash matching the filter, the most recently deleted first
+func (r *memoryLists) trashed(filter func(listRec *list) bool) []list {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	lists := make([]list, 0)
+	for _, listRec := range r.lists {
+		if listRec.Deleted != nil && filter(&listRec) {
+			lists = append(lists, copyList(listRec))
+		}
+	}
+	sort.Slice(lists, func(i, j int) bool { return lists[i].Deleted.After(*lists[j].Deleted) })
+	return lists
+}
+
+func (r *memoryLists) Trashed(owner string) ([]list, error) {
+	return r.trashed(func(listRec *list) bool {
+		return listRec.Owner == owner
+	}), nil
+}
+
+func (r *memoryLists) TrashedBefore(before time.Time) ([]list, error) {
+	return r.trashed(func(listRec *list) bool {
+		return listRec.Deleted.Before(before)
+	}), nil
+}
+
+func (r *memoryAccess) Get(username string) (*accessRecord, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	record, ok := r.records[username]
+	if !ok {
+		return nil, errNotFound
+	}
+	record = copyAccessRecord(record)
+	return &record, nil
+}
+
+func (r *memoryAccess) Insert(record accessRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.records[record.Username]; ok {
+		return errDuplicate
+	}
+	r.records[record.Username] = copyAccessRecord(record)
+	return nil
+}
+
+func (r *memoryAccess) modify(username string, change func(record *accessRecord)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	record, ok := r.records[username]
+	if !ok {
+		return errNotFound
+	}
+	record = copyAccessRecord(record)
+	change(&record)
+	r.records[username] = record
+	return nil
+}
+
+func withoutLink(links []listLink, id string) []listLink {
+	filtered := links[:0]
+	for _, link := range links {
+		if link.Id != id {
+			filtered = append(filtered, link)
+		}
+	}
+	return filtered
+}
+
+// addLink adds the link unless the user has a link to the list already
+func (r *memoryAccess) addLink(username string, link listLink, owned bool) error {
+	duplicate := false
+	err := r.modify(username, func(record *accessRecord) {
+		if findLink(record.OwnedLists, link.Id) != nil || findLink(record.SharedLists, link.Id) != nil {
+			duplicate = true
+		} else if owned {
+			record.OwnedLists = append(record.OwnedLists, link)
+		} else {
+			record.SharedLists = append(record.SharedLists, link)
+		}
+	})
+	if err == nil && duplicate {
+		return errDuplicate
+	}
+	return err
+}
+
+func (r *memoryAccess) AddOwned(username string, link listLink) error {
+	return r.addLink(username, link, true)
+}
+
+func (r *memoryAccess) AddShared(username string, link listLink) error {
+	return r.addLink(username, link, false)
+}
+
+func (r *memoryAccess) RemoveOwned(username, id string) error {
+	return r.modify(username, func(record *accessRecord) {
+		record.OwnedLists = withoutLink(record.OwnedLists, id)
+	})
+}
+
+func (r *memoryAccess) RemoveShared(username, id string) error {
+	return r.modify(username, func(record *accessRecord) {
+		record.SharedLists = withoutLink(record.SharedLists, id)
+	})
+}
+
+func (r *memoryAccess) SetDisplayName(username, id, name string) error {
+	return r.modify(username, func(record *accessRecord) {
+		for _, links := range [][]listLink{record.OwnedLists, record.SharedLists} {
+			for i := range links {
+				if links[i].Id == id && !links[i].Aliased {
+					links[i].DisplayName = name
+				}
+			}
+		}
+	})
+}
+
+func (r *memoryAccess) SetAlias(username, id, name string, aliased bool) error {
+	found := false
+	err := r.modify(username, func(record *accessRecord) {
+		for _, links := range [][]listLink{record.OwnedLists, record.SharedLists} {
+			for i := range links {
+				if links[i].Id == id {
+					links[i].DisplayName = name
+					links[i].Aliased = aliased
+					found = true
+				}
+			}
+		}
+	})
+	if err == nil && !found {
+		return errNotFound
+	}
+	return err
+}
+
+func (r *memoryAccess) All() ([]accessRecord, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	records := make([]accessRecord, 0, len(r.records))
+	for _, record := range r.records {
+		records = append(records, copyAccessRecord(record))
+	}
+	return records, nil
+}
+
+func (r *memoryRequests) Insert(req shareRequest) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.requests {
+		if existing.Id == req.Id || (existing.ListId == req.ListId && existing.Guest == req.Guest) {
+			return errDuplicate
+		}
+	}
+	r.requests = append(r.requests, req)
+	return nil
+}
+
+func (r *memoryRequests) Get(id string) (*shareRequest, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, req := range r.requests {
+		if req.Id == id {
+			return &req, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (r *memoryRequests) find(match func(req shareRequest) bool) []shareRequest {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	requests := make([]shareRequest, 0, 1)
+	for _, req := range r.requests {
+		if match(req) {
+			requests = append(requests, req)
+		}
+	}
+	return requests
+}
+
+func (r *memoryRequests) ByGuest(guest string) ([]shareRequest, error) {
+	return r.find(func(req shareRequest) bool { return req.Guest == guest }), nil
+}
+
+func (r *memoryRequests) ByOwner(owner string) ([]shareRequest, error) {
+	return r.find(func(req shareRequest) bool { return req.Owner == owner }), nil
+}
+
+// remove deletes requests matched by match and returns how many were deleted
+func (r *memoryRequests) remove(match func(req shareRequest) bool) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	kept := r.requests[:0]
+	for _, req := range r.requests {
+		if !match(req) {
+			kept = append(kept, req)
+		}
+	}
+	removed := len(r.requests) - len(kept)
+	r.requests = kept
+	return removed
+}
+
+func (r *memoryRequests) Remove(id string) error {
+	if r.remove(func(req shareRequest) bool { return req.Id == id }) != 1 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (r *memoryRequests) RemoveForList(listId string) error {
+	r.remove(func(req shareRequest) bool { return req.ListId == listId })
+	return nil
+}
+
+func (r *memoryNotifications) Insert(n notification) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.notifications = append(r.notifications, n)
+	return nil
+}
+
+func (r *memoryNotifications) matching(username string, unreadOnly bool) []notification {
+	notifications := make([]notification, 0, 1)
+	for _, n := range r.notifications {
+		if n.Username == username && !(unreadOnly && n.Read) {
+			notifications = append(notifications, n)
+		}
+	}
+	return notifications
+}
+
+func (r *memoryNotifications) Find(username string, unreadOnly bool, offset, limit int64) ([]notification, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	notifications := r.matching(username, unreadOnly)
+	sort.SliceStable(notifications, func(i, j int) bool {
+		return notifications[i].Created.After(notifications[j].Created)
+	})
+	if offset >= int64(len(notifications)) {
+		return notifications[:0], nil
+	}
+	notifications = notifications[offset:]
+	if limit > 0 && limit < int64(len(notifications)) {
+		notifications = notifications[:limit]
+	}
+	return notifications, nil
+}
+
+func (r *memoryNotifications) Count(username string, unreadOnly bool) (int64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return int64(len(r.matching(username, unreadOnly))), nil
+}
+
+func (r *memoryNotifications) MarkRead(username, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	matched := 0
+	for i := range r.notifications {
+		n := &r.notifications[i]
+		if n.Username == username && (id == "" || n.Id == id) {
+			n.Read = true
+			matched++
+		}
+	}
+	if id != "" && matched != 1 {
+		return errNotificationNotFound
+	}
+	return nil
+}
+
+func (r *memoryNotifications) Remove(username, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, n := range r.notifications {
+		if n.Username == username && n.Id == id {
+			r.notifications = append(r.notifications[:i], r.notifications[i+1:]...)
+			return nil
+		}
+	}
+	return errNotificationNotFound
+}
+
+func (r *memoryTombstones) Insert(id string, usernames []string, removed time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Expired tombstones are dropped here instead of by a TTL index
+	expiry := time.Now().Add(-tombstoneRetention)
+	kept := r.tombstones[:0]
+	for _, t := range r.tombstones {
+		if t.Removed.After(expiry) {
+			kept = append(kept, t)
+		}
+	}
+	r.tombstones = kept
+	for _, username := range usernames {
+		r.tombstones = append(r.tombstones, tombstone{ListId: id, Username: username, Removed: removed})
+	}
+	return nil
+}
+
+func (r *memoryTombstones) Since(username string, since time.Time) ([]tombstone, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	tombstones := make([]tombstone, 0, 1)
+	for _, t := range r.tombstones {
+		if t.Username == username && t.Removed.After(since) {
+			tombstones = append(tombstones, t)
+		}
+	}
+	return tombstones, nil
+}
+
+func (r *memoryInvites) Insert(inv invite) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.invites {
+		if existing.Id == inv.Id || existing.Token == inv.Token {
+			return errDuplicate
+		}
+	}
+	r.invites = append(r.invites, inv)
+	return nil
+}
+
+func (r *memoryInvites) Get(token string) (*invite, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, inv := range r.invites {
+		if inv.Token == token {
+			return &inv, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (r *memoryInvites) ByList(listId string) ([]invite, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	invites := make([]invite, 0, 1)
+	for _, inv := range r.invites {
+		if inv.ListId == listId {
+			invites = append(invites, inv)
+		}
+	}
+	return invites, nil
+}
+
+func (r *memoryInvites) Use(token string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.invites {
+		inv := &r.invites[i]
+		if inv.Token == token && (inv.MaxUses == 0 || inv.Uses < inv.MaxUses) {
+			inv.Uses++
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+func (r *memoryInvites) Release(token string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.invites {
+		inv := &r.invites[i]
+		if inv.Token == token && inv.Uses > 0 {
+			inv.Uses--
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+// remove deletes invites matched by match and returns how many were deleted
+func (r *memoryInvites) remove(match func(inv invite) bool) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	kept := r.invites[:0]
+	for _, inv := range r.invites {
+		if !match(inv) {
+			kept = append(kept, inv)
+		}
+	}
+	removed := len(r.invites) - len(kept)
+	r.invites = kept
+	return removed
+}
+
+func (r *memoryInvites) Remove(listId, id string) error {
+	if r.remove(func(inv invite) bool { return inv.ListId == listId && inv.Id == id }) != 1 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (r *memoryInvites) RemoveForList(listId string) error {
+	r.remove(func(inv invite) bool { return inv.ListId == listId })
+	return nil
+}
+
+func copyGroup(g group) group {
+	g.Members = append(make([]groupMember, 0, len(g.Members)), g.Members...)
+	return g
+}
+
+func (r *memoryGroups) Insert(g group) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.groups[g.Id]; ok {
+		return errDuplicate
+	}
+	r.groups[g.Id] = copyGroup(g)
+	return nil
+}
+
+func (r *memoryGroups) Get(id string) (*group, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	g, ok := r.groups[id]
+	if !ok {
+		return nil, errNotFound
+	}
+	g = copyGroup(g)
+	return &g, nil
+}
+
+func (r *memoryGroups) ByMember(username string) ([]group, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	groups := make([]group, 0, 1)
+	for _, g := range r.groups {
+		if g.member(username) != nil {
+			groups = append(groups, copyGroup(g))
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Id < groups[j].Id })
+	return groups, nil
+}
+
+// modify applies change to a copy of the group and stores it, change returns false if the group doesn't match
+func (r *memoryGroups) modify(id string, change func(g *group) bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	g, ok := r.groups[id]
+	if !ok {
+		return errNotFound
+	}
+	g = copyGroup(g)
+	if !change(&g) {
+		return errNotFound
+	}
+	r.groups[id] = g
+	return nil
+}
+
+func (r *memoryGroups) AddMember(id string, member groupMember) error {
+	duplicate := false
+	err := r.modify(id, func(g *group) bool {
+		if g.member(member.Username) != nil {
+			duplicate = true
+			return false
+		}
+		g.Members = append(g.Members, member)
+		return true
+	})
+	if duplicate {
+		return errDuplicate
+	}
+	return err
+}
+
+func (r *memoryGroups) RemoveMember(id, username string) error {
+	return r.modify(id, func(g *group) bool {
+		members := make([]groupMember, 0, len(g.Members))
+		for _, member := range g.Members {
+			if member.Username != username {
+				members = append(members, member)
+			}
+		}
+		if len(members) == len(g.Members) {
+			return false
+		}
+		g.Members = members
+		return true
+	})
+}
+
+func (r *memoryGroups) SetMemberRole(id, username, role string) error {
+	return r.modify(id, func(g *group) bool {
+		member := g.member(username)
+		if member == nil {
+			return false
+		}
+		member.Role = role
+		return true
+	})
+}
+
+func (r *memoryGroups) Remove(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.groups[id]; !ok {
+		return errNotFound
+	}
+	delete(r.groups, id)
+	return nil
+}
+
+func copyRevision(rev revision) revision {
+	rev.Items = append(make([]item, 0, len(rev.Items)), rev.Items...)
+	return rev
+}
+
+// Insert keeps revisions of each list newest first
+func (r *memoryRevisions) Insert(rev revision, keep int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	revisions := r.revisions[rev.ListId]
+	for _, existing := range revisions {
+		if existing.Version == rev.Version {
+			return errDuplicate
+		}
+	}
+	revisions = append(revisions, copyRevision(rev))
+	sort.Slice(revisions, func(i, j int) bool { return revisions[i].Version > revisions[j].Version })
+	if len(revisions) > keep {
+		revisions = revisions[:keep]
+	}
+	r.revisions[rev.ListId] = revisions
+	return nil
+}
+
+func (r *memoryRevisions) Get(listId string, version int64) (*revision, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, rev := range r.revisions[listId] {
+		if rev.Version == version {
+			rev = copyRevision(rev)
+			return &rev, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (r *memoryRevisions) ByList(listId string) ([]revision, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	revisions := make([]revision, 0, len(r.revisions[listId]))
+	for _, rev := range r.revisions[listId] {
+		revisions = append(revisions, copyRevision(rev))
+	}
+	return revisions, nil
+}
+
+func (r *memoryRevisions) RemoveForList(listId string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.revisions, listId)
+	return nil
+}
+
+func (r *memoryItemOps) Insert(listId string, ops []itemOp, keep int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	logged := r.ops[listId]
+	seen := make(map[stamp]bool, len(logged))
+	for i := range logged {
+		seen[logged[i].stamp()] = true
+	}
+	for _, op := range ops {
+		if !seen[op.stamp()] {
+			seen[op.stamp()] = true
+			logged = append(logged, op)
+		}
+	}
+	sort.Slice(logged, func(i, j int) bool { return logged[j].stamp().after(logged[i].stamp()) })
+	if len(logged) > keep {
+		logged = logged[len(logged)-keep:]
+	}
+	r.ops[listId] = logged
+	return nil
+}
+
+func (r *memoryItemOps) Since(listId string, since int64) ([]itemOp, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ops := make([]itemOp, 0)
+	for _, op := range r.ops[listId] {
+		if op.Clock > since {
+			ops = append(ops, op)
+		}
+	}
+	return ops, nil
+}
+
+func (r *memoryItemOps) RemoveForList(listId string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.ops, listId)
+	return nil
+}
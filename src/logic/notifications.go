@@ -0,0 +1,99 @@
+package logic
+
+import (
+	"errors"
+	"github.com/segmentio/ksuid"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const (
+	notificationListShared        = "list_shared"
+	notificationListDeleted       = "list_deleted"
+	notificationListEdited        = "list_edited"
+	notificationRequestAccepted   = "request_accepted"
+	notificationAccessRevoked     = "access_revoked"
+	notificationGuestLeft         = "guest_left"
+	notificationRoleChanged       = "role_changed"
+	notificationTransferRequested = "transfer_requested"
+	notificationInviteUsed        = "invite_used"
+	notificationOwnerChanged      = "owner_changed"
+	notificationListRenamed       = "list_renamed"
+	notificationListReverted      = "list_reverted"
+	notificationListRestored      = "list_restored"
+)
+
+const (
+	defaultNotificationLimit = 50
+	maxNotificationLimit     = 100
+)
+
+var errNotificationNotFound = errors.New("notification not found")
+
+type notification struct {
+	Id       string    `bson:"id" json:"id"`
+	Username string    `bson:"username" json:"-"`
+	Type     string    `bson:"type" json:"type"`
+	ListId   string    `bson:"list_id" json:"list_id"`
+	ListName string    `bson:"list_name" json:"list_name"`
+	Actor    string    `bson:"actor" json:"actor"`
+	Created  time.Time `bson:"created" json:"created"`
+	Read     bool      `bson:"read" json:"read"`
+}
+
+type notificationPage struct {
+	Total         int64          `json:"total"`
+	Unread        int64          `json:"unread"`
+	Notifications []notification `json:"notifications"`
+}
+
+// notify stores a notification for every recipient except the actor.
+// Notifications are best effort, so failures are only logged.
+func (s *Service) notify(recipients []string, kind, actor, listId, listName string) {
+	for _, recipient := range recipients {
+		if recipient == actor {
+			continue
+		}
+		err := s.notifications.Insert(notification{
+			Id:       ksuid.New().String(),
+			Username: recipient,
+			Type:     kind,
+			ListId:   listId,
+			ListName: listName,
+			Actor:    actor,
+			Created:  time.Now(),
+		})
+		if err != nil {
+			log.Error("Failed to notify ", recipient, " about ", kind, " of ", listId, ": ", err)
+		}
+	}
+}
+
+func (s *Service) listNotifications(username string, unreadOnly bool, offset, limit int64) (*notificationPage, error) {
+	if limit <= 0 {
+		limit = defaultNotificationLimit
+	}
+	if limit > maxNotificationLimit {
+		limit = maxNotificationLimit
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	notifications, err := s.notifications.Find(username, unreadOnly, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	total, err := s.notifications.Count(username, unreadOnly)
+	if err != nil {
+		return nil, err
+	}
+	unread, err := s.notifications.Count(username, true)
+	if err != nil {
+		return nil, err
+	}
+	return &notificationPage{
+		Total:         total,
+		Unread:        unread,
+		Notifications: notifications,
+	}, nil
+}
@@ -0,0 +1,470 @@
+package logic
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kinds of operations on items
+const (
+	opAdd    = "add"
+	opSet    = "set"
+	opRemove = "remove"
+)
+
+// maxOps is how many of the latest operations are kept per list.
+// Operations older than the kept ones can't be merged correctly anymore, so clients should not stay offline for that long.
+const maxOps = 1000
+
+// mergeAttempts is how many times merging is retried when the list is modified concurrently
+const mergeAttempts = 5
+
+var (
+	errInvalidOp = errors.New("invalid operation")
+	// errMergeContended is returned when the list has changed during every merge attempt, sending the operations again is safe
+	errMergeContended = errors.New("list is changed concurrently, send the operations again")
+)
+
+// stamp orders operations: Lamport clocks of clients, the client id breaks ties between equal clocks
+type stamp struct {
+	Clock    int64  `bson:"clock" json:"clock"`
+	ClientId string `bson:"client_id" json:"client_id"`
+}
+
+func (st stamp) after(other stamp) bool {
+	if st.Clock != other.Clock {
+		return st.Clock > other.Clock
+	}
+	return st.ClientId > other.ClientId
+}
+
+// serverClient is the client id in stamps of direct writes, which are not made by operations.
+// Operations must have a client id, so they win ties with direct writes.
+const serverClient = ""
+
+// itemStamps hold the stamp of the latest operation which has added the item and which has set each of its fields
+type itemStamps struct {
+	Added    stamp `bson:"added" json:"added"`
+	Name     stamp `bson:"name" json:"name"`
+	Quantity stamp `bson:"quantity" json:"quantity"`
+	Unit     stamp `bson:"unit" json:"unit"`
+	Checked  stamp `bson:"checked" json:"checked"`
+	Note     stamp `bson:"note" json:"note"`
+	Position stamp `bson:"position" json:"position"`
+}
+
+// stampAll stamps the item as if an operation with st had added it
+func (stamps *itemStamps) stampAll(st stamp) {
+	*stamps = itemStamps{Added: st, Name: st, Quantity: st, Unit: st, Checked: st, Note: st, Position: st}
+}
+
+// stampChanges stamps the fields set by changes
+func (stamps *itemStamps) stampChanges(changes itemChanges, st stamp) {
+	if changes.Name != nil {
+		stamps.Name = st
+	}
+	if changes.Quantity != nil {
+		stamps.Quantity = st
+	}
+	if changes.Unit != nil {
+		stamps.Unit = st
+	}
+	if changes.Checked != nil {
+		stamps.Checked = st
+	}
+	if changes.Note != nil {
+		stamps.Note = st
+	}
+}
+
+func (stamps *itemStamps) latestClock() int64 {
+	var clock int64
+	for _, st := range []stamp{stamps.Added, stamps.Name, stamps.Quantity, stamps.Unit, stamps.Checked, stamps.Note, stamps.Position} {
+		if st.Clock > clock {
+			clock = st.Clock
+		}
+	}
+	return clock
+}
+
+// itemOp is an operation on an item made by a client, possibly while it was offline.
+// Clients keep a Lamport clock: every operation gets a clock greater than that of any operation
+// the client has made or seen, including the clock returned by the server.
+// The id of a new item is chosen by the client, so later operations of the client can refer to it.
+type itemOp struct {
+	ListId   string `bson:"list_id" json:"-"`
+	ClientId string `bson:"client_id" json:"client_id"`
+	Clock    int64  `bson:"clock" json:"clock"`
+	Kind     string `bson:"kind" json:"kind"`
+	ItemId   string `bson:"item_id" json:"item_id"`
+	// Fields are set by add and set operations, an added item has defaults for the omitted ones
+	Fields   opFields  `bson:"fields" json:"fields"`
+	Author   string    `bson:"author" json:"author"`
+	Received time.Time `bson:"received" json:"received"`
+}
+
+type opFields struct {
+	Name     *string  `bson:"name,omitempty" json:"name,omitempty"`
+	Quantity *float64 `bson:"quantity,omitempty" json:"quantity,omitempty"`
+	Unit     *string  `bson:"unit,omitempty" json:"unit,omitempty"`
+	Checked  *bool    `bson:"checked,omitempty" json:"checked,omitempty"`
+	Note     *string  `bson:"note,omitempty" json:"note,omitempty"`
+	Position *int     `bson:"position,omitempty" json:"position,omitempty"`
+}
+
+func (op *itemOp) stamp() stamp {
+	return stamp{Clock: op.Clock, ClientId: op.ClientId}
+}
+
+type mergeResp struct {
+	// Clock is the greatest clock of merged operations and direct writes, clients continue their clocks from it
+	Clock int64 `json:"clock"`
+	List  *list `json:"list"`
+}
+
+type opsResp struct {
+	Clock int64    `json:"clock"`
+	Ops   []itemOp `json:"ops"`
+}
+
+func validateOp(op *itemOp) error {
+	if op.ClientId == "" || op.Clock <= 0 || op.ItemId == "" {
+		return errInvalidOp
+	}
+	switch op.Kind {
+	case opAdd:
+		if op.Fields.Name == nil {
+			return errEmptyItemName
+		}
+	case opSet, opRemove:
+	default:
+		return errInvalidOp
+	}
+	if op.Fields.Name != nil {
+		name := strings.TrimSpace(*op.Fields.Name)
+		if name == "" {
+			return errEmptyItemName
+		}
+		op.Fields.Name = &name
+	}
+	return nil
+}
+
+// mergeOps merges operations of a client into the list. Operations are merged field by field,
+// the operation with the latest stamp wins, so the list ends up the same whatever order operations arrive in.
+// An item stays removed unless it is added again by a later operation, changes of removed items are dropped.
+// Operations which have been merged already are skipped, so clients can safely send them again.
+func (s *Service) mergeOps(username, id string, ops []itemOp) (*mergeResp, error) {
+	now := time.Now()
+	stamps := make(map[stamp]bool, len(ops))
+	for i := range ops {
+		if err := validateOp(&ops[i]); err != nil {
+			return nil, err
+		}
+		// A client never uses a clock twice
+		if stamps[ops[i].stamp()] {
+			return nil, errInvalidOp
+		}
+		stamps[ops[i].stamp()] = true
+		ops[i].ListId = id
+		ops[i].Author = username
+		ops[i].Received = now
+	}
+	for attempt := 1; ; attempt++ {
+		listRec, err := s.loadList(id)
+		if err != nil {
+			return nil, err
+		}
+		logged, err := s.itemOps.Since(id, 0)
+		if err != nil {
+			return nil, err
+		}
+		fresh := unseenOps(logged, ops)
+		all := append(logged, fresh...)
+		items, changed := mergeItems(listRec.Items, fresh, all)
+		newVersion := listRec.Version
+		if changed {
+			// Merging is computed from the loaded list, so it is repeated if the list has changed meanwhile
+			newVersion, err = s.lists.SetItems(id, items, listRec.Version)
+			if err == errVersionMismatch {
+				if attempt < mergeAttempts {
+					continue
+				}
+				// The client has not sent a version, so a mismatch is not a failed precondition
+				return nil, errMergeContended
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(fresh) > 0 {
+			// Operations are merged already, sending them again is harmless if they are not logged
+			if err = s.itemOps.Insert(id, fresh, maxOps); err != nil {
+				log.Error("Failed to log operations on ", id, ": ", err)
+			}
+		}
+		if changed {
+			s.listEdited(username, listRec, newVersion)
+		}
+		merged, err := s.loadList(id)
+		if err != nil {
+			return nil, err
+		}
+		return &mergeResp{Clock: listClock(merged.Items, all), List: merged}, nil
+	}
+}
+
+// serverStamp returns the stamp of a direct write of the list. It is after every logged operation and every stamp
+// of the items, so operations made before the write can't override it.
+func (s *Service) serverStamp(listRec *list) (stamp, error) {
+	logged, err := s.itemOps.Since(listRec.Id, 0)
+	if err != nil {
+		return stamp{}, err
+	}
+	return stamp{Clock: listClock(listRec.Items, logged) + 1, ClientId: serverClient}, nil
+}
+
+// stampItems stamps the fields of items which differ from the previous item with the same id, new items are stamped entirely
+func stampItems(items, previous []item, st stamp) {
+	byId := make(map[string]*item, len(previous))
+	for i := range previous {
+		byId[previous[i].Id] = &previous[i]
+	}
+	for i := range items {
+		it := &items[i]
+		before, ok := byId[it.Id]
+		if !ok {
+			it.Stamps.stampAll(st)
+			continue
+		}
+		if it.Name != before.Name {
+			it.Stamps.Name = st
+		}
+		if it.Quantity != before.Quantity {
+			it.Stamps.Quantity = st
+		}
+		if it.Unit != before.Unit {
+			it.Stamps.Unit = st
+		}
+		if it.Checked != before.Checked {
+			it.Stamps.Checked = st
+		}
+		if it.Note != before.Note {
+			it.Stamps.Note = st
+		}
+		if it.Position != before.Position {
+			it.Stamps.Position = st
+		}
+	}
+}
+
+// unseenOps returns operations not among logged ones, without duplicates, in the order of their stamps
+func unseenOps(logged, ops []itemOp) []itemOp {
+	seen := make(map[stamp]bool, len(logged)+len(ops))
+	for i := range logged {
+		seen[logged[i].stamp()] = true
+	}
+	fresh := make([]itemOp, 0, len(ops))
+	for i := range ops {
+		if !seen[ops[i].stamp()] {
+			seen[ops[i].stamp()] = true
+			fresh = append(fresh, ops[i])
+		}
+	}
+	sort.Slice(fresh, func(i, j int) bool { return fresh[j].stamp().after(fresh[i].stamp()) })
+	return fresh
+}
+
+// removals returns the stamp of the latest removal of each removed item
+func removals(ops []itemOp) map[string]stamp {
+	removed := make(map[string]stamp)
+	for i := range ops {
+		st := ops[i].stamp()
+		if ops[i].Kind == opRemove && st.after(removed[ops[i].ItemId]) {
+			removed[ops[i].ItemId] = st
+		}
+	}
+	return removed
+}
+
+func latestClock(ops []itemOp) int64 {
+	var clock int64
+	for i := range ops {
+		if ops[i].Clock > clock {
+			clock = ops[i].Clock
+		}
+	}
+	return clock
+}
+
+// listClock returns the greatest clock of the operations and of the stamps of the items, which include direct writes
+func listClock(items []item, ops []itemOp) int64 {
+	clock := latestClock(ops)
+	for i := range items {
+		if itemClock := items[i].Stamps.latestClock(); itemClock > clock {
+			clock = itemClock
+		}
+	}
+	return clock
+}
+
+// mergeItems applies fresh operations in the order of their stamps to a copy of items and reports whether anything has changed.
+// All are the operations merged so far including fresh ones, set operations on an item which arrived before it was added
+// are applied when it is added, so the result doesn't depend on the order operations arrive in.
+// Items are sorted by position and id, so concurrently added items with the same position are in the same order everywhere.
+func mergeItems(items []item, ops []itemOp, all []itemOp) ([]item, bool) {
+	removed := removals(all)
+	merged := append(make([]item, 0, len(items)+len(ops)), items...)
+	changed := false
+	for i := range ops {
+		op := &ops[i]
+		st := op.stamp()
+		index := -1
+		for j := range merged {
+			if merged[j].Id == op.ItemId {
+				index = j
+				break
+			}
+		}
+		switch {
+		case op.Kind == opAdd && index < 0:
+			if latest, ok := removed[op.ItemId]; ok && latest.after(st) {
+				continue
+			}
+			added := addedItem(op)
+			for j := range all {
+				if all[j].Kind == opSet && all[j].ItemId == op.ItemId {
+					applyOpFields(&added, all[j].Fields, all[j].stamp())
+				}
+			}
+			merged = append(merged, added)
+			changed = true
+		case op.Kind == opAdd || op.Kind == opSet:
+			// A set operation on an item which is not added yet is applied when the item is added
+			if index < 0 {
+				continue
+			}
+			fields := op.Fields
+			if op.Kind == opAdd {
+				// Adding the item again sets the omitted fields to their defaults, as if it was added first
+				fields = addFields(op)
+				if st.after(merged[index].Stamps.Added) {
+					merged[index].Stamps.Added = st
+					changed = true
+				}
+			}
+			if applyOpFields(&merged[index], fields, st) {
+				changed = true
+			}
+		case op.Kind == opRemove:
+			// An item added again after the removal stays
+			if index < 0 || !st.after(merged[index].Stamps.Added) {
+				continue
+			}
+			merged = append(merged[:index], merged[index+1:]...)
+			changed = true
+		}
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		if merged[i].Position != merged[j].Position {
+			return merged[i].Position < merged[j].Position
+		}
+		return merged[i].Id < merged[j].Id
+	})
+	return merged, changed
+}
+
+// addedItem creates the item added by the operation, all of its fields are stamped by it
+func addedItem(op *itemOp) item {
+	it := item{Id: op.ItemId}
+	it.Stamps.stampAll(op.stamp())
+	setOpFields(&it, op.Fields)
+	return it
+}
+
+// addFields returns all fields set by the add operation, including the defaults of the omitted ones
+func addFields(op *itemOp) opFields {
+	it := addedItem(op)
+	return opFields{
+		Name:     &it.Name,
+		Quantity: &it.Quantity,
+		Unit:     &it.Unit,
+		Checked:  &it.Checked,
+		Note:     &it.Note,
+		Position: &it.Position,
+	}
+}
+
+func setOpFields(it *item, fields opFields) {
+	if fields.Name != nil {
+		it.Name = *fields.Name
+	}
+	if fields.Quantity != nil {
+		it.Quantity = *fields.Quantity
+	}
+	if fields.Unit != nil {
+		it.Unit = *fields.Unit
+	}
+	if fields.Checked != nil {
+		it.Checked = *fields.Checked
+	}
+	if fields.Note != nil {
+		it.Note = *fields.Note
+	}
+	if fields.Position != nil {
+		it.Position = *fields.Position
+	}
+}
+
+// applyOpFields sets the fields which were last set before st, and reports whether the item or its stamps have changed
+func applyOpFields(it *item, fields opFields, st stamp) bool {
+	before := *it
+	newer := opFields{}
+	if fields.Name != nil && st.after(it.Stamps.Name) {
+		newer.Name = fields.Name
+		it.Stamps.Name = st
+	}
+	if fields.Quantity != nil && st.after(it.Stamps.Quantity) {
+		newer.Quantity = fields.Quantity
+		it.Stamps.Quantity = st
+	}
+	if fields.Unit != nil && st.after(it.Stamps.Unit) {
+		newer.Unit = fields.Unit
+		it.Stamps.Unit = st
+	}
+	if fields.Checked != nil && st.after(it.Stamps.Checked) {
+		newer.Checked = fields.Checked
+		it.Stamps.Checked = st
+	}
+	if fields.Note != nil && st.after(it.Stamps.Note) {
+		newer.Note = fields.Note
+		it.Stamps.Note = st
+	}
+	if fields.Position != nil && st.after(it.Stamps.Position) {
+		newer.Position = fields.Position
+		it.Stamps.Position = st
+	}
+	setOpFields(it, newer)
+	return *it != before
+}
+
+// listOps returns logged operations on the list with a clock greater than since, in the order of their stamps.
+// The clock covers direct writes too, so operations clients make afterwards come after them.
+func (s *Service) listOps(id string, since int64) (*opsResp, error) {
+	listRec, err := s.lists.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	ops, err := s.itemOps.Since(id, since)
+	if err != nil {
+		return nil, err
+	}
+	clock := listClock(listRec.Items, ops)
+	if clock < since {
+		clock = since
+	}
+	return &opsResp{Clock: clock, Ops: ops}, nil
+}
@@ -0,0 +1,228 @@
+package logic
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func stringField(value string) *string {
+	return &value
+}
+
+func floatField(value float64) *float64 {
+	return &value
+}
+
+func boolField(value bool) *bool {
+	return &value
+}
+
+func intField(value int) *int {
+	return &value
+}
+
+// arrive merges operations one by one in the order, as the server does when each of them comes in its own request
+func arrive(ops []itemOp, order []int) []item {
+	items := make([]item, 0)
+	logged := make([]itemOp, 0)
+	for _, i := range order {
+		fresh := unseenOps(logged, ops[i:i+1])
+		all := append(logged, fresh...)
+		items, _ = mergeItems(items, fresh, all)
+		logged = all
+	}
+	return items
+}
+
+// permutations returns every order of n operations
+func permutations(n int) [][]int {
+	if n == 0 {
+		return [][]int{{}}
+	}
+	orders := make([][]int, 0)
+	for _, shorter := range permutations(n - 1) {
+		for at := 0; at <= len(shorter); at++ {
+			order := append(append(append(make([]int, 0, n), shorter[:at]...), n-1), shorter[at:]...)
+			orders = append(orders, order)
+		}
+	}
+	return orders
+}
+
+func TestMergeItemsDoesNotDependOnArrivalOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  []itemOp
+		want []item
+	}{
+		{
+			name: "changes arrive before the item is added",
+			ops: []itemOp{
+				{ClientId: "a", Clock: 1, Kind: opAdd, ItemId: "milk", Fields: opFields{Name: stringField("Milk")}},
+				{ClientId: "b", Clock: 2, Kind: opSet, ItemId: "milk", Fields: opFields{Checked: boolField(true)}},
+				{ClientId: "a", Clock: 3, Kind: opSet, ItemId: "milk", Fields: opFields{Quantity: floatField(2)}},
+				{ClientId: "c", Clock: 3, Kind: opSet, ItemId: "milk", Fields: opFields{Quantity: floatField(3)}},
+			},
+			want: []item{{Id: "milk", Name: "Milk", Quantity: 3, Checked: true}},
+		},
+		{
+			name: "item is removed and added again",
+			ops: []itemOp{
+				{ClientId: "a", Clock: 1, Kind: opAdd, ItemId: "milk", Fields: opFields{Name: stringField("Milk")}},
+				{ClientId: "b", Clock: 2, Kind: opSet, ItemId: "milk", Fields: opFields{Note: stringField("skimmed")}},
+				{ClientId: "b", Clock: 3, Kind: opRemove, ItemId: "milk"},
+				{ClientId: "c", Clock: 4, Kind: opAdd, ItemId: "milk", Fields: opFields{Name: stringField("Oat milk")}},
+				{ClientId: "a", Clock: 5, Kind: opSet, ItemId: "milk", Fields: opFields{Checked: boolField(true)}},
+			},
+			want: []item{{Id: "milk", Name: "Oat milk", Checked: true}},
+		},
+		{
+			name: "item is removed after its last change",
+			ops: []itemOp{
+				{ClientId: "a", Clock: 1, Kind: opAdd, ItemId: "bread", Fields: opFields{Name: stringField("Bread")}},
+				{ClientId: "b", Clock: 2, Kind: opSet, ItemId: "bread", Fields: opFields{Unit: stringField("loaf")}},
+				{ClientId: "a", Clock: 3, Kind: opRemove, ItemId: "bread"},
+				{ClientId: "b", Clock: 4, Kind: opAdd, ItemId: "eggs", Fields: opFields{Name: stringField("Eggs"), Position: intField(1)}},
+			},
+			want: []item{{Id: "eggs", Name: "Eggs", Position: 1}},
+		},
+		{
+			name: "items are moved concurrently",
+			ops: []itemOp{
+				{ClientId: "a", Clock: 1, Kind: opAdd, ItemId: "milk", Fields: opFields{Name: stringField("Milk"), Position: intField(1)}},
+				{ClientId: "b", Clock: 1, Kind: opAdd, ItemId: "bread", Fields: opFields{Name: stringField("Bread"), Position: intField(1)}},
+				{ClientId: "a", Clock: 2, Kind: opSet, ItemId: "bread", Fields: opFields{Position: intField(0)}},
+				{ClientId: "b", Clock: 2, Kind: opSet, ItemId: "bread", Fields: opFields{Position: intField(2)}},
+			},
+			want: []item{{Id: "milk", Name: "Milk", Position: 1}, {Id: "bread", Name: "Bread", Position: 2}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, order := range permutations(len(test.ops)) {
+				items := arrive(test.ops, order)
+				for i := range items {
+					items[i].Stamps = itemStamps{}
+				}
+				if !reflect.DeepEqual(items, test.want) {
+					t.Fatalf("operations in order %v merged into %+v, want %+v", order, items, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeItemsSkipsMergedOperations(t *testing.T) {
+	ops := []itemOp{
+		{ClientId: "a", Clock: 1, Kind: opAdd, ItemId: "milk", Fields: opFields{Name: stringField("Milk")}},
+		{ClientId: "a", Clock: 2, Kind: opSet, ItemId: "milk", Fields: opFields{Checked: boolField(true)}},
+	}
+	items, changed := mergeItems(make([]item, 0), ops, ops)
+	if !changed {
+		t.Fatal("adding an item reported no change")
+	}
+	fresh := unseenOps(ops, ops)
+	if len(fresh) != 0 {
+		t.Fatalf("merged operations are not skipped: %+v", fresh)
+	}
+	if _, changed = mergeItems(items, fresh, ops); changed {
+		t.Fatal("merging nothing reported a change")
+	}
+}
+
+func mergeBody(ops ...itemOp) string {
+	body, _ := json.Marshal(mergeReq{Ops: ops})
+	return string(body)
+}
+
+func TestMergeOpsSentAgain(t *testing.T) {
+	s := newTestService(t, "katya", "vasya")
+	id := createTestList(t, s, "katya", `{"name":"Groceries"}`)
+	check := itemOp{ClientId: "tablet", Clock: 2, Kind: opSet, ItemId: "milk", Fields: opFields{Checked: boolField(true)}}
+	add := itemOp{ClientId: "phone", Clock: 1, Kind: opAdd, ItemId: "milk", Fields: opFields{Name: stringField("Milk")}}
+
+	// The change arrives before the item is added and is applied once it is
+	w := serve(s.HandleMergeOps, "vasya", "POST", "/v1/list/ops?id="+id, mergeBody(check))
+	expectStatus(t, w, http.StatusUnauthorized)
+	w = serve(s.HandleMergeOps, "katya", "POST", "/v1/list/ops?id="+id, mergeBody(check))
+	expectStatus(t, w, http.StatusOK)
+	w = serve(s.HandleMergeOps, "katya", "POST", "/v1/list/ops?id="+id, mergeBody(add))
+	expectStatus(t, w, http.StatusOK)
+	var merged mergeResp
+	decode(t, w, &merged)
+	if merged.Clock != 2 || len(merged.List.Items) != 1 || !merged.List.Items[0].Checked {
+		t.Fatalf("got merged list %+v with clock %d", merged.List, merged.Clock)
+	}
+
+	w = serve(s.HandleMergeOps, "katya", "POST", "/v1/list/ops?id="+id, mergeBody(add, check))
+	expectStatus(t, w, http.StatusOK)
+	var again mergeResp
+	decode(t, w, &again)
+	if again.List.Version != merged.List.Version || len(again.List.Items) != 1 {
+		t.Errorf("sending operations again changed the list from %+v to %+v", merged.List, again.List)
+	}
+	var logged opsResp
+	decode(t, serve(s.HandleGetOps, "katya", "GET", "/v1/list/ops?id="+id, ""), &logged)
+	if len(logged.Ops) != 2 || logged.Clock != 2 {
+		t.Errorf("got logged operations %+v", logged)
+	}
+}
+
+func TestMergeOpsRejectsInvalidOperations(t *testing.T) {
+	s := newTestService(t, "katya")
+	id := createTestList(t, s, "katya", `{"name":"Groceries","content":"Milk"}`)
+	tests := []struct {
+		name string
+		ops  []itemOp
+	}{
+		{"unknown kind", []itemOp{{ClientId: "phone", Clock: 1, Kind: "rename", ItemId: "milk"}}},
+		{"no clock", []itemOp{{ClientId: "phone", Kind: opRemove, ItemId: "milk"}}},
+		{"no name", []itemOp{{ClientId: "phone", Clock: 1, Kind: opAdd, ItemId: "bread"}}},
+		{"clock used twice", []itemOp{
+			{ClientId: "phone", Clock: 1, Kind: opRemove, ItemId: "milk"},
+			{ClientId: "phone", Clock: 1, Kind: opRemove, ItemId: "bread"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := serve(s.HandleMergeOps, "katya", "POST", "/v1/list/ops?id="+id, mergeBody(test.ops...))
+			expectStatus(t, w, http.StatusBadRequest)
+		})
+	}
+	if listRec := getTestList(t, s, "katya", id); listRec.Version != 1 || len(listRec.Items) != 1 {
+		t.Errorf("invalid operations changed the list: %+v", listRec)
+	}
+}
+
+func TestDirectEditWinsOverEarlierOperations(t *testing.T) {
+	s := newTestService(t, "katya")
+	id := createTestList(t, s, "katya", `{"name":"Groceries"}`)
+	add := itemOp{ClientId: "phone", Clock: 1, Kind: opAdd, ItemId: "milk", Fields: opFields{Name: stringField("Milk")}}
+	var merged mergeResp
+	decode(t, serve(s.HandleMergeOps, "katya", "POST", "/v1/list/ops?id="+id, mergeBody(add)), &merged)
+
+	w := serve(s.HandleEditItem, "katya", "POST", "/v1/list/items/edit?id="+id+"&item=milk", `{"name":"Oat milk"}`,
+		"If-Match", strconv.Quote(strconv.FormatInt(merged.List.Version, 10)))
+	expectStatus(t, w, http.StatusOK)
+	// The tablet was offline and renamed the item before the edit
+	rename := itemOp{ClientId: "tablet", Clock: 1, Kind: opSet, ItemId: "milk", Fields: opFields{Name: stringField("Whole milk")}}
+	decode(t, serve(s.HandleMergeOps, "katya", "POST", "/v1/list/ops?id="+id, mergeBody(rename)), &merged)
+	if len(merged.List.Items) != 1 || merged.List.Items[0].Name != "Oat milk" || merged.Clock < 2 {
+		t.Fatalf("got merged list %+v with clock %d", merged.List, merged.Clock)
+	}
+	var logged opsResp
+	decode(t, serve(s.HandleGetOps, "katya", "GET", "/v1/list/ops?id="+id, ""), &logged)
+	if logged.Clock != merged.Clock {
+		t.Errorf("got clock %d, the merge returned %d", logged.Clock, merged.Clock)
+	}
+
+	// An operation made after the client has seen the clock wins over the edit
+	rename = itemOp{ClientId: "tablet", Clock: merged.Clock + 1, Kind: opSet, ItemId: "milk", Fields: opFields{Name: stringField("Whole milk")}}
+	decode(t, serve(s.HandleMergeOps, "katya", "POST", "/v1/list/ops?id="+id, mergeBody(rename)), &merged)
+	if merged.List.Items[0].Name != "Whole milk" {
+		t.Errorf("got items %+v", merged.List.Items)
+	}
+}
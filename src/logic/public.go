@@ -0,0 +1,143 @@
+package logic
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errPublicListNotFound = errors.New("list not found")
+
+// publicList is the read-only view of a list served by its public token, it doesn't reveal the members
+type publicList struct {
+	Name        string    `json:"name"`
+	LastChanged time.Time `json:"last_changed"`
+	Items       []item    `json:"items"`
+}
+
+type publicLinkResp struct {
+	Token string `json:"token"`
+}
+
+// enablePublicLink makes the list public and returns its token.
+// The current token is kept unless rotate is set, then the old link stops working.
+func (s *Service) enablePublicLink(username, id string, rotate bool) (string, error) {
+	listRec, err := s.lists.Get(id)
+	if err == errNotFound {
+		return "", errNotOwner
+	}
+	if err != nil {
+		return "", err
+	}
+	if !listRec.permits(username, permManage) {
+		return "", errNotOwner
+	}
+	if listRec.PublicToken != "" && !rotate {
+		return listRec.PublicToken, nil
+	}
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	if err = s.lists.SetPublicToken(id, token); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (s *Service) disablePublicLink(username, id string) error {
+	listRec, err := s.lists.Get(id)
+	if err == errNotFound {
+		return errNotOwner
+	}
+	if err != nil {
+		return err
+	}
+	if !listRec.permits(username, permManage) {
+		return errNotOwner
+	}
+	return s.lists.SetPublicToken(id, "")
+}
+
+func (s *Service) publicView(token string) (*publicList, error) {
+	listRec, err := s.lists.ByPublicToken(token)
+	if err == errNotFound {
+		return nil, errPublicListNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	listRec, err = s.loadList(listRec.Id)
+	if err != nil {
+		return nil, err
+	}
+	return &publicList{
+		Name:        listRec.OriginalName,
+		LastChanged: listRec.LastChanged,
+		Items:       listRec.Items,
+	}, nil
+}
+
+// describeItem renders quantity, unit and note of the item, e.g. "2 l, skimmed"
+func describeItem(it item) string {
+	parts := make([]string, 0, 2)
+	if it.Quantity != 0 {
+		parts = append(parts, strings.TrimSpace(strconv.FormatFloat(it.Quantity, 'f', -1, 64)+" "+it.Unit))
+	}
+	if it.Note != "" {
+		parts = append(parts, it.Note)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func writePublicText(w io.Writer, view *publicList) error {
+	var builder strings.Builder
+	builder.WriteString(view.Name + "\n\n")
+	for _, it := range view.Items {
+		mark := "[ ]"
+		if it.Checked {
+			mark = "[x]"
+		}
+		line := mark + " " + it.Name
+		if description := describeItem(it); description != "" {
+			line += " (" + description + ")"
+		}
+		builder.WriteString(line + "\n")
+	}
+	_, err := fmt.Fprint(w, builder.String())
+	return err
+}
+
+var publicListTemplate = template.Must(template.New("list").Funcs(template.FuncMap{
+	"describe": describeItem,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{.Name}}</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; }
+ul { list-style: none; padding: 0; }
+li { padding: 0.3em 0; border-bottom: 1px solid #ddd; }
+.checked { text-decoration: line-through; color: #888; }
+.details { color: #666; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>{{.Name}}</h1>
+<ul>
+{{range .Items}}<li{{if .Checked}} class="checked"{{end}}>{{if .Checked}}&#9745;{{else}}&#9744;{{end}} {{.Name}}{{with describe .}} <span class="details">{{.}}</span>{{end}}</li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+func writePublicHTML(w io.Writer, view *publicList) error {
+	return publicListTemplate.Execute(w, view)
+}
@@ -0,0 +1,166 @@
+package logic
+
+import (
+	"errors"
+	"github.com/segmentio/ksuid"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+var (
+	errRequestNotFound  = errors.New("request not found")
+	errUnknownUser      = errors.New("user doesn't exist")
+	errSelfShare        = errors.New("list can't be shared with yourself")
+	errAlreadyShared    = errors.New("list is already shared with the user")
+	errAlreadyRequested = errors.New("user already has a pending request for the list")
+)
+
+// shareRequest invites Guest to the list with Role. Owner is who has sent it, the owner of the list or a co-owner.
+// Requests with roleOwner transfer ownership, the owner keeps FormerOwnerRole or leaves the list if it is empty.
+type shareRequest struct {
+	Id              string    `bson:"id" json:"id"`
+	ListId          string    `bson:"list_id" json:"list_id"`
+	ListName        string    `bson:"list_name" json:"list_name"`
+	Owner           string    `bson:"owner" json:"owner"`
+	Guest           string    `bson:"guest" json:"guest"`
+	Role            string    `bson:"role" json:"role"`
+	FormerOwnerRole string    `bson:"former_owner_role,omitempty" json:"former_owner_role,omitempty"`
+	Created         time.Time `bson:"created" json:"created"`
+}
+
+// requestShare creates a pending invitation for guest to join the list with the role on behalf of sender,
+// who must be allowed to share the list. The guest gets access only after accepting it.
+func (s *Service) requestShare(sender, guest, id, role string) (string, error) {
+	if role == "" {
+		role = defaultGuestRole
+	}
+	if !validGuestRole(role) {
+		return "", errInvalidRole
+	}
+	listRec, err := s.lists.Get(id)
+	if err == errNotFound {
+		return "", errNoPermission
+	}
+	if err != nil {
+		return "", err
+	}
+	permitted, err := s.permitsList(listRec, sender, permShare)
+	if err != nil {
+		return "", err
+	}
+	if !permitted {
+		return "", errNoPermission
+	}
+	if guest == sender {
+		return "", errSelfShare
+	}
+	if err = s.checkInvitee(listRec, guest); err != nil {
+		return "", err
+	}
+	if listRec.roleOf(guest) != "" {
+		return "", errAlreadyShared
+	}
+	req := shareRequest{
+		Id:       ksuid.New().String(),
+		ListId:   id,
+		ListName: listRec.OriginalName,
+		Owner:    sender,
+		Guest:    guest,
+		Role:     role,
+		Created:  time.Now(),
+	}
+	err = s.requests.Insert(req)
+	if err == errDuplicate {
+		return "", errAlreadyRequested
+	}
+	if err != nil {
+		return "", err
+	}
+	s.notify([]string{guest}, notificationListShared, sender, id, listRec.OriginalName)
+	return req.Id, nil
+}
+
+// checkInvitee checks that the user can receive a request for the list
+func (s *Service) checkInvitee(listRec *list, username string) error {
+	_, err := s.access.Get(username)
+	if err == errNotFound {
+		return errUnknownUser
+	}
+	if err != nil {
+		return err
+	}
+	pending, err := s.requests.ByGuest(username)
+	if err != nil {
+		return err
+	}
+	for _, req := range pending {
+		if req.ListId == listRec.Id {
+			return errAlreadyRequested
+		}
+	}
+	return nil
+}
+
+func (s *Service) acceptShareRequest(username, requestId string) error {
+	req, err := s.requests.Get(requestId)
+	if err != nil || req.Guest != username {
+		return errRequestNotFound
+	}
+	switch req.Role {
+	case roleOwner:
+		err = s.transferOwnership(req.Owner, req.Guest, req.ListId, req.FormerOwnerRole)
+	case "":
+		// Requests sent before roles existed
+		err = s.addGuest(req.Owner, req.Guest, req.ListId, defaultGuestRole)
+	default:
+		err = s.addGuest(req.Owner, req.Guest, req.ListId, req.Role)
+	}
+	if err == errAlreadyShared || err == errAlreadyOwner {
+		// The user has got the list another way meanwhile, so the request has nothing left to give
+		if removeErr := s.removeRequest(requestId); removeErr != nil {
+			log.Error("Request ", requestId, " is fulfilled already but it is not removed: ", removeErr)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if err = s.requests.Remove(requestId); err != nil {
+		log.Error("Request ", requestId, " was accepted by ", username, " but it is not removed: ", err)
+	}
+	s.notify([]string{req.Owner}, notificationRequestAccepted, username, req.ListId, req.ListName)
+	return nil
+}
+
+func (s *Service) declineShareRequest(username, requestId string) error {
+	req, err := s.requests.Get(requestId)
+	if err != nil || req.Guest != username {
+		return errRequestNotFound
+	}
+	return s.removeRequest(requestId)
+}
+
+func (s *Service) cancelShareRequest(username, requestId string) error {
+	req, err := s.requests.Get(requestId)
+	if err != nil || req.Owner != username {
+		return errRequestNotFound
+	}
+	return s.removeRequest(requestId)
+}
+
+// removeRequest removes the request, which may have been answered or cancelled meanwhile
+func (s *Service) removeRequest(requestId string) error {
+	err := s.requests.Remove(requestId)
+	if err == errNotFound {
+		return errRequestNotFound
+	}
+	return err
+}
+
+func (s *Service) listIncomingRequests(username string) ([]shareRequest, error) {
+	return s.requests.ByGuest(username)
+}
+
+func (s *Service) listOutgoingRequests(username string) ([]shareRequest, error) {
+	return s.requests.ByOwner(username)
+}
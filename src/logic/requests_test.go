@@ -0,0 +1,94 @@
+package logic
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func shareBody(id, guest string) string {
+	body, _ := json.Marshal(shareReq{Id: id, Guest: guest})
+	return string(body)
+}
+
+func TestShareRejectsInvalidGuests(t *testing.T) {
+	s := newTestService(t, "katya", "vasya", "masha")
+	id := createTestList(t, s, "katya", `{"name":"Groceries"}`)
+	shareTestList(t, s, "katya", "vasya", id, roleEditor)
+	w := serve(s.HandleShareList, "katya", "POST", "/v1/list/share", shareBody(id, "masha"))
+	expectStatus(t, w, http.StatusOK)
+
+	tests := []struct {
+		name   string
+		guest  string
+		status int
+	}{
+		{"unknown user", "nobody", http.StatusNotFound},
+		{"owner", "katya", http.StatusBadRequest},
+		{"guest", "vasya", http.StatusConflict},
+		{"pending request", "masha", http.StatusConflict},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := serve(s.HandleShareList, "katya", "POST", "/v1/list/share", shareBody(id, test.guest))
+			expectStatus(t, w, test.status)
+		})
+	}
+}
+
+func TestShareRequiresPermission(t *testing.T) {
+	s := newTestService(t, "katya", "vasya", "masha")
+	id := createTestList(t, s, "katya", `{"name":"Groceries"}`)
+	shareTestList(t, s, "katya", "vasya", id, roleViewer)
+
+	w := serve(s.HandleShareList, "vasya", "POST", "/v1/list/share", shareBody(id, "masha"))
+	expectStatus(t, w, http.StatusUnauthorized)
+	w = serve(s.HandleShareList, "masha", "POST", "/v1/list/share", shareBody(id, "vasya"))
+	expectStatus(t, w, http.StatusUnauthorized)
+}
+
+func TestDeclineAndCancelRequests(t *testing.T) {
+	s := newTestService(t, "katya", "vasya")
+	id := createTestList(t, s, "katya", `{"name":"Groceries"}`)
+	var declined, cancelled idResp
+	decode(t, serve(s.HandleShareList, "katya", "POST", "/v1/list/share", shareBody(id, "vasya")), &declined)
+
+	w := serve(s.HandleCancelRequest, "vasya", "POST", "/v1/requests/cancel?id="+declined.Id, "")
+	expectStatus(t, w, http.StatusNotFound)
+	w = serve(s.HandleDeclineRequest, "vasya", "POST", "/v1/requests/decline?id="+declined.Id, "")
+	expectStatus(t, w, http.StatusOK)
+	w = serve(s.HandleAcceptRequest, "vasya", "POST", "/v1/requests/accept?id="+declined.Id, "")
+	expectStatus(t, w, http.StatusNotFound)
+
+	decode(t, serve(s.HandleShareList, "katya", "POST", "/v1/list/share", shareBody(id, "vasya")), &cancelled)
+	w = serve(s.HandleCancelRequest, "katya", "POST", "/v1/requests/cancel?id="+cancelled.Id, "")
+	expectStatus(t, w, http.StatusOK)
+	w = serve(s.HandleCancelRequest, "katya", "POST", "/v1/requests/cancel?id="+cancelled.Id, "")
+	expectStatus(t, w, http.StatusNotFound)
+	if guests := getTestList(t, s, "katya", id).Guests; len(guests) != 0 {
+		t.Errorf("declined and cancelled requests added guests %v", guests)
+	}
+}
+
+func TestAcceptRequestForListJoinedMeanwhile(t *testing.T) {
+	s := newTestService(t, "katya", "vasya")
+	id := createTestList(t, s, "katya", `{"name":"Groceries"}`)
+	var request idResp
+	decode(t, serve(s.HandleShareList, "katya", "POST", "/v1/list/share", shareBody(id, "vasya")), &request)
+	var inv invite
+	decode(t, serve(s.HandleCreateInvite, "katya", "POST", "/v1/list/invites/create?id="+id, `{}`), &inv)
+	w := serve(s.HandleJoinByInvite, "vasya", "POST", "/v1/invites/join?token="+inv.Token, "")
+	expectStatus(t, w, http.StatusOK)
+
+	w = serve(s.HandleAcceptRequest, "vasya", "POST", "/v1/requests/accept?id="+request.Id, "")
+	expectStatus(t, w, http.StatusConflict)
+	var pending []shareRequest
+	decode(t, serve(s.HandleGetRequests, "vasya", "GET", "/v1/requests/get", ""), &pending)
+	if len(pending) != 0 {
+		t.Errorf("fulfilled request is still pending: %+v", pending)
+	}
+	decode(t, serve(s.HandleGetSentRequests, "katya", "GET", "/v1/requests/sent", ""), &pending)
+	if len(pending) != 0 {
+		t.Errorf("fulfilled request is still sent: %+v", pending)
+	}
+}
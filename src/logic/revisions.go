@@ -0,0 +1,176 @@
+package logic
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// maxRevisions is how many of the latest revisions are kept per list
+const maxRevisions = 50
+
+var (
+	errRevisionNotFound = errors.New("revision not found")
+	errInvalidRevision  = errors.New("invalid revision")
+)
+
+// revision is a snapshot of a list right after somebody has changed it
+type revision struct {
+	ListId  string    `bson:"list_id" json:"list_id"`
+	Version int64     `bson:"version" json:"version"`
+	Author  string    `bson:"author" json:"author"`
+	Created time.Time `bson:"created" json:"created"`
+	Name    string    `bson:"name" json:"name"`
+	Items   []item    `bson:"items" json:"items"`
+	// RevertedFrom is the version this revision has restored, it is 0 for ordinary changes
+	RevertedFrom int64 `bson:"reverted_from,omitempty" json:"reverted_from,omitempty"`
+}
+
+type revisionSummary struct {
+	Version      int64     `json:"version"`
+	Author       string    `json:"author"`
+	Created      time.Time `json:"created"`
+	Name         string    `json:"name"`
+	ItemCount    int       `json:"item_count"`
+	RevertedFrom int64     `json:"reverted_from,omitempty"`
+}
+
+// itemDiff lists names of items changed by a revision compared to the previous one
+type itemDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+}
+
+type revisionView struct {
+	*revision
+	// Diff is nil for the oldest kept revision
+	Diff *itemDiff `json:"diff"`
+}
+
+// recordRevision stores the list as it is in version, made by author.
+// Nothing is recorded if the list has been changed again meanwhile, that change records its own revision.
+func (s *Service) recordRevision(author, id string, version, revertedFrom int64) {
+	listRec, err := s.lists.Get(id)
+	if err != nil {
+		log.Error("Failed to load list ", id, " for its history: ", err)
+		return
+	}
+	if listRec.Version != version {
+		return
+	}
+	presentList(listRec)
+	err = s.revisions.Insert(revision{
+		ListId:       id,
+		Version:      version,
+		Author:       author,
+		Created:      listRec.LastChanged,
+		Name:         listRec.OriginalName,
+		Items:        listRec.Items,
+		RevertedFrom: revertedFrom,
+	}, maxRevisions)
+	if err != nil && err != errDuplicate {
+		log.Error("Failed to record revision ", version, " of ", id, ": ", err)
+	}
+}
+
+func (s *Service) listRevisions(id string) ([]revisionSummary, error) {
+	revisions, err := s.revisions.ByList(id)
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]revisionSummary, 0, len(revisions))
+	for _, rev := range revisions {
+		summaries = append(summaries, revisionSummary{
+			Version:      rev.Version,
+			Author:       rev.Author,
+			Created:      rev.Created,
+			Name:         rev.Name,
+			ItemCount:    len(rev.Items),
+			RevertedFrom: rev.RevertedFrom,
+		})
+	}
+	return summaries, nil
+}
+
+// getRevision returns the revision with the changes it has made since the previous kept one
+func (s *Service) getRevision(id string, version int64) (*revisionView, error) {
+	revisions, err := s.revisions.ByList(id)
+	if err != nil {
+		return nil, err
+	}
+	// Revisions are newest first, so the previous one follows the requested one
+	for i := range revisions {
+		if revisions[i].Version != version {
+			continue
+		}
+		view := &revisionView{revision: &revisions[i]}
+		if i+1 < len(revisions) {
+			view.Diff = diffItems(revisions[i+1].Items, revisions[i].Items)
+		}
+		return view, nil
+	}
+	return nil, errRevisionNotFound
+}
+
+func diffItems(before, after []item) *itemDiff {
+	diff := &itemDiff{
+		Added:   make([]string, 0),
+		Removed: make([]string, 0),
+		Changed: make([]string, 0),
+	}
+	previous := make(map[string]item, len(before))
+	for _, it := range before {
+		previous[it.Id] = it
+	}
+	for _, it := range after {
+		old, ok := previous[it.Id]
+		if !ok {
+			diff.Added = append(diff.Added, it.Name)
+			continue
+		}
+		delete(previous, it.Id)
+		if old != it {
+			diff.Changed = append(diff.Changed, it.Name)
+		}
+	}
+	for _, it := range before {
+		if _, ok := previous[it.Id]; ok {
+			diff.Removed = append(diff.Removed, it.Name)
+		}
+	}
+	return diff
+}
+
+// revertList restores items of the list from the revision, which is recorded as a new revision
+func (s *Service) revertList(username, id string, target, version int64) (int64, error) {
+	rev, err := s.revisions.Get(id, target)
+	if err == errNotFound {
+		return 0, errRevisionNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	listRec, err := s.loadList(id)
+	if err != nil {
+		return 0, err
+	}
+	if err = checkVersion(listRec, version); err != nil {
+		return 0, err
+	}
+	st, err := s.serverStamp(listRec)
+	if err != nil {
+		return 0, err
+	}
+	// Restored items are stamped where they differ from the current ones, so earlier operations don't undo the revert
+	items := append(make([]item, 0, len(rev.Items)), rev.Items...)
+	stampItems(items, listRec.Items, st)
+	newVersion, err := s.lists.SetItems(id, items, listRec.Version)
+	if err != nil {
+		return 0, err
+	}
+	s.recordRevision(username, id, newVersion, rev.Version)
+	s.notify(listMembers(listRec), notificationListReverted, username, id, listRec.OriginalName)
+	s.publishListEvent(eventListEdited, username, listRec, newVersion)
+	return newVersion, nil
+}
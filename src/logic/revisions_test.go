@@ -0,0 +1,103 @@
+package logic
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// editTestList replaces the items of the list with content, checking that it is in the version
+func editTestList(t *testing.T, s *Service, username, id, content string, version int64) {
+	t.Helper()
+	w := serve(s.HandleUpdateList, username, "POST", "/v1/list/update?id="+id, `{"content":"`+content+`"}`,
+		"If-Match", strconv.Quote(strconv.FormatInt(version, 10)))
+	expectStatus(t, w, http.StatusOK)
+}
+
+func TestRevisionsRecordChanges(t *testing.T) {
+	s := newTestService(t, "katya", "vasya")
+	id := createTestList(t, s, "katya", `{"name":"Groceries","content":"Milk\nBread"}`)
+	editTestList(t, s, "katya", id, `Milk\nEggs`, 1)
+	shareTestList(t, s, "katya", "vasya", id, roleViewer)
+
+	var revisions []revisionSummary
+	decode(t, serve(s.HandleGetRevisions, "vasya", "GET", "/v1/list/revisions?id="+id, ""), &revisions)
+	if len(revisions) != 2 || revisions[0].Version != 2 || revisions[1].Version != 1 {
+		t.Fatalf("got revisions %+v, want versions 2 and 1", revisions)
+	}
+	if revisions[0].Author != "katya" || revisions[0].ItemCount != 2 {
+		t.Errorf("got revision %+v", revisions[0])
+	}
+
+	var view struct {
+		Version int64     `json:"version"`
+		Items   []item    `json:"items"`
+		Diff    *itemDiff `json:"diff"`
+	}
+	decode(t, serve(s.HandleGetRevision, "vasya", "GET", "/v1/list/revisions/get?id="+id+"&version=2", ""), &view)
+	if view.Version != 2 || view.Diff == nil {
+		t.Fatalf("got revision %+v", view)
+	}
+	if names := strings.Join(itemNames(view.Items), ","); names != "Milk,Eggs" {
+		t.Errorf("revision has items %s", names)
+	}
+	if strings.Join(view.Diff.Added, ",") != "Eggs" || strings.Join(view.Diff.Removed, ",") != "Bread" || len(view.Diff.Changed) != 0 {
+		t.Errorf("got diff %+v", view.Diff)
+	}
+	decode(t, serve(s.HandleGetRevision, "vasya", "GET", "/v1/list/revisions/get?id="+id+"&version=1", ""), &view)
+	if view.Diff != nil {
+		t.Errorf("the oldest revision has diff %+v", view.Diff)
+	}
+
+	w := serve(s.HandleGetRevision, "vasya", "GET", "/v1/list/revisions/get?id="+id+"&version=7", "")
+	expectStatus(t, w, http.StatusNotFound)
+	w = serve(s.HandleGetRevision, "vasya", "GET", "/v1/list/revisions/get?id="+id+"&version=0", "")
+	expectStatus(t, w, http.StatusBadRequest)
+}
+
+func TestRevisionsArePruned(t *testing.T) {
+	s := newTestService(t, "katya")
+	id := createTestList(t, s, "katya", `{"name":"Groceries"}`)
+	for version := int64(1); version <= maxRevisions+5; version++ {
+		editTestList(t, s, "katya", id, "Milk "+strconv.FormatInt(version, 10), version)
+	}
+	var revisions []revisionSummary
+	decode(t, serve(s.HandleGetRevisions, "katya", "GET", "/v1/list/revisions?id="+id, ""), &revisions)
+	if len(revisions) != maxRevisions {
+		t.Fatalf("got %d revisions, want %d", len(revisions), maxRevisions)
+	}
+	if revisions[0].Version != maxRevisions+6 {
+		t.Errorf("the newest kept revision is %d", revisions[0].Version)
+	}
+}
+
+func TestRevertList(t *testing.T) {
+	s := newTestService(t, "katya", "vasya")
+	id := createTestList(t, s, "katya", `{"name":"Groceries","content":"Milk\nBread"}`)
+	editTestList(t, s, "katya", id, `Beer`, 1)
+	shareTestList(t, s, "katya", "vasya", id, roleViewer)
+	version := getTestList(t, s, "katya", id).Version
+
+	w := serve(s.HandleRevertList, "vasya", "POST", "/v1/list/revert?id="+id+"&version=1", "")
+	expectStatus(t, w, http.StatusUnauthorized)
+	w = serve(s.HandleRevertList, "katya", "POST", "/v1/list/revert?id="+id+"&version=1", "", "If-Match", `"1"`)
+	expectStatus(t, w, http.StatusPreconditionFailed)
+	w = serve(s.HandleRevertList, "katya", "POST", "/v1/list/revert?id="+id+"&version=9", "")
+	expectStatus(t, w, http.StatusNotFound)
+
+	w = serve(s.HandleRevertList, "katya", "POST", "/v1/list/revert?id="+id+"&version=1", "",
+		"If-Match", strconv.Quote(strconv.FormatInt(version, 10)))
+	expectStatus(t, w, http.StatusOK)
+	if etag := w.Header().Get("ETag"); etag != strconv.Quote(strconv.FormatInt(version+1, 10)) {
+		t.Errorf("got ETag %s after version %d", etag, version)
+	}
+	if names := strings.Join(itemNames(getTestList(t, s, "katya", id).Items), ","); names != "Milk,Bread" {
+		t.Errorf("reverted list has items %s", names)
+	}
+	var revisions []revisionSummary
+	decode(t, serve(s.HandleGetRevisions, "katya", "GET", "/v1/list/revisions?id="+id, ""), &revisions)
+	if len(revisions) == 0 || revisions[0].RevertedFrom != 1 || revisions[0].Version != version+1 {
+		t.Errorf("got revisions %+v", revisions)
+	}
+}
@@ -0,0 +1,114 @@
+package logic
+
+import (
+	"errors"
+)
+
+// Roles of list members. The owner is not stored as a role, every guest has one of the others.
+const (
+	roleOwner   = "owner"
+	roleCoOwner = "co-owner"
+	roleEditor  = "editor"
+	roleViewer  = "viewer"
+)
+
+// defaultGuestRole is given to guests without a stored role, who were added before roles existed
+const defaultGuestRole = roleEditor
+
+var (
+	errInvalidRole  = errors.New("role must be one of viewer, editor or co-owner")
+	errNoPermission = errors.New("access denied")
+)
+
+// permission is what a member may do with a list, each one includes the ones before it
+type permission int
+
+const (
+	// permRead allows reading the list and leaving it
+	permRead permission = iota
+	// permEdit allows modifying items
+	permEdit
+	// permShare allows inviting other users
+	permShare
+	// permManage allows deleting the list and managing its guests
+	permManage
+)
+
+var rolePermissions = map[string]permission{
+	roleViewer:  permRead,
+	roleEditor:  permEdit,
+	roleCoOwner: permShare,
+	roleOwner:   permManage,
+}
+
+type guestRole struct {
+	Username string `bson:"username" json:"username"`
+	Role     string `bson:"role" json:"role"`
+}
+
+func validGuestRole(role string) bool {
+	return role == roleViewer || role == roleEditor || role == roleCoOwner
+}
+
+// roleOf returns the role of the user in the list, or an empty string if they are not a member
+func (l *list) roleOf(username string) string {
+	if l.Owner == username {
+		return roleOwner
+	}
+	if !hasGuest(l, username) {
+		return ""
+	}
+	for _, guest := range l.Roles {
+		if guest.Username == username {
+			return guest.Role
+		}
+	}
+	return defaultGuestRole
+}
+
+// permits reports whether the user may do what the permission allows with the list
+func (l *list) permits(username string, required permission) bool {
+	granted, ok := rolePermissions[l.roleOf(username)]
+	return ok && granted >= required
+}
+
+// hasAccessToList reports whether the user has the required permission for the list,
+// either as its member or as a member of a group the list is shared with
+func (s *Service) hasAccessToList(username, id string, required permission) (bool, error) {
+	listRec, err := s.lists.Get(id)
+	if err == errNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return s.permitsList(listRec, username, required)
+}
+
+// setGuestRole changes the role of a guest on behalf of the owner
+func (s *Service) setGuestRole(owner, guest, id, role string) error {
+	if !validGuestRole(role) {
+		return errInvalidRole
+	}
+	listRec, err := s.lists.Get(id)
+	if err == errNotFound {
+		return errNotOwner
+	}
+	if err != nil {
+		return err
+	}
+	if listRec.Owner != owner {
+		return errNotOwner
+	}
+	if !hasGuest(listRec, guest) {
+		return errNotGuest
+	}
+	if err = s.lists.SetRole(id, guest, role); err != nil {
+		return err
+	}
+	s.notify([]string{guest}, notificationRoleChanged, owner, id, listRec.OriginalName)
+	if updated, err := s.lists.Get(id); err == nil {
+		s.publishListEvent(eventRoleChanged, owner, updated, updated.Version)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package logic
+
+import "time"
+
+// TokenChecker tells whether an access token has been revoked, the token is checked again during long requests
+type TokenChecker interface {
+	IsAccessTokenRevoked(id string) (bool, error)
+}
+
+// Service implements shopping list logic and HTTP handlers on top of a storage
+type Service struct {
+	*Storage
+	events EventBroker
+	tokens TokenChecker
+	// trashRetention is how long deleted lists can be restored before they are purged
+	trashRetention time.Duration
+	// eventKeepAlive is how often a comment is sent to idle event streams so proxies don't close them
+	eventKeepAlive time.Duration
+}
+
+func NewService(storage *Storage, events EventBroker, tokens TokenChecker, trashRetention time.Duration) *Service {
+	return &Service{
+		Storage:        storage,
+		events:         events,
+		tokens:         tokens,
+		trashRetention: trashRetention,
+		eventKeepAlive: defaultEventKeepAlive,
+	}
+}
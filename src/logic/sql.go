@@ -0,0 +1,1304 @@
+package logic
+
+import (
+	"database/sql"
+	"encoding/json"
+	"shoppinglist-server/src/sqldb"
+	"strings"
+	"time"
+)
+
+// SQL repositories keep guests and links in their own tables referencing lists,
+// so removing a list removes them as well.
+
+type sqlLists struct {
+	db sqldb.Conn
+}
+
+type sqlAccess struct {
+	db sqldb.Conn
+}
+
+type sqlRequests struct {
+	db sqldb.Conn
+}
+
+type sqlNotifications struct {
+	db sqldb.Conn
+}
+
+type sqlTombstones struct {
+	db sqldb.Conn
+}
+
+type sqlInvites struct {
+	db sqldb.Conn
+}
+
+type sqlGroups struct {
+	db sqldb.Conn
+}
+
+type sqlRevisions struct {
+	db sqldb.Conn
+}
+
+type sqlItemOps struct {
+	db sqldb.Conn
+}
+
+// sqlTransactions runs writes to several repositories in one database transaction
+type sqlTransactions struct {
+	db *sqldb.DB
+}
+
+func (t sqlTransactions) inTransaction(f func(tx *Storage) error) error {
+	return t.db.InTx(func(tx *sqldb.Tx) error {
+		return f(sqlRepositories(tx))
+	})
+}
+
+func NewSQLStorage(db *sqldb.DB) *Storage {
+	storage := sqlRepositories(db)
+	storage.transactions = sqlTransactions{db: db}
+	return storage
+}
+
+// sqlRepositories returns repositories running their statements on db, which may be a transaction
+func sqlRepositories(db sqldb.Conn) *Storage {
+	return &Storage{
+		lists:         sqlLists{db: db},
+		access:        sqlAccess{db: db},
+		requests:      sqlRequests{db: db},
+		notifications: sqlNotifications{db: db},
+		tombstones:    sqlTombstones{db: db},
+		invites:       sqlInvites{db: db},
+		groups:        sqlGroups{db: db},
+		revisions:     sqlRevisions{db: db},
+		itemOps:       sqlItemOps{db: db},
+	}
+}
+
+func getSQLList(q sqldb.Querier, id string) (*list, error) {
+	var listRec list
+	var lastChanged int64
+	var publicToken sql.NullString
+	var deleted sql.NullInt64
+	err := q.QueryRow(`SELECT id, owner, name, last_changed, version, content, public_token, deleted FROM lists WHERE id = ?`, id).
+		Scan(&listRec.Id, &listRec.Owner, &listRec.OriginalName, &lastChanged, &listRec.Version, &listRec.Content, &publicToken, &deleted)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	listRec.LastChanged = sqldb.FromNanos(lastChanged)
+	listRec.PublicToken = publicToken.String
+	if deleted.Valid {
+		deletedAt := sqldb.FromNanos(deleted.Int64)
+		listRec.Deleted = &deletedAt
+	}
+	listRec.Guests, listRec.Roles, err = getSQLGuests(q, id)
+	if err != nil {
+		return nil, err
+	}
+	listRec.Groups, err = getSQLGroupShares(q, id)
+	if err != nil {
+		return nil, err
+	}
+	listRec.Items, err = getSQLItems(q, id)
+	if err != nil {
+		return nil, err
+	}
+	return &listRec, nil
+}
+
+func getSQLGroupShares(q sqldb.Querier, id string) ([]groupShare, error) {
+	rows, err := q.Query(`SELECT group_id, role FROM list_groups WHERE list_id = ? ORDER BY added, group_id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	shares := make([]groupShare, 0)
+	for rows.Next() {
+		var share groupShare
+		if err = rows.Scan(&share.GroupId, &share.Role); err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, rows.Err()
+}
+
+func getSQLGuests(q sqldb.Querier, id string) ([]string, []guestRole, error) {
+	rows, err := q.Query(`SELECT username, role FROM list_guests WHERE list_id = ? ORDER BY added, username`, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	guests := make([]string, 0, 1)
+	roles := make([]guestRole, 0, 1)
+	for rows.Next() {
+		var guest guestRole
+		if err = rows.Scan(&guest.Username, &guest.Role); err != nil {
+			return nil, nil, err
+		}
+		guests = append(guests, guest.Username)
+		roles = append(roles, guest)
+	}
+	return guests, roles, rows.Err()
+}
+
+func getSQLItems(q sqldb.Querier, id string) ([]item, error) {
+	rows, err := q.Query(`SELECT id, name, quantity, unit, checked, note, position, stamps FROM list_items
+		WHERE list_id = ? ORDER BY seq`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := make([]item, 0, 1)
+	for rows.Next() {
+		var it item
+		var stamps string
+		if err = rows.Scan(&it.Id, &it.Name, &it.Quantity, &it.Unit, &it.Checked, &it.Note, &it.Position, &stamps); err != nil {
+			return nil, err
+		}
+		if stamps != "" {
+			if err = json.Unmarshal([]byte(stamps), &it.Stamps); err != nil {
+				return nil, err
+			}
+		}
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+func insertSQLItem(tx *sqldb.Tx, id string, seq int, it item) error {
+	// Items which no operation or direct write has stamped, such as migrated ones, have no stamps
+	stamps := ""
+	if it.Stamps != (itemStamps{}) {
+		encoded, err := json.Marshal(it.Stamps)
+		if err != nil {
+			return err
+		}
+		stamps = string(encoded)
+	}
+	_, err := tx.Exec(`INSERT INTO list_items (list_id, id, seq, name, quantity, unit, checked, note, position, stamps)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, it.Id, seq, it.Name, it.Quantity, it.Unit, it.Checked, it.Note, it.Position, stamps)
+	return err
+}
+
+func (r sqlLists) Get(id string) (*list, error) {
+	listRec, err := getSQLList(r.db, id)
+	if err != nil {
+		return nil, err
+	}
+	if listRec.Deleted != nil {
+		return nil, errNotFound
+	}
+	return listRec, nil
+}
+
+func (r sqlLists) Insert(listRec list) error {
+	publicToken := sql.NullString{String: listRec.PublicToken, Valid: listRec.PublicToken != ""}
+	return r.db.InTx(func(tx *sqldb.Tx) error {
+		_, err := tx.Exec(`INSERT INTO lists (id, owner, name, last_changed, version, content, public_token)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			listRec.Id, listRec.Owner, listRec.OriginalName, sqldb.Nanos(listRec.LastChanged), listRec.Version, listRec.Content,
+			publicToken)
+		if err != nil {
+			return err
+		}
+		for _, guest := range listRec.Guests {
+			_, err = tx.Exec(`INSERT INTO list_guests (list_id, username, added, role) VALUES (?, ?, ?, ?)`,
+				listRec.Id, guest, sqldb.Nanos(listRec.LastChanged), listRec.roleOf(guest))
+			if err != nil {
+				return err
+			}
+		}
+		for _, share := range listRec.Groups {
+			_, err = tx.Exec(`INSERT INTO list_groups (list_id, group_id, role, added) VALUES (?, ?, ?, ?)`,
+				listRec.Id, share.GroupId, share.Role, sqldb.Nanos(listRec.LastChanged))
+			if err != nil {
+				return err
+			}
+		}
+		for i, it := range listRec.Items {
+			if err = insertSQLItem(tx, listRec.Id, i, it); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// versionClause restricts a statement to the given version unless it is anyVersion
+func versionClause(version int64) (string, []interface{}) {
+	if version == anyVersion {
+		return "", nil
+	}
+	return " AND version = ?", []interface{}{version}
+}
+
+func (r sqlLists) Remove(id string, version int64) error {
+	clause, args := versionClause(version)
+	removed, err := sqldb.Affected(r.db.Exec(`DELETE FROM lists WHERE id = ?`+clause, append([]interface{}{id}, args...)...))
+	if err != nil {
+		return err
+	}
+	if removed != 1 {
+		return errVersionMismatch
+	}
+	return nil
+}
+
+// modify bumps the version of the list if it is in the given version and applies change in the same transaction.
+// change returns false if the list doesn't match, then nothing is modified.
+func (r sqlLists) modify(id string, version int64, change func(tx *sqldb.Tx) (bool, error)) (int64, error) {
+	var newVersion int64
+	err := r.db.InTx(func(tx *sqldb.Tx) error {
+		clause, args := versionClause(version)
+		updated, err := sqldb.Affected(tx.Exec(`UPDATE lists SET version = version + 1, last_changed = ?
+			WHERE id = ? AND deleted IS NULL`+clause,
+			append([]interface{}{sqldb.Nanos(time.Now()), id}, args...)...))
+		if err != nil {
+			return err
+		}
+		if updated != 1 {
+			return errVersionMismatch
+		}
+		matched, err := change(tx)
+		if err != nil {
+			return err
+		}
+		if !matched {
+			return errVersionMismatch
+		}
+		return tx.QueryRow(`SELECT version FROM lists WHERE id = ?`, id).Scan(&newVersion)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return newVersion, nil
+}
+
+func (r sqlLists) SetItems(id string, items []item, version int64) (int64, error) {
+	return r.modify(id, version, func(tx *sqldb.Tx) (bool, error) {
+		if _, err := tx.Exec(`UPDATE lists SET content = '' WHERE id = ?`, id); err != nil {
+			return false, err
+		}
+		if _, err := tx.Exec(`DELETE FROM list_items WHERE list_id = ?`, id); err != nil {
+			return false, err
+		}
+		for i, it := range items {
+			if err := insertSQLItem(tx, id, i, it); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+}
+
+func (r sqlLists) PushItem(id string, it item, version int64) (int64, error) {
+	return r.modify(id, version, func(tx *sqldb.Tx) (bool, error) {
+		var seq int
+		err := tx.QueryRow(`SELECT COALESCE(MAX(seq), -1) + 1 FROM list_items WHERE list_id = ?`, id).Scan(&seq)
+		if err != nil {
+			return false, err
+		}
+		return true, insertSQLItem(tx, id, seq, it)
+	})
+}
+
+func (r sqlLists) UpdateItem(id, itemId string, changes itemChanges, st stamp, version int64) (int64, error) {
+	var fields []string
+	var args []interface{}
+	if changes.Name != nil {
+		fields = append(fields, "name = ?")
+		args = append(args, *changes.Name)
+	}
+	if changes.Quantity != nil {
+		fields = append(fields, "quantity = ?")
+		args = append(args, *changes.Quantity)
+	}
+	if changes.Unit != nil {
+		fields = append(fields, "unit = ?")
+		args = append(args, *changes.Unit)
+	}
+	if changes.Checked != nil {
+		fields = append(fields, "checked = ?")
+		args = append(args, *changes.Checked)
+	}
+	if changes.Note != nil {
+		fields = append(fields, "note = ?")
+		args = append(args, *changes.Note)
+	}
+	return r.modify(id, version, func(tx *sqldb.Tx) (bool, error) {
+		var encoded string
+		err := tx.QueryRow(`SELECT stamps FROM list_items WHERE list_id = ? AND id = ?`, id, itemId).Scan(&encoded)
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		if err != nil || len(fields) == 0 {
+			return err == nil, err
+		}
+		// Stamps are stored encoded, so they are changed in the loaded copy
+		var stamps itemStamps
+		if encoded != "" {
+			if err = json.Unmarshal([]byte(encoded), &stamps); err != nil {
+				return false, err
+			}
+		}
+		stamps.stampChanges(changes, st)
+		stampsJSON, err := json.Marshal(stamps)
+		if err != nil {
+			return false, err
+		}
+		updated, err := sqldb.Affected(tx.Exec(`UPDATE list_items SET `+strings.Join(fields, ", ")+`, stamps = ? WHERE list_id = ? AND id = ?`,
+			append(args, string(stampsJSON), id, itemId)...))
+		return updated == 1, err
+	})
+}
+
+func (r sqlLists) PullItem(id, itemId string, version int64) (int64, error) {
+	return r.modify(id, version, func(tx *sqldb.Tx) (bool, error) {
+		removed, err := sqldb.Affected(tx.Exec(`DELETE FROM list_items WHERE list_id = ? AND id = ?`, id, itemId))
+		return removed == 1, err
+	})
+}
+
+func (r sqlLists) Rename(id, name string, version int64) (int64, error) {
+	return r.modify(id, version, func(tx *sqldb.Tx) (bool, error) {
+		_, err := tx.Exec(`UPDATE lists SET name = ? WHERE id = ?`, name, id)
+		return true, err
+	})
+}
+
+func (r sqlLists) AddGuest(id, username, role string) error {
+	_, err := r.modify(id, anyVersion, func(tx *sqldb.Tx) (bool, error) {
+		inserted, err := sqldb.Affected(tx.Exec(`INSERT INTO list_guests (list_id, username, added, role)
+			VALUES (?, ?, ?, ?) ON CONFLICT (list_id, username) DO NOTHING`,
+			id, username, sqldb.Nanos(time.Now()), role))
+		if err == nil && inserted == 0 {
+			err = errDuplicate
+		}
+		return true, err
+	})
+	if err == errVersionMismatch {
+		return errNotFound
+	}
+	return err
+}
+
+func (r sqlLists) RemoveGuest(id, username string) error {
+	_, err := r.modify(id, anyVersion, func(tx *sqldb.Tx) (bool, error) {
+		_, err := tx.Exec(`DELETE FROM list_guests WHERE list_id = ? AND username = ?`, id, username)
+		return true, err
+	})
+	if err == errVersionMismatch {
+		return errNotFound
+	}
+	return err
+}
+
+func (r sqlLists) SetOwner(id, owner string) error {
+	_, err := r.modify(id, anyVersion, func(tx *sqldb.Tx) (bool, error) {
+		_, err := tx.Exec(`UPDATE lists SET owner = ? WHERE id = ?`, owner, id)
+		return true, err
+	})
+	if err == errVersionMismatch {
+		return errNotFound
+	}
+	return err
+}
+
+func (r sqlLists) SetPublicToken(id, token string) error {
+	publicToken := sql.NullString{String: token, Valid: token != ""}
+	updated, err := sqldb.Affected(r.db.Exec(`UPDATE lists SET public_token = ? WHERE id = ?`, publicToken, id))
+	if err != nil {
+		return err
+	}
+	if updated != 1 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (r sqlLists) ByPublicToken(token string) (*list, error) {
+	var id string
+	err := r.db.QueryRow(`SELECT id FROM lists WHERE public_token = ? AND deleted IS NULL`, token).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return getSQLList(r.db, id)
+}
+
+func (r sqlLists) SetRole(id, username, role string) error {
+	_, err := r.modify(id, anyVersion, func(tx *sqldb.Tx) (bool, error) {
+		updated, err := sqldb.Affected(tx.Exec(`UPDATE list_guests SET role = ? WHERE list_id = ? AND username = ?`,
+			role, id, username))
+		return updated == 1, err
+	})
+	if err == errVersionMismatch {
+		return errNotFound
+	}
+	return err
+}
+
+func (r sqlLists) AddGroup(id string, share groupShare) error {
+	_, err := r.modify(id, anyVersion, func(tx *sqldb.Tx) (bool, error) {
+		inserted, err := sqldb.Affected(tx.Exec(`INSERT INTO list_groups (list_id, group_id, role, added)
+			VALUES (?, ?, ?, ?) ON CONFLICT (list_id, group_id) DO NOTHING`,
+			id, share.GroupId, share.Role, sqldb.Nanos(time.Now())))
+		if err == nil && inserted == 0 {
+			err = errDuplicate
+		}
+		return true, err
+	})
+	if err == errVersionMismatch {
+		return errNotFound
+	}
+	return err
+}
+
+func (r sqlLists) RemoveGroup(id, groupId string) error {
+	_, err := r.modify(id, anyVersion, func(tx *sqldb.Tx) (bool, error) {
+		removed, err := sqldb.Affected(tx.Exec(`DELETE FROM list_groups WHERE list_id = ? AND group_id = ?`, id, groupId))
+		return removed == 1, err
+	})
+	if err == errVersionMismatch {
+		return errNotFound
+	}
+	return err
+}
+
+func (r sqlLists) ByGroup(groupId string) ([]list, error) {
+	return r.find(`SELECT list_id FROM list_groups JOIN lists ON lists.id = list_groups.list_id
+		WHERE group_id = ? AND deleted IS NULL ORDER BY list_id`, groupId)
+}
+
+func (r sqlLists) ChangedSince(ids []string, since time.Time) ([]list, error) {
+	if len(ids) == 0 {
+		return make([]list, 0), nil
+	}
+	args := make([]interface{}, 0, len(ids)+1)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	args = append(args, sqldb.Nanos(since))
+	return r.find(`SELECT id FROM lists WHERE id IN (`+sqldb.Placeholders(len(ids))+`) AND last_changed > ? AND deleted IS NULL`, args...)
+}
+
+func (r sqlLists) All() ([]list, error) {
+	return r.find(`SELECT id FROM lists WHERE deleted IS NULL ORDER BY id`)
+}
+
+func (r sqlLists) Trash(id string, deleted time.Time, version int64) (int64, error) {
+	return r.modify(id, version, func(tx *sqldb.Tx) (bool, error) {
+		_, err := tx.Exec(`UPDATE lists SET deleted = ? WHERE id = ?`, sqldb.Nanos(deleted), id)
+		return true, err
+	})
+}
+
+func (r sqlLists) Restore(id string) (int64, error) {
+	var newVersion int64
+	err := r.db.InTx(func(tx *sqldb.Tx) error {
+		updated, err := sqldb.Affected(tx.Exec(`UPDATE lists SET deleted = NULL, version = version + 1, last_changed = ?
+			WHERE id = ? AND deleted IS NOT NULL`, sqldb.Nanos(time.Now()), id))
+		if err != nil {
+			return err
+		}
+		if updated != 1 {
+			return errNotFound
+		}
+		return tx.QueryRow(`SELECT version FROM lists WHERE id = ?`, id).Scan(&newVersion)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return newVersion, nil
+}
+
+func (r sqlLists) Trashed(owner string) ([]list, error) {
+	return r.find(`SELECT id FROM lists WHERE owner = ? AND deleted IS NOT NULL ORDER BY deleted DESC`, owner)
+}
+
+func (r sqlLists) TrashedBefore(before time.Time) ([]list, error) {
+	return r.find(`SELECT id FROM lists WHERE deleted < ? ORDER BY deleted`, sqldb.Nanos(before))
+}
+
+// find loads lists with ids selected by query
+func (r sqlLists) find(query string, args ...interface{}) ([]list, error) {
+	lists := make([]list, 0, 1)
+	err := r.db.InTx(func(tx *sqldb.Tx) error {
+		rows, err := tx.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		ids := make([]string, 0, 1)
+		for rows.Next() {
+			var id string
+			if err = rows.Scan(&id); err != nil {
+				_ = rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		_ = rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			listRec, err := getSQLList(tx, id)
+			if err != nil {
+				return err
+			}
+			lists = append(lists, *listRec)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lists, nil
+}
+
+func (r sqlAccess) Get(username string) (*accessRecord, error) {
+	record := accessRecord{
+		Username:    username,
+		OwnedLists:  make([]listLink, 0, 1),
+		SharedLists: make([]listLink, 0, 1),
+	}
+	err := r.db.InTx(func(tx *sqldb.Tx) error {
+		var count int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE username = ?`, username).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return errNotFound
+		}
+		rows, err := tx.Query(`SELECT list_id, display_name, aliased, owned FROM list_links
+			WHERE username = ? ORDER BY linked, list_id`, username)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var link listLink
+			var owned bool
+			if err = rows.Scan(&link.Id, &link.DisplayName, &link.Aliased, &owned); err != nil {
+				return err
+			}
+			if owned {
+				record.OwnedLists = append(record.OwnedLists, link)
+			} else {
+				record.SharedLists = append(record.SharedLists, link)
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func insertSQLLink(q sqldb.Querier, username string, link listLink, owned bool) error {
+	inserted, err := sqldb.Affected(q.Exec(`INSERT INTO list_links (username, list_id, owned, display_name, aliased, linked)
+		VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (username, list_id) DO NOTHING`,
+		username, link.Id, owned, link.DisplayName, link.Aliased, sqldb.Nanos(time.Now())))
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return errDuplicate
+	}
+	return nil
+}
+
+// Insert creates the user if the credentials are stored elsewhere, such a user can't sign in with the empty hash
+func (r sqlAccess) Insert(record accessRecord) error {
+	return r.db.InTx(func(tx *sqldb.Tx) error {
+		_, err := tx.Exec(`INSERT INTO users (username, hash) VALUES (?, '') ON CONFLICT (username) DO NOTHING`, record.Username)
+		if err != nil {
+			return err
+		}
+		for _, link := range record.OwnedLists {
+			if err = insertSQLLink(tx, record.Username, link, true); err != nil {
+				return err
+			}
+		}
+		for _, link := range record.SharedLists {
+			if err = insertSQLLink(tx, record.Username, link, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r sqlAccess) AddOwned(username string, link listLink) error {
+	return insertSQLLink(r.db, username, link, true)
+}
+
+func (r sqlAccess) AddShared(username string, link listLink) error {
+	return insertSQLLink(r.db, username, link, false)
+}
+
+func (r sqlAccess) RemoveOwned(username, id string) error {
+	return r.removeLink(username, id, true)
+}
+
+func (r sqlAccess) RemoveShared(username, id string) error {
+	return r.removeLink(username, id, false)
+}
+
+// removeLink deletes the link, a user without it is only looked up to tell whether the user exists
+func (r sqlAccess) removeLink(username, id string, owned bool) error {
+	return r.db.InTx(func(tx *sqldb.Tx) error {
+		removed, err := sqldb.Affected(tx.Exec(`DELETE FROM list_links WHERE username = ? AND list_id = ? AND owned = ?`,
+			username, id, owned))
+		if err != nil {
+			return err
+		}
+		if removed > 0 {
+			return nil
+		}
+		var count int
+		if err = tx.QueryRow(`SELECT COUNT(*) FROM users WHERE username = ?`, username).Scan(&count); err != nil {
+			return err
+		}
+		if count == 0 {
+			return errNotFound
+		}
+		return nil
+	})
+}
+
+func (r sqlAccess) SetDisplayName(username, id, name string) error {
+	_, err := r.db.Exec(`UPDATE list_links SET display_name = ? WHERE username = ? AND list_id = ? AND NOT aliased`,
+		name, username, id)
+	return err
+}
+
+func (r sqlAccess) SetAlias(username, id, name string, aliased bool) error {
+	updated, err := sqldb.Affected(r.db.Exec(`UPDATE list_links SET display_name = ?, aliased = ? WHERE username = ? AND list_id = ?`,
+		name, aliased, username, id))
+	if err != nil {
+		return err
+	}
+	if updated != 1 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (r sqlAccess) All() ([]accessRecord, error) {
+	records := make([]accessRecord, 0, 1)
+	err := r.db.InTx(func(tx *sqldb.Tx) error {
+		rows, err := tx.Query(`SELECT username FROM users ORDER BY username`)
+		if err != nil {
+			return err
+		}
+		byUsername := make(map[string]*accessRecord)
+		for rows.Next() {
+			record := accessRecord{
+				OwnedLists:  make([]listLink, 0, 1),
+				SharedLists: make([]listLink, 0, 1),
+			}
+			if err = rows.Scan(&record.Username); err != nil {
+				_ = rows.Close()
+				return err
+			}
+			records = append(records, record)
+		}
+		_ = rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		for i := range records {
+			byUsername[records[i].Username] = &records[i]
+		}
+		rows, err = tx.Query(`SELECT username, list_id, display_name, aliased, owned FROM list_links ORDER BY linked, list_id`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var username string
+			var link listLink
+			var owned bool
+			if err = rows.Scan(&username, &link.Id, &link.DisplayName, &link.Aliased, &owned); err != nil {
+				return err
+			}
+			record := byUsername[username]
+			if owned {
+				record.OwnedLists = append(record.OwnedLists, link)
+			} else {
+				record.SharedLists = append(record.SharedLists, link)
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+const requestColumns = `id, list_id, list_name, owner, guest, created, role, former_owner_role`
+
+func scanRequest(scanner interface{ Scan(...interface{}) error }) (shareRequest, error) {
+	var req shareRequest
+	var created int64
+	err := scanner.Scan(&req.Id, &req.ListId, &req.ListName, &req.Owner, &req.Guest, &created, &req.Role, &req.FormerOwnerRole)
+	req.Created = sqldb.FromNanos(created)
+	return req, err
+}
+
+func (r sqlRequests) Insert(req shareRequest) error {
+	inserted, err := sqldb.Affected(r.db.Exec(`INSERT INTO share_requests (`+requestColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (list_id, guest) DO NOTHING`,
+		req.Id, req.ListId, req.ListName, req.Owner, req.Guest, sqldb.Nanos(req.Created), req.Role, req.FormerOwnerRole))
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return errDuplicate
+	}
+	return nil
+}
+
+func (r sqlRequests) Get(id string) (*shareRequest, error) {
+	req, err := scanRequest(r.db.QueryRow(`SELECT `+requestColumns+` FROM share_requests WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func (r sqlRequests) find(column, value string) ([]shareRequest, error) {
+	rows, err := r.db.Query(`SELECT `+requestColumns+` FROM share_requests WHERE `+column+` = ? ORDER BY created`, value)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	requests := make([]shareRequest, 0, 1)
+	for rows.Next() {
+		req, err := scanRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, req)
+	}
+	return requests, rows.Err()
+}
+
+func (r sqlRequests) ByGuest(guest string) ([]shareRequest, error) {
+	return r.find("guest", guest)
+}
+
+func (r sqlRequests) ByOwner(owner string) ([]shareRequest, error) {
+	return r.find("owner", owner)
+}
+
+func (r sqlRequests) Remove(id string) error {
+	removed, err := sqldb.Affected(r.db.Exec(`DELETE FROM share_requests WHERE id = ?`, id))
+	if err != nil {
+		return err
+	}
+	if removed != 1 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (r sqlRequests) RemoveForList(listId string) error {
+	_, err := r.db.Exec(`DELETE FROM share_requests WHERE list_id = ?`, listId)
+	return err
+}
+
+func (r sqlNotifications) Insert(n notification) error {
+	_, err := r.db.Exec(`INSERT INTO notifications (id, username, type, list_id, list_name, actor, created, read)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		n.Id, n.Username, n.Type, n.ListId, n.ListName, n.Actor, sqldb.Nanos(n.Created), n.Read)
+	return err
+}
+
+// notificationFilter selects notifications of the user, only unread ones if unreadOnly is set
+func notificationFilter(username string, unreadOnly bool) (string, []interface{}) {
+	if unreadOnly {
+		return ` WHERE username = ? AND read = ?`, []interface{}{username, false}
+	}
+	return ` WHERE username = ?`, []interface{}{username}
+}
+
+func (r sqlNotifications) Find(username string, unreadOnly bool, offset, limit int64) ([]notification, error) {
+	filter, args := notificationFilter(username, unreadOnly)
+	rows, err := r.db.Query(`SELECT id, username, type, list_id, list_name, actor, created, read FROM notifications`+
+		filter+` ORDER BY created DESC LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	notifications := make([]notification, 0, 1)
+	for rows.Next() {
+		var n notification
+		var created int64
+		err = rows.Scan(&n.Id, &n.Username, &n.Type, &n.ListId, &n.ListName, &n.Actor, &created, &n.Read)
+		if err != nil {
+			return nil, err
+		}
+		n.Created = sqldb.FromNanos(created)
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+func (r sqlNotifications) Count(username string, unreadOnly bool) (int64, error) {
+	filter, args := notificationFilter(username, unreadOnly)
+	var count int64
+	err := r.db.QueryRow(`SELECT COUNT(*) FROM notifications`+filter, args...).Scan(&count)
+	return count, err
+}
+
+func (r sqlNotifications) MarkRead(username, id string) error {
+	if id == "" {
+		_, err := r.db.Exec(`UPDATE notifications SET read = ? WHERE username = ?`, true, username)
+		return err
+	}
+	updated, err := sqldb.Affected(r.db.Exec(`UPDATE notifications SET read = ? WHERE username = ? AND id = ?`, true, username, id))
+	if err != nil {
+		return err
+	}
+	if updated != 1 {
+		return errNotificationNotFound
+	}
+	return nil
+}
+
+func (r sqlNotifications) Remove(username, id string) error {
+	removed, err := sqldb.Affected(r.db.Exec(`DELETE FROM notifications WHERE username = ? AND id = ?`, username, id))
+	if err != nil {
+		return err
+	}
+	if removed != 1 {
+		return errNotificationNotFound
+	}
+	return nil
+}
+
+func (r sqlTombstones) Insert(id string, usernames []string, removed time.Time) error {
+	return r.db.InTx(func(tx *sqldb.Tx) error {
+		// Expired tombstones are dropped here instead of by a TTL index
+		_, err := tx.Exec(`DELETE FROM tombstones WHERE removed < ?`, sqldb.Nanos(time.Now().Add(-tombstoneRetention)))
+		if err != nil {
+			return err
+		}
+		for _, username := range usernames {
+			_, err = tx.Exec(`INSERT INTO tombstones (list_id, username, removed) VALUES (?, ?, ?)`,
+				id, username, sqldb.Nanos(removed))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r sqlTombstones) Since(username string, since time.Time) ([]tombstone, error) {
+	rows, err := r.db.Query(`SELECT list_id, username, removed FROM tombstones WHERE username = ? AND removed > ?`,
+		username, sqldb.Nanos(since))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tombstones := make([]tombstone, 0, 1)
+	for rows.Next() {
+		var t tombstone
+		var removed int64
+		if err = rows.Scan(&t.ListId, &t.Username, &removed); err != nil {
+			return nil, err
+		}
+		t.Removed = sqldb.FromNanos(removed)
+		tombstones = append(tombstones, t)
+	}
+	return tombstones, rows.Err()
+}
+
+const inviteColumns = `id, token, list_id, creator, role, created, expires, max_uses, uses`
+
+func scanInvite(scanner interface{ Scan(...interface{}) error }) (invite, error) {
+	var inv invite
+	var created int64
+	var expires sql.NullInt64
+	err := scanner.Scan(&inv.Id, &inv.Token, &inv.ListId, &inv.Creator, &inv.Role, &created, &expires, &inv.MaxUses, &inv.Uses)
+	inv.Created = sqldb.FromNanos(created)
+	if expires.Valid {
+		t := sqldb.FromNanos(expires.Int64)
+		inv.Expires = &t
+	}
+	return inv, err
+}
+
+func (r sqlInvites) Insert(inv invite) error {
+	var expires sql.NullInt64
+	if inv.Expires != nil {
+		expires = sql.NullInt64{Int64: sqldb.Nanos(*inv.Expires), Valid: true}
+	}
+	return r.db.InTx(func(tx *sqldb.Tx) error {
+		// Expired invites are dropped here instead of by a TTL index
+		_, err := tx.Exec(`DELETE FROM invites WHERE expires < ?`, sqldb.Nanos(time.Now()))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO invites (`+inviteColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			inv.Id, inv.Token, inv.ListId, inv.Creator, inv.Role, sqldb.Nanos(inv.Created), expires, inv.MaxUses, inv.Uses)
+		return err
+	})
+}
+
+func (r sqlInvites) Get(token string) (*invite, error) {
+	inv, err := scanInvite(r.db.QueryRow(`SELECT `+inviteColumns+` FROM invites WHERE token = ?`, token))
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+func (r sqlInvites) ByList(listId string) ([]invite, error) {
+	rows, err := r.db.Query(`SELECT `+inviteColumns+` FROM invites WHERE list_id = ? ORDER BY created`, listId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	invites := make([]invite, 0, 1)
+	for rows.Next() {
+		inv, err := scanInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, inv)
+	}
+	return invites, rows.Err()
+}
+
+func (r sqlInvites) Use(token string) error {
+	used, err := sqldb.Affected(r.db.Exec(`UPDATE invites SET uses = uses + 1
+		WHERE token = ? AND (max_uses = 0 OR uses < max_uses)`, token))
+	if err != nil {
+		return err
+	}
+	if used != 1 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (r sqlInvites) Release(token string) error {
+	released, err := sqldb.Affected(r.db.Exec(`UPDATE invites SET uses = uses - 1 WHERE token = ? AND uses > 0`, token))
+	if err != nil {
+		return err
+	}
+	if released != 1 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (r sqlInvites) Remove(listId, id string) error {
+	removed, err := sqldb.Affected(r.db.Exec(`DELETE FROM invites WHERE list_id = ? AND id = ?`, listId, id))
+	if err != nil {
+		return err
+	}
+	if removed != 1 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (r sqlInvites) RemoveForList(listId string) error {
+	_, err := r.db.Exec(`DELETE FROM invites WHERE list_id = ?`, listId)
+	return err
+}
+
+func getSQLGroup(q sqldb.Querier, id string) (*group, error) {
+	var g group
+	var created int64
+	err := q.QueryRow(`SELECT id, name, created FROM user_groups WHERE id = ?`, id).Scan(&g.Id, &g.Name, &created)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	g.Created = sqldb.FromNanos(created)
+	rows, err := q.Query(`SELECT username, role, joined FROM group_members WHERE group_id = ? ORDER BY joined, username`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	g.Members = make([]groupMember, 0, 1)
+	for rows.Next() {
+		var member groupMember
+		var joined int64
+		if err = rows.Scan(&member.Username, &member.Role, &joined); err != nil {
+			return nil, err
+		}
+		member.Joined = sqldb.FromNanos(joined)
+		g.Members = append(g.Members, member)
+	}
+	return &g, rows.Err()
+}
+
+func (r sqlGroups) Insert(g group) error {
+	return r.db.InTx(func(tx *sqldb.Tx) error {
+		_, err := tx.Exec(`INSERT INTO user_groups (id, name, created) VALUES (?, ?, ?)`, g.Id, g.Name, sqldb.Nanos(g.Created))
+		if err != nil {
+			return err
+		}
+		for _, member := range g.Members {
+			_, err = tx.Exec(`INSERT INTO group_members (group_id, username, role, joined) VALUES (?, ?, ?, ?)`,
+				g.Id, member.Username, member.Role, sqldb.Nanos(member.Joined))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r sqlGroups) Get(id string) (*group, error) {
+	return getSQLGroup(r.db, id)
+}
+
+func (r sqlGroups) ByMember(username string) ([]group, error) {
+	groups := make([]group, 0, 1)
+	err := r.db.InTx(func(tx *sqldb.Tx) error {
+		rows, err := tx.Query(`SELECT group_id FROM group_members WHERE username = ? ORDER BY group_id`, username)
+		if err != nil {
+			return err
+		}
+		ids := make([]string, 0, 1)
+		for rows.Next() {
+			var id string
+			if err = rows.Scan(&id); err != nil {
+				_ = rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		_ = rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			g, err := getSQLGroup(tx, id)
+			if err != nil {
+				return err
+			}
+			groups = append(groups, *g)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func (r sqlGroups) AddMember(id string, member groupMember) error {
+	return r.db.InTx(func(tx *sqldb.Tx) error {
+		var exists int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM user_groups WHERE id = ?`, id).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists == 0 {
+			return errNotFound
+		}
+		inserted, err := sqldb.Affected(tx.Exec(`INSERT INTO group_members (group_id, username, role, joined)
+			VALUES (?, ?, ?, ?) ON CONFLICT (group_id, username) DO NOTHING`,
+			id, member.Username, member.Role, sqldb.Nanos(member.Joined)))
+		if err == nil && inserted == 0 {
+			err = errDuplicate
+		}
+		return err
+	})
+}
+
+func (r sqlGroups) RemoveMember(id, username string) error {
+	removed, err := sqldb.Affected(r.db.Exec(`DELETE FROM group_members WHERE group_id = ? AND username = ?`, id, username))
+	if err != nil {
+		return err
+	}
+	if removed != 1 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (r sqlGroups) SetMemberRole(id, username, role string) error {
+	updated, err := sqldb.Affected(r.db.Exec(`UPDATE group_members SET role = ? WHERE group_id = ? AND username = ?`,
+		role, id, username))
+	if err != nil {
+		return err
+	}
+	if updated != 1 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (r sqlGroups) Remove(id string) error {
+	removed, err := sqldb.Affected(r.db.Exec(`DELETE FROM user_groups WHERE id = ?`, id))
+	if err != nil {
+		return err
+	}
+	if removed != 1 {
+		return errNotFound
+	}
+	return nil
+}
+
+const revisionColumns = `list_id, version, author, created, name, items, reverted_from`
+
+func scanRevision(scanner interface{ Scan(...interface{}) error }) (revision, error) {
+	var rev revision
+	var created int64
+	var items string
+	err := scanner.Scan(&rev.ListId, &rev.Version, &rev.Author, &created, &rev.Name, &items, &rev.RevertedFrom)
+	if err != nil {
+		return rev, err
+	}
+	rev.Created = sqldb.FromNanos(created)
+	err = json.Unmarshal([]byte(items), &rev.Items)
+	return rev, err
+}
+
+func (r sqlRevisions) Insert(rev revision, keep int) error {
+	items, err := json.Marshal(rev.Items)
+	if err != nil {
+		return err
+	}
+	return r.db.InTx(func(tx *sqldb.Tx) error {
+		inserted, err := sqldb.Affected(tx.Exec(`INSERT INTO list_revisions (`+revisionColumns+`)
+			VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT (list_id, version) DO NOTHING`,
+			rev.ListId, rev.Version, rev.Author, sqldb.Nanos(rev.Created), rev.Name, string(items), rev.RevertedFrom))
+		if err != nil {
+			return err
+		}
+		if inserted == 0 {
+			return errDuplicate
+		}
+		_, err = tx.Exec(`DELETE FROM list_revisions WHERE list_id = ? AND version NOT IN
+			(SELECT version FROM list_revisions WHERE list_id = ? ORDER BY version DESC LIMIT ?)`,
+			rev.ListId, rev.ListId, keep)
+		return err
+	})
+}
+
+func (r sqlRevisions) Get(listId string, version int64) (*revision, error) {
+	rev, err := scanRevision(r.db.QueryRow(`SELECT `+revisionColumns+` FROM list_revisions
+		WHERE list_id = ? AND version = ?`, listId, version))
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rev, nil
+}
+
+func (r sqlRevisions) ByList(listId string) ([]revision, error) {
+	rows, err := r.db.Query(`SELECT `+revisionColumns+` FROM list_revisions WHERE list_id = ? ORDER BY version DESC`, listId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	revisions := make([]revision, 0, 1)
+	for rows.Next() {
+		rev, err := scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+func (r sqlRevisions) RemoveForList(listId string) error {
+	_, err := r.db.Exec(`DELETE FROM list_revisions WHERE list_id = ?`, listId)
+	return err
+}
+
+func (r sqlItemOps) Insert(listId string, ops []itemOp, keep int) error {
+	return r.db.InTx(func(tx *sqldb.Tx) error {
+		for _, op := range ops {
+			fields, err := json.Marshal(op.Fields)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`INSERT INTO item_ops (list_id, client_id, clock, kind, item_id, fields, author, received)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (list_id, client_id, clock) DO NOTHING`,
+				listId, op.ClientId, op.Clock, op.Kind, op.ItemId, string(fields), op.Author, sqldb.Nanos(op.Received))
+			if err != nil {
+				return err
+			}
+		}
+		var oldest stamp
+		err := tx.QueryRow(`SELECT clock, client_id FROM item_ops WHERE list_id = ?
+			ORDER BY clock DESC, client_id DESC LIMIT 1 OFFSET ?`, listId, keep-1).Scan(&oldest.Clock, &oldest.ClientId)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// Operations with the same clock as the oldest kept one are ordered by the client id, as their stamps are
+		_, err = tx.Exec(`DELETE FROM item_ops WHERE list_id = ? AND (clock < ? OR clock = ? AND client_id < ?)`,
+			listId, oldest.Clock, oldest.Clock, oldest.ClientId)
+		return err
+	})
+}
+
+func (r sqlItemOps) Since(listId string, since int64) ([]itemOp, error) {
+	rows, err := r.db.Query(`SELECT client_id, clock, kind, item_id, fields, author, received FROM item_ops
+		WHERE list_id = ? AND clock > ? ORDER BY clock, client_id`, listId, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ops := make([]itemOp, 0)
+	for rows.Next() {
+		op := itemOp{ListId: listId}
+		var fields string
+		var received int64
+		err = rows.Scan(&op.ClientId, &op.Clock, &op.Kind, &op.ItemId, &fields, &op.Author, &received)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(fields), &op.Fields); err != nil {
+			return nil, err
+		}
+		op.Received = sqldb.FromNanos(received)
+		ops = append(ops, op)
+	}
+	return ops, rows.Err()
+}
+
+func (r sqlItemOps) RemoveForList(listId string) error {
+	_, err := r.db.Exec(`DELETE FROM item_ops WHERE list_id = ?`, listId)
+	return err
+}
@@ -0,0 +1,169 @@
+package logic
+
+import (
+	"errors"
+	"time"
+)
+
+var errNotFound = errors.New("not found")
+var errDuplicate = errors.New("already exists")
+
+// listRepository stores lists. Modifications bump the list version and return the new one.
+// They are applied only if the list is in the given version unless it is anyVersion,
+// and return errVersionMismatch if the list or the item to modify doesn't match.
+// Lists in the trash are neither returned nor modified, except by the methods dealing with the trash and Remove.
+type listRepository interface {
+	Get(id string) (*list, error)
+	Insert(listRec list) error
+	Remove(id string, version int64) error
+	SetItems(id string, items []item, version int64) (int64, error)
+	PushItem(id string, it item, version int64) (int64, error)
+	// UpdateItem sets the fields of changes and stamps them with st
+	UpdateItem(id, itemId string, changes itemChanges, st stamp, version int64) (int64, error)
+	PullItem(id, itemId string, version int64) (int64, error)
+	Rename(id, name string, version int64) (int64, error)
+	// AddGuest adds the guest with the role or returns errDuplicate if they are a guest already.
+	// RemoveGuest removes the guest with their role.
+	AddGuest(id, username, role string) error
+	RemoveGuest(id, username string) error
+	// SetRole changes the role of the guest, it returns errNotFound if the list has no such guest
+	SetRole(id, username, role string) error
+	SetOwner(id, owner string) error
+	// SetPublicToken replaces the public token of the list, an empty one makes the list private.
+	// It doesn't change the version, the token is not part of the list content.
+	SetPublicToken(id, token string) error
+	// ByPublicToken returns the list with the public token
+	ByPublicToken(token string) (*list, error)
+	// AddGroup shares the list with the group or returns errDuplicate if it is shared with it already.
+	// RemoveGroup returns errNotFound if the list is not shared with the group.
+	AddGroup(id string, share groupShare) error
+	RemoveGroup(id, groupId string) error
+	// ByGroup returns lists shared with the group
+	ByGroup(groupId string) ([]list, error)
+	// ChangedSince returns lists among ids changed after since
+	ChangedSince(ids []string, since time.Time) ([]list, error)
+	All() ([]list, error)
+	// Trash moves the list to the trash of its owner, marking when it was deleted.
+	// Restore takes the list out of the trash, it returns errNotFound if the list is not there.
+	Trash(id string, deleted time.Time, version int64) (int64, error)
+	Restore(id string) (int64, error)
+	// Trashed returns lists in the trash of the owner, the most recently deleted first
+	Trashed(owner string) ([]list, error)
+	// TrashedBefore returns lists moved to the trash before the time
+	TrashedBefore(before time.Time) ([]list, error)
+}
+
+// accessRepository stores links to lists owned by and shared with each user.
+// A user has at most one link to a list, adding another one returns errDuplicate.
+type accessRepository interface {
+	Get(username string) (*accessRecord, error)
+	Insert(record accessRecord) error
+	AddOwned(username string, link listLink) error
+	AddShared(username string, link listLink) error
+	// RemoveOwned and RemoveShared succeed if the user has no such link.
+	// They return errNotFound if the user has no access record.
+	RemoveOwned(username, id string) error
+	RemoveShared(username, id string) error
+	// SetDisplayName renames the link of the user to the list unless it has an alias
+	SetDisplayName(username, id, name string) error
+	// SetAlias renames the link of the user to the list and marks whether the name is an alias.
+	// It returns errNotFound if the user has no link to the list.
+	SetAlias(username, id, name string, aliased bool) error
+	All() ([]accessRecord, error)
+}
+
+// requestRepository stores pending share requests, at most one per list and guest.
+// Insert returns errDuplicate if the guest has a request for the list already,
+// Remove returns errNotFound if there is no such request.
+type requestRepository interface {
+	Insert(req shareRequest) error
+	Get(id string) (*shareRequest, error)
+	ByGuest(guest string) ([]shareRequest, error)
+	ByOwner(owner string) ([]shareRequest, error)
+	Remove(id string) error
+	RemoveForList(listId string) error
+}
+
+// notificationRepository stores notifications, Find returns them newest first
+type notificationRepository interface {
+	Insert(n notification) error
+	Find(username string, unreadOnly bool, offset, limit int64) ([]notification, error)
+	Count(username string, unreadOnly bool) (int64, error)
+	// MarkRead marks the notification as read, or all notifications of the user if id is empty
+	MarkRead(username, id string) error
+	Remove(username, id string) error
+}
+
+// tombstoneRepository stores tombstones for tombstoneRetention at least
+type tombstoneRepository interface {
+	Insert(id string, usernames []string, removed time.Time) error
+	Since(username string, since time.Time) ([]tombstone, error)
+}
+
+// inviteRepository stores invite links of lists
+type inviteRepository interface {
+	Insert(inv invite) error
+	// Get returns the invite with the token
+	Get(token string) (*invite, error)
+	ByList(listId string) ([]invite, error)
+	// Use counts a use of the invite, it returns errNotFound if the invite has reached its max uses
+	Use(token string) error
+	// Release gives back a use of the invite, it returns errNotFound if the invite has no uses
+	Release(token string) error
+	Remove(listId, id string) error
+	RemoveForList(listId string) error
+}
+
+// revisionRepository stores revisions of lists, ByList returns them newest first
+type revisionRepository interface {
+	// Insert stores the revision and drops the oldest revisions of the list beyond keep.
+	// It returns errDuplicate if the list has a revision with the version already.
+	Insert(rev revision, keep int) error
+	Get(listId string, version int64) (*revision, error)
+	ByList(listId string) ([]revision, error)
+	RemoveForList(listId string) error
+}
+
+// itemOpRepository stores operations on items merged into lists, Since returns them in the order of their stamps
+type itemOpRepository interface {
+	// Insert stores the operations on the list, skipping those stored already,
+	// and drops the oldest operations of the list in the order of their stamps, so at most keep are left
+	Insert(listId string, ops []itemOp, keep int) error
+	// Since returns operations on the list with a clock greater than since
+	Since(listId string, since int64) ([]itemOp, error)
+	RemoveForList(listId string) error
+}
+
+// groupRepository stores groups of users with their members
+type groupRepository interface {
+	Insert(g group) error
+	Get(id string) (*group, error)
+	// ByMember returns groups the user is a member of
+	ByMember(username string) ([]group, error)
+	// AddMember returns errDuplicate if the user is a member of the group already.
+	// RemoveMember and SetMemberRole return errNotFound if the group has no such member.
+	AddMember(id string, member groupMember) error
+	RemoveMember(id, username string) error
+	SetMemberRole(id, username, role string) error
+	Remove(id string) error
+}
+
+// transactor runs f with repositories bound to a transaction, which is committed if f returns nil
+type transactor interface {
+	inTransaction(f func(tx *Storage) error) error
+}
+
+// Storage holds the repositories used by the service.
+// transactions is nil if the storage can't run writes to several repositories atomically.
+type Storage struct {
+	lists         listRepository
+	access        accessRepository
+	requests      requestRepository
+	notifications notificationRepository
+	tombstones    tombstoneRepository
+	invites       inviteRepository
+	groups        groupRepository
+	revisions     revisionRepository
+	itemOps       itemOpRepository
+	transactions  transactor
+}
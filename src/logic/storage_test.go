@@ -0,0 +1,130 @@
+package logic
+
+import (
+	"shoppinglist-server/src/sqldb"
+	"testing"
+	"time"
+)
+
+// testStorages returns every storage which runs without a server, so repositories can be checked against each other
+func testStorages(t *testing.T) map[string]*Storage {
+	db, err := sqldb.Open(sqldb.SQLite, ":memory:", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	return map[string]*Storage{
+		"memory": NewMemoryStorage(),
+		"sqlite": NewSQLStorage(db),
+	}
+}
+
+func TestRemoveLinks(t *testing.T) {
+	for name, storage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, username := range []string{"katya", "vasya"} {
+				err := storage.access.Insert(accessRecord{Username: username})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, listRec := range []list{{Id: "groceries", Owner: "katya"}, {Id: "party", Owner: "vasya", Guests: []string{"katya"}}} {
+				if err := storage.lists.Insert(listRec); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := storage.access.AddOwned("katya", listLink{Id: "groceries", DisplayName: "Groceries"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = storage.access.AddShared("katya", listLink{Id: "party", DisplayName: "Party"}); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				if err = storage.access.RemoveOwned("katya", "groceries"); err != nil {
+					t.Errorf("removing an owned link returned %v", err)
+				}
+				if err = storage.access.RemoveShared("katya", "party"); err != nil {
+					t.Errorf("removing a shared link returned %v", err)
+				}
+			}
+			record, err := storage.access.Get("katya")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(record.OwnedLists) != 0 || len(record.SharedLists) != 0 {
+				t.Errorf("links are left: %+v", record)
+			}
+			if err = storage.access.RemoveOwned("nobody", "groceries"); err != errNotFound {
+				t.Errorf("removing an owned link of an unknown user returned %v", err)
+			}
+			if err = storage.access.RemoveShared("nobody", "party"); err != errNotFound {
+				t.Errorf("removing a shared link of an unknown user returned %v", err)
+			}
+		})
+	}
+}
+
+func TestUpdateItemStampsChanges(t *testing.T) {
+	for name, storage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := storage.access.Insert(accessRecord{Username: "katya"}); err != nil {
+				t.Fatal(err)
+			}
+			added := stamp{Clock: 1, ClientId: "phone"}
+			it := newItem("Milk", 0)
+			it.Stamps.stampAll(added)
+			if err := storage.lists.Insert(list{Id: "groceries", Owner: "katya", Items: []item{it}, Version: 1}); err != nil {
+				t.Fatal(err)
+			}
+			edited := stamp{Clock: 2, ClientId: serverClient}
+			_, err := storage.lists.UpdateItem("groceries", it.Id, itemChanges{Checked: boolField(true)}, edited, anyVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			listRec, err := storage.lists.Get("groceries")
+			if err != nil {
+				t.Fatal(err)
+			}
+			stamps := listRec.Items[0].Stamps
+			if stamps.Checked != edited || stamps.Name != added || !listRec.Items[0].Checked {
+				t.Errorf("got item %+v", listRec.Items[0])
+			}
+		})
+	}
+}
+
+func TestItemOpsKeepLatest(t *testing.T) {
+	for name, storage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := storage.access.Insert(accessRecord{Username: "katya"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.lists.Insert(list{Id: "groceries", Owner: "katya"}); err != nil {
+				t.Fatal(err)
+			}
+			ops := make([]itemOp, 0)
+			for _, st := range []stamp{{1, "phone"}, {2, "laptop"}, {2, "phone"}, {2, "tablet"}, {3, "phone"}} {
+				ops = append(ops, itemOp{ClientId: st.ClientId, Clock: st.Clock, Kind: opRemove, ItemId: "milk"})
+			}
+			if err := storage.itemOps.Insert("groceries", ops, 3); err != nil {
+				t.Fatal(err)
+			}
+			kept, err := storage.itemOps.Since("groceries", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []stamp{{2, "phone"}, {2, "tablet"}, {3, "phone"}}
+			if len(kept) != len(want) {
+				t.Fatalf("got operations %+v", kept)
+			}
+			for i := range want {
+				if kept[i].stamp() != want[i] {
+					t.Errorf("got operation %+v, want %+v", kept[i], want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package logic
+
+import (
+	"errors"
+	"time"
+)
+
+// tombstoneRetention is how long removals are remembered, older cursors need a full resync
+const tombstoneRetention = 30 * 24 * time.Hour
+
+// syncOverlap moves the returned cursor back to catch writes that were in flight during the sync,
+// so the same change may be reported twice
+const syncOverlap = 2 * time.Second
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// tombstone records that a user has lost access to a list, because it was deleted or unlinked
+type tombstone struct {
+	ListId   string    `bson:"list_id" json:"id"`
+	Username string    `bson:"username" json:"-"`
+	Removed  time.Time `bson:"removed" json:"removed"`
+}
+
+type syncEntry struct {
+	DisplayName string `json:"display_name"`
+	Owned       bool   `json:"owned"`
+	// Group is set for lists the user sees only as a member of the group
+	Group string `json:"group,omitempty"`
+	List  *list  `json:"list"`
+}
+
+type syncResp struct {
+	Cursor string `json:"cursor"`
+	// Reset is set when all lists are returned and the client should drop the ones it doesn't see
+	Reset   bool        `json:"reset"`
+	Changed []syncEntry `json:"changed"`
+	Removed []string    `json:"removed"`
+}
+
+func formatCursor(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseCursor(cursor string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, cursor)
+	if err != nil {
+		return time.Time{}, errInvalidCursor
+	}
+	return t, nil
+}
+
+// removeAccessTracked records tombstones for users that have lost access to the list
+func (s *Service) removeAccessTracked(id string, usernames ...string) error {
+	return s.tombstones.Insert(id, usernames, time.Now())
+}
+
+// syncChanges returns lists of the user changed since cursor, everything if cursor is empty or too old
+func (s *Service) syncChanges(username, cursor string) (*syncResp, error) {
+	started := time.Now()
+	since := time.Time{}
+	reset := true
+	if cursor != "" {
+		var err error
+		since, err = parseCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		reset = started.Sub(since) > tombstoneRetention
+		if reset {
+			since = time.Time{}
+		}
+	}
+	accessRec, err := s.access.Get(username)
+	if err != nil {
+		return nil, err
+	}
+	count := len(accessRec.OwnedLists) + len(accessRec.SharedLists)
+	links := make(map[string]syncEntry, count)
+	ids := make([]string, 0, count)
+	for _, listLn := range accessRec.OwnedLists {
+		links[listLn.Id] = syncEntry{DisplayName: listLn.DisplayName, Owned: true}
+		ids = append(ids, listLn.Id)
+	}
+	for _, listLn := range accessRec.SharedLists {
+		links[listLn.Id] = syncEntry{DisplayName: listLn.DisplayName}
+		ids = append(ids, listLn.Id)
+	}
+	lists, err := s.lists.ChangedSince(ids, since)
+	if err != nil {
+		return nil, err
+	}
+	groupLists, err := s.changedGroupLists(username, since, links)
+	if err != nil {
+		return nil, err
+	}
+	lists = append(lists, groupLists...)
+	resp := &syncResp{
+		Cursor:  formatCursor(started.Add(-syncOverlap)),
+		Reset:   reset,
+		Changed: make([]syncEntry, 0, len(lists)),
+		Removed: make([]string, 0),
+	}
+	for i := range lists {
+		listRec := &lists[i]
+		if isLegacyList(listRec) {
+			listRec, err = s.loadList(listRec.Id)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			presentList(listRec)
+		}
+		entry := links[listRec.Id]
+		entry.List = listRec
+		resp.Changed = append(resp.Changed, entry)
+	}
+	if reset {
+		return resp, nil
+	}
+	tombstones, err := s.tombstones.Since(username, since)
+	if err != nil {
+		return nil, err
+	}
+	removed := make(map[string]bool, len(tombstones))
+	for _, t := range tombstones {
+		// The list could have been shared with the user again after removal
+		if _, ok := links[t.ListId]; !ok && !removed[t.ListId] {
+			removed[t.ListId] = true
+			resp.Removed = append(resp.Removed, t.ListId)
+		}
+	}
+	return resp, nil
+}
+
+// changedGroupLists returns lists the user sees through groups which have changed since,
+// or which the user has gained access to since then, and adds entries for all of them to links
+func (s *Service) changedGroupLists(username string, since time.Time, links map[string]syncEntry) ([]list, error) {
+	groups, err := s.groups.ByMember(username)
+	if err != nil {
+		return nil, err
+	}
+	changed := make([]list, 0)
+	for _, g := range groups {
+		joined := g.member(username).Joined
+		lists, err := s.lists.ByGroup(g.Id)
+		if err != nil {
+			return nil, err
+		}
+		for _, listRec := range lists {
+			if _, ok := links[listRec.Id]; ok {
+				continue
+			}
+			links[listRec.Id] = syncEntry{DisplayName: listRec.OriginalName, Group: g.Id}
+			if listRec.LastChanged.After(since) || joined.After(since) {
+				changed = append(changed, listRec)
+			}
+		}
+	}
+	return changed, nil
+}
@@ -0,0 +1,178 @@
+package logic
+
+import (
+	"errors"
+	"github.com/segmentio/ksuid"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+var errAlreadyOwner = errors.New("user already owns the list")
+
+// requestTransfer asks newOwner to take over the list of owner.
+// After the transfer owner stays a guest with formerOwnerRole, or leaves the list if it is empty.
+func (s *Service) requestTransfer(owner, newOwner, id, formerOwnerRole string) (string, error) {
+	if formerOwnerRole != "" && !validGuestRole(formerOwnerRole) {
+		return "", errInvalidRole
+	}
+	listRec, err := s.lists.Get(id)
+	if err == errNotFound {
+		return "", errNotOwner
+	}
+	if err != nil {
+		return "", err
+	}
+	if listRec.Owner != owner {
+		return "", errNotOwner
+	}
+	if newOwner == owner {
+		return "", errAlreadyOwner
+	}
+	if err = s.checkInvitee(listRec, newOwner); err != nil {
+		return "", err
+	}
+	req := shareRequest{
+		Id:              ksuid.New().String(),
+		ListId:          id,
+		ListName:        listRec.OriginalName,
+		Owner:           owner,
+		Guest:           newOwner,
+		Role:            roleOwner,
+		FormerOwnerRole: formerOwnerRole,
+		Created:         time.Now(),
+	}
+	err = s.requests.Insert(req)
+	if err == errDuplicate {
+		return "", errAlreadyRequested
+	}
+	if err != nil {
+		return "", err
+	}
+	s.notify([]string{newOwner}, notificationTransferRequested, owner, id, listRec.OriginalName)
+	return req.Id, nil
+}
+
+// transferOwnership makes newOwner the owner of the list, if owner still owns it.
+// newOwner stops being a guest, owner becomes one with formerOwnerRole unless it is empty.
+func (s *Service) transferOwnership(owner, newOwner, id, formerOwnerRole string) error {
+	listRec, err := s.lists.Get(id)
+	if err == errNotFound {
+		return errNoPermission
+	}
+	if err != nil {
+		return err
+	}
+	if listRec.Owner == newOwner {
+		return errAlreadyOwner
+	}
+	if listRec.Owner != owner {
+		return errNoPermission
+	}
+	ownerAccess, err := s.access.Get(owner)
+	if err != nil {
+		return err
+	}
+	newOwnerAccess, err := s.access.Get(newOwner)
+	if err != nil {
+		return err
+	}
+	// Both keep the names they know the list by
+	ownerLink := listLink{Id: id, DisplayName: listRec.OriginalName}
+	if link := findLink(ownerAccess.OwnedLists, id); link != nil {
+		ownerLink = *link
+	}
+	newOwnerLink := listLink{Id: id, DisplayName: listRec.OriginalName}
+	sharedLink := findLink(newOwnerAccess.SharedLists, id)
+	if sharedLink != nil {
+		newOwnerLink = *sharedLink
+	}
+	wasGuest := hasGuest(listRec, newOwner)
+	guestRole := listRec.roleOf(newOwner)
+	err = s.atomically(func(st *Storage, sg *saga) error {
+		if sharedLink != nil {
+			err := sg.step(func() error {
+				return st.access.RemoveShared(newOwner, id)
+			}, func() error {
+				return st.access.AddShared(newOwner, *sharedLink)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if wasGuest {
+			err := sg.step(func() error {
+				return st.lists.RemoveGuest(id, newOwner)
+			}, func() error {
+				return st.lists.AddGuest(id, newOwner, guestRole)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		err := sg.step(func() error {
+			return st.access.RemoveOwned(owner, id)
+		}, func() error {
+			return st.access.AddOwned(owner, ownerLink)
+		})
+		if err != nil {
+			return err
+		}
+		err = sg.step(func() error {
+			return st.lists.SetOwner(id, newOwner)
+		}, func() error {
+			return st.lists.SetOwner(id, owner)
+		})
+		if err != nil {
+			return err
+		}
+		err = sg.step(func() error {
+			return st.access.AddOwned(newOwner, newOwnerLink)
+		}, func() error {
+			return st.access.RemoveOwned(newOwner, id)
+		})
+		if err != nil || formerOwnerRole == "" {
+			return err
+		}
+		err = sg.step(func() error {
+			return st.lists.AddGuest(id, owner, formerOwnerRole)
+		}, func() error {
+			return st.lists.RemoveGuest(id, owner)
+		})
+		if err != nil {
+			return err
+		}
+		return sg.step(func() error {
+			return st.access.AddShared(owner, ownerLink)
+		}, nil)
+	})
+	if err != nil {
+		return err
+	}
+	members := append(listMembers(listRec), s.groupMembers(listRec)...)
+	if formerOwnerRole == "" {
+		if err = s.removeAccessTracked(id, owner); err != nil {
+			log.Error("Failed to record removal of ", id, " for ", owner, ": ", err)
+		}
+	}
+	if !wasGuest {
+		members = append(members, newOwner)
+	}
+	guests := make([]string, 0, len(listRec.Guests))
+	for _, guest := range listRec.Guests {
+		if guest != newOwner {
+			guests = append(guests, guest)
+		}
+	}
+	s.notify(guests, notificationOwnerChanged, newOwner, id, listRec.OriginalName)
+	if updated, err := s.lists.Get(id); err == nil {
+		s.events.Publish(ListEvent{
+			Type:    eventOwnerChanged,
+			ListId:  id,
+			Actor:   newOwner,
+			Version: updated.Version,
+			Time:    time.Now(),
+			Members: members,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package logic
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+var errNotInTrash = errors.New("list is not in the trash")
+
+// trashedList is a list in the trash as its owner sees it
+type trashedList struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	ItemCount int       `json:"item_count"`
+	Deleted   time.Time `json:"deleted"`
+	// Purge is when the list will be removed for good
+	Purge time.Time `json:"purge"`
+}
+
+// expired reports whether the list has been in the trash for longer than it can be restored
+func (s *Service) expired(listRec *list, now time.Time) bool {
+	return !now.Before(listRec.Deleted.Add(s.trashRetention))
+}
+
+// userTrash returns lists in the trash of the user which can still be restored
+func (s *Service) userTrash(username string) ([]trashedList, error) {
+	lists, err := s.lists.Trashed(username)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	trash := make([]trashedList, 0, len(lists))
+	for i := range lists {
+		listRec := &lists[i]
+		if s.expired(listRec, now) {
+			continue
+		}
+		trash = append(trash, trashedList{
+			Id:        listRec.Id,
+			Name:      listRec.OriginalName,
+			ItemCount: len(listRec.Items),
+			Deleted:   *listRec.Deleted,
+			Purge:     listRec.Deleted.Add(s.trashRetention),
+		})
+	}
+	return trash, nil
+}
+
+// restoreList takes the list out of the trash of the user and gives the owner and guests their links back.
+// Links are named after the list, aliases guests had before the list was deleted are not kept.
+func (s *Service) restoreList(username, id string) (int64, error) {
+	lists, err := s.lists.Trashed(username)
+	if err != nil {
+		return 0, err
+	}
+	var listRec *list
+	for i := range lists {
+		if lists[i].Id == id {
+			listRec = &lists[i]
+		}
+	}
+	if listRec == nil || s.expired(listRec, time.Now()) {
+		return 0, errNotInTrash
+	}
+	// Guests whose accounts are gone get no link and are removed from the list once it is restored
+	guests := make([]string, 0, len(listRec.Guests))
+	gone := make([]string, 0)
+	for _, guest := range listRec.Guests {
+		_, err = s.access.Get(guest)
+		if err == errNotFound {
+			gone = append(gone, guest)
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		guests = append(guests, guest)
+	}
+	link := listLink{Id: id, DisplayName: listRec.OriginalName}
+	var newVersion int64
+	err = s.atomically(func(st *Storage, sg *saga) error {
+		err := linkStep(sg, func() error {
+			return st.access.AddOwned(listRec.Owner, link)
+		}, func() error {
+			return st.access.RemoveOwned(listRec.Owner, id)
+		})
+		if err != nil {
+			return err
+		}
+		for _, guest := range guests {
+			guest := guest
+			err = linkStep(sg, func() error {
+				return st.access.AddShared(guest, link)
+			}, func() error {
+				return st.access.RemoveShared(guest, id)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		// The list is restored last, so the links are removed again if it has been restored or purged meanwhile
+		return sg.step(func() error {
+			newVersion, err = st.lists.Restore(id)
+			return err
+		}, nil)
+	})
+	if err == errNotFound {
+		return 0, errNotInTrash
+	}
+	if err != nil {
+		return 0, err
+	}
+	for _, guest := range gone {
+		if err = s.lists.RemoveGuest(id, guest); err != nil {
+			log.Error("Failed to remove guest ", guest, " without an account from ", id, ": ", err)
+		}
+	}
+	if len(gone) > 0 {
+		if restored, err := s.lists.Get(id); err == nil {
+			newVersion = restored.Version
+		}
+	}
+	s.notify(guests, notificationListRestored, username, id, listRec.OriginalName)
+	s.publishListEvent(eventListRestored, username, listRec, newVersion)
+	return newVersion, nil
+}
+
+// linkStep adds a link in the saga. A link the user has already, for example after joining again by an invite,
+// is left as it is and kept on rollback.
+func linkStep(sg *saga, add, remove func() error) error {
+	err := sg.step(add, remove)
+	if err == errDuplicate {
+		return nil
+	}
+	return err
+}
+
+// purgeTrash removes lists which have been in the trash for longer than the retention,
+// with their invites, history and operations
+func (s *Service) purgeTrash() (int, error) {
+	lists, err := s.lists.TrashedBefore(time.Now().Add(-s.trashRetention))
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, listRec := range lists {
+		listRec := listRec
+		// Nothing here can be undone, without transactions the list stays removed if removing the rest fails
+		err = s.atomically(func(st *Storage, sg *saga) error {
+			// A list restored meanwhile has a newer version and is kept
+			if err := st.lists.Remove(listRec.Id, listRec.Version); err != nil {
+				return err
+			}
+			if err := st.invites.RemoveForList(listRec.Id); err != nil {
+				return err
+			}
+			if err := st.revisions.RemoveForList(listRec.Id); err != nil {
+				return err
+			}
+			return st.itemOps.RemoveForList(listRec.Id)
+		})
+		if err == errVersionMismatch {
+			continue
+		}
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// PurgeTrashPeriodically purges the trash right away and then every interval, it never returns
+func (s *Service) PurgeTrashPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		purged, err := s.purgeTrash()
+		if err != nil {
+			log.Error("Failed to purge the trash: ", err)
+		} else if purged > 0 {
+			log.Info("Purged ", purged, " lists from the trash")
+		}
+		<-ticker.C
+	}
+}
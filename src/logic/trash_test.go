@@ -0,0 +1,119 @@
+package logic
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// deleteTestList moves the list of the owner to the trash
+func deleteTestList(t *testing.T, s *Service, owner, id string) {
+	t.Helper()
+	version := getTestList(t, s, owner, id).Version
+	w := serve(s.HandleDeleteList, owner, "POST", "/v1/list/delete?id="+id, "", "If-Match", strconv.Quote(strconv.FormatInt(version, 10)))
+	expectStatus(t, w, http.StatusOK)
+}
+
+func TestRestoreList(t *testing.T) {
+	s := newTestService(t, "katya", "vasya")
+	id := createTestList(t, s, "katya", `{"name":"Groceries","content":"Milk\nBread"}`)
+	shareTestList(t, s, "katya", "vasya", id, roleEditor)
+	deleteTestList(t, s, "katya", id)
+
+	var trash []trashedList
+	decode(t, serve(s.HandleGetTrash, "katya", "GET", "/v1/lists/trash", ""), &trash)
+	if len(trash) != 1 || trash[0].Id != id || trash[0].Name != "Groceries" || trash[0].ItemCount != 2 {
+		t.Fatalf("got trash %+v", trash)
+	}
+	decode(t, serve(s.HandleGetTrash, "vasya", "GET", "/v1/lists/trash", ""), &trash)
+	if len(trash) != 0 {
+		t.Errorf("guest sees the trash of the owner: %+v", trash)
+	}
+	w := serve(s.HandleRestoreList, "vasya", "POST", "/v1/list/restore?id="+id, "")
+	expectStatus(t, w, http.StatusNotFound)
+
+	w = serve(s.HandleRestoreList, "katya", "POST", "/v1/list/restore?id="+id, "")
+	expectStatus(t, w, http.StatusOK)
+	listRec := getTestList(t, s, "vasya", id)
+	if w.Header().Get("ETag") != strconv.Quote(strconv.FormatInt(listRec.Version, 10)) {
+		t.Errorf("got ETag %s for version %d", w.Header().Get("ETag"), listRec.Version)
+	}
+	var owned, shared []listLink
+	decode(t, serve(s.HandleGetOwnedLists, "katya", "GET", "/v1/lists/owned", ""), &owned)
+	decode(t, serve(s.HandleGetSharedLists, "vasya", "GET", "/v1/lists/shared", ""), &shared)
+	if len(owned) != 1 || len(shared) != 1 || shared[0].Id != id {
+		t.Errorf("links are not restored: owned %+v, shared %+v", owned, shared)
+	}
+	decode(t, serve(s.HandleGetTrash, "katya", "GET", "/v1/lists/trash", ""), &trash)
+	if len(trash) != 0 {
+		t.Errorf("restored list is still in the trash: %+v", trash)
+	}
+	w = serve(s.HandleRestoreList, "katya", "POST", "/v1/list/restore?id="+id, "")
+	expectStatus(t, w, http.StatusNotFound)
+}
+
+func TestRestoreListKeepsExistingLinks(t *testing.T) {
+	s := newTestService(t, "katya", "vasya")
+	id := createTestList(t, s, "katya", `{"name":"Groceries"}`)
+	shareTestList(t, s, "katya", "vasya", id, roleEditor)
+	deleteTestList(t, s, "katya", id)
+	err := s.access.AddShared("vasya", listLink{Id: id, DisplayName: "Our groceries", Aliased: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(s.HandleRestoreList, "katya", "POST", "/v1/list/restore?id="+id, "")
+	expectStatus(t, w, http.StatusOK)
+	var shared []listLink
+	decode(t, serve(s.HandleGetSharedLists, "vasya", "GET", "/v1/lists/shared", ""), &shared)
+	if len(shared) != 1 || shared[0].DisplayName != "Our groceries" {
+		t.Errorf("got shared lists %+v", shared)
+	}
+}
+
+func TestRestoreListSkipsGuestsWithoutAccounts(t *testing.T) {
+	s := newTestService(t, "katya", "vasya", "masha")
+	id := createTestList(t, s, "katya", `{"name":"Groceries"}`)
+	shareTestList(t, s, "katya", "vasya", id, roleEditor)
+	shareTestList(t, s, "katya", "masha", id, roleViewer)
+	deleteTestList(t, s, "katya", id)
+	delete(s.access.(*memoryAccess).records, "vasya")
+
+	w := serve(s.HandleRestoreList, "katya", "POST", "/v1/list/restore?id="+id, "")
+	expectStatus(t, w, http.StatusOK)
+	listRec := getTestList(t, s, "katya", id)
+	if len(listRec.Guests) != 1 || listRec.Guests[0] != "masha" {
+		t.Errorf("got guests %v, want masha", listRec.Guests)
+	}
+	if etag := strconv.Quote(strconv.FormatInt(listRec.Version, 10)); w.Header().Get("ETag") != etag {
+		t.Errorf("got ETag %s, want %s", w.Header().Get("ETag"), etag)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	s := newTestService(t, "katya")
+	kept := createTestList(t, s, "katya", `{"name":"Groceries"}`)
+	purged := createTestList(t, s, "katya", `{"name":"Party","content":"Cake"}`)
+	deleteTestList(t, s, "katya", purged)
+	s.trashRetention = 0
+
+	var trash []trashedList
+	decode(t, serve(s.HandleGetTrash, "katya", "GET", "/v1/lists/trash", ""), &trash)
+	if len(trash) != 0 {
+		t.Errorf("expired list is in the trash: %+v", trash)
+	}
+	w := serve(s.HandleRestoreList, "katya", "POST", "/v1/list/restore?id="+purged, "")
+	expectStatus(t, w, http.StatusNotFound)
+
+	count, err := s.purgeTrash()
+	if err != nil || count != 1 {
+		t.Fatalf("purged %d lists with error %v, want 1", count, err)
+	}
+	if _, err = s.lists.Get(purged); err != errNotFound {
+		t.Errorf("purged list is still stored, got error %v", err)
+	}
+	if revisions, _ := s.revisions.ByList(purged); len(revisions) != 0 {
+		t.Errorf("history of the purged list is kept: %+v", revisions)
+	}
+	getTestList(t, s, "katya", kept)
+}
@@ -4,55 +4,120 @@ import (
 	"github.com/auth0/go-jwt-middleware"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
 	"github.com/urfave/negroni"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"shoppinglist-server/src/auth"
+	"shoppinglist-server/src/config"
 	"shoppinglist-server/src/credentials"
 	"shoppinglist-server/src/logic"
+	"shoppinglist-server/src/sqldb"
 	"shoppinglist-server/src/utils"
-	"strings"
 )
 
-func handlerPlaceholder(w http.ResponseWriter, _ *http.Request) {
-	_, _ = w.Write([]byte("Placeholder"))
-}
-
-func readEnv() string {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = ":8080"
-	}
-	if !strings.HasPrefix(port, ":") {
-		port = ":" + port
-	}
-	return port
-}
-
 func main() {
-	port := readEnv()
-	secretKey := []byte("SECRET KEY WILL BE HERE")
-
-	credChecker, err := credentials.NewMongoDBCredentials("mongodb://localhost:27017", "shoppinglist", "users")
+	cfg, err := config.Load(os.Args[1:])
 	if err != nil {
-		log.Panicln(err)
+		log.Fatalln("Invalid configuration:", err)
 	}
-	log.Println("Connected to the database")
-	err = logic.InitDB("mongodb://localhost:27017", "shoppinglist", "access", "lists")
+	level, err := logrus.ParseLevel(cfg.LogLevel)
 	if err != nil {
-		log.Panicln(err)
+		log.Fatalln("Invalid configuration:", err)
+	}
+	logrus.SetLevel(level)
+	secretKey, err := cfg.SecretKey()
+	if err != nil {
+		log.Fatalln("Invalid configuration:", err)
+	}
+	sameSite, _ := cfg.SameSite()
+	cookie := auth.CookieOptions{
+		Domain:   cfg.Cookie.Domain,
+		Secure:   cfg.Cookie.Secure,
+		SameSite: sameSite,
 	}
 
+	var credChecker credentials.CredController
+	var storage *logic.Storage
+	var tokenStore auth.TokenStore
+	switch cfg.Storage {
+	case config.StorageMemory:
+		log.Println("Using in-memory storage, all data will be lost on exit")
+		credChecker = credentials.NewMemoryCredentials()
+		storage = logic.NewMemoryStorage()
+		tokenStore = auth.NewMemoryTokenStore()
+	case config.StorageSQLite, config.StoragePostgres:
+		db, err := sqldb.Open(cfg.Storage, cfg.SQL.DSN, cfg.Timeouts.Connect)
+		if err != nil {
+			log.Panicln(err)
+		}
+		log.Println("Connected to the database")
+		credChecker = credentials.NewSQLCredentials(db)
+		storage = logic.NewSQLStorage(db)
+		tokenStore = auth.NewSQLTokenStore(db)
+	default:
+		credChecker, err = credentials.NewMongoDBCredentials(cfg.Mongo.URI, cfg.Mongo.Database, cfg.Mongo.Collections.Users, cfg.Timeouts.Connect)
+		if err != nil {
+			log.Panicln(err)
+		}
+		log.Println("Connected to the database")
+		storage, err = logic.NewMongoStorage(cfg.Mongo.URI, cfg.Mongo.Database, logic.Collections{
+			Access:        cfg.Mongo.Collections.Access,
+			Lists:         cfg.Mongo.Collections.Lists,
+			Requests:      cfg.Mongo.Collections.Requests,
+			Notifications: cfg.Mongo.Collections.Notifications,
+			Tombstones:    cfg.Mongo.Collections.Tombstones,
+			Invites:       cfg.Mongo.Collections.Invites,
+			Groups:        cfg.Mongo.Collections.Groups,
+			Revisions:     cfg.Mongo.Collections.Revisions,
+			ItemOps:       cfg.Mongo.Collections.ItemOps,
+		}, cfg.Timeouts.Connect)
+		if err != nil {
+			log.Panicln(err)
+		}
+		tokenStore, err = auth.NewMongoTokenStore(cfg.Mongo.URI, cfg.Mongo.Database,
+			cfg.Mongo.Collections.RefreshTokens, cfg.Mongo.Collections.RevokedTokens, cfg.Timeouts.Connect)
+		if err != nil {
+			log.Panicln(err)
+		}
+	}
+	service := logic.NewService(storage, logic.NewLocalBroker(), tokenStore, cfg.Trash.Retention)
+	if len(cfg.Args) > 0 {
+		os.Exit(runCommand(service, cfg.Args))
+	}
+	go service.PurgeTrashPeriodically(cfg.Trash.PurgeInterval)
+	tokens := auth.NewTokenIssuer(secretKey, cookie, cfg.JWT.AccessTTL, cfg.JWT.RefreshTTL, tokenStore)
+
 	unauthenticatedRouter := mux.NewRouter()
-	// Sign in
-	unauthenticatedRouter.Handle("/v1/user/login", auth.NewLoginHandler(credChecker, secretKey))
+	// Sign in, sets short-lived "jwt" cookie and "refresh" cookie
+	unauthenticatedRouter.Handle("/v1/user/login", auth.NewLoginHandler(credChecker, tokens))
 	// Create new account
-	unauthenticatedRouter.Handle("/v1/user/register", auth.NewRegistrationHandler(credChecker, secretKey))
+	unauthenticatedRouter.Handle("/v1/user/register", auth.NewRegistrationHandler(credChecker, tokens, service.InitNewUser))
+	// Get new cookies when "jwt" has expired, the "refresh" cookie can be used only once
+	/*
+		->
+		POST example.com/v1/user/refresh
+
+		<-
+		Status 401
+		{"error":"invalid refresh token"}
+		or
+		Status 200 and empty response with new cookies
+	*/
+	unauthenticatedRouter.Path("/v1/user/refresh").Methods("POST").Handler(auth.NewRefreshHandler(tokens))
+	// Sign out, revoking both tokens
+	/*
+		->
+		POST example.com/v1/user/logout
+
+		<-
+		Status 200 and empty response with cleared cookies
+	*/
+	unauthenticatedRouter.Path("/v1/user/logout").Methods("POST").Handler(auth.NewLogoutHandler(tokens))
 
 	authenticatedRouter := mux.NewRouter()
-	// Get list contents
+	// Get list contents, ETag header holds the list version
 	/*
 		->
 		GET example.com/v1/list/get?id=1gMzFPoiPWNywuRwYYrilF6RP2D
@@ -60,57 +125,622 @@ func main() {
 		<-
 		{"error":"something went wrong"}
 		or
-		{"id":"1gMzFPoiPWNywuRwYYrilF6RP2D","owner":"katya","guests":["vasya"],"OriginalName":"Katya kishechka","last_changed":"2020-08-20T15:59:04.82Z","content":"100 proc"}
+		ETag: "3"
+		{"id":"1gMzFPoiPWNywuRwYYrilF6RP2D","owner":"katya","guests":["vasya"],"roles":[{"username":"vasya","role":"editor"}],"OriginalName":"Katya kishechka","last_changed":"2020-08-20T15:59:04.82Z","version":3,"items":[{"id":"1gMzG3ol4Vr3zPxCXQnm2tHiKQO","name":"Milk","quantity":2,"unit":"l","checked":false,"note":"","position":0}],"content":"Milk"}
 	*/
-	authenticatedRouter.Path("/v1/list/get").Methods("GET").HandlerFunc(logic.HandleGetList)
+	authenticatedRouter.Path("/v1/list/get").Methods("GET").HandlerFunc(service.HandleGetList)
 	// Create new list
 	/*
 		->
 		POST example.com/v1/list/create
 
+		{"name":"New list name","items":[{"name":"Milk","quantity":2,"unit":"l","note":""}]}
+		or, for older clients
 		{"name":"New list name","content":"list goes here"}
 		<-
 		{"error":"something went wrong"}
 		or
 		{"id":"1gMzFPoiPWNywuRwYYrilF6RP2D"}
 	*/
-	authenticatedRouter.Path("/v1/list/create").Methods("POST").HandlerFunc(logic.HandleCreateList)
-	// Delete a list
+	authenticatedRouter.Path("/v1/list/create").Methods("POST").HandlerFunc(service.HandleCreateList)
+	// Delete a list, the owner moves it to their trash and guests lose access to it, a guest just leaves it
+	// All requests modifying a list accept optional If-Match header with the version from ETag.
+	// If the list was changed since then, they reply with status 412 and the current list.
 	/*
 		->
 		POST example.com/v1/list/delete?id=1gMzFPoiPWNywuRwYYrilF6RP2D
+		If-Match: "3"
 
 		<-
 		{"error":"something went wrong"}
 		or
+		Status 412
+		{"error":"list was modified by someone else","list":{"id":"1gMzFPoiPWNywuRwYYrilF6RP2D",...,"version":4,...}}
+		or
+		Status 403
+		{"error":"list is shared with the user through a group, leave the group instead"}
+		or
 		Status 200 and empty response
 	*/
-	authenticatedRouter.Path("/v1/list/delete").Methods("POST").HandlerFunc(logic.HandleDeleteList)
-	// Update list contents
+	authenticatedRouter.Path("/v1/list/delete").Methods("POST").HandlerFunc(service.HandleDeleteList)
+	// Get deleted lists of the user which can still be restored, the most recently deleted first.
+	// Lists are purged for good when their purge time comes.
+	/*
+		->
+		GET example.com/v1/lists/trash
+		<-
+		{"error":"something went wrong"}
+		or
+		[{"id":"1gMzFPoiPWNywuRwYYrilF6RP2D","name":"Groceries","item_count":3,"deleted":"2020-11-06T18:24:51.735Z","purge":"2020-12-06T18:24:51.735Z"}]
+	*/
+	authenticatedRouter.Path("/v1/lists/trash").Methods("GET").HandlerFunc(service.HandleGetTrash)
+	// Restore a list from the trash, the owner and guests get it back under its name
+	/*
+		->
+		POST example.com/v1/list/restore?id=1gMzFPoiPWNywuRwYYrilF6RP2D
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 404
+		{"error":"list is not in the trash"}
+		or
+		Status 200 and empty response with new ETag
+	*/
+	authenticatedRouter.Path("/v1/list/restore").Methods("POST").HandlerFunc(service.HandleRestoreList)
+	// Replace all items of a list, one item per line of content
 	/*
 		->
 		POST example.com/v1/list/update?id=1gMzFPoiPWNywuRwYYrilF6RP2D
+		If-Match: "3"
 
 		{"content":"updated content here"}
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 200 and empty response with new ETag
+	*/
+	authenticatedRouter.Path("/v1/list/update").Methods("POST").HandlerFunc(service.HandleUpdateList)
+	// Rename a list, only the owner can do it. If-Match is optional.
+	// With propagate guests without an alias see the new name too, otherwise they keep the old one as an alias.
+	/*
+		->
+		POST example.com/v1/list/rename?id=1gMzFPoiPWNywuRwYYrilF6RP2D
+		If-Match: "3"
+
+		{"name":"Groceries","propagate":true}
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 400
+		{"error":"list name can't be empty"}
+		or
+		Status 200 and empty response with new ETag
+	*/
+	authenticatedRouter.Path("/v1/list/rename").Methods("POST").HandlerFunc(service.HandleRenameList)
+	// Name a list for the user only, other members don't see it. An empty alias restores the name of the list.
+	/*
+		->
+		POST example.com/v1/list/alias?id=1gMzFPoiPWNywuRwYYrilF6RP2D
+
+		{"alias":"Weekend"}
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 404
+		{"error":"user has no link to the list"}
+		or
+		Status 200 and empty response
+	*/
+	authenticatedRouter.Path("/v1/list/alias").Methods("POST").HandlerFunc(service.HandleSetAlias)
+	// Add an item to the end of a list
+	/*
+		->
+		POST example.com/v1/list/items/add?id=1gMzFPoiPWNywuRwYYrilF6RP2D
+
+		{"name":"Milk","quantity":2,"unit":"l","note":"lactose free"}
+		<-
+		{"error":"something went wrong"}
+		or
+		{"id":"1gMzG3ol4Vr3zPxCXQnm2tHiKQO"}
+	*/
+	authenticatedRouter.Path("/v1/list/items/add").Methods("POST").HandlerFunc(service.HandleAddItem)
+	// Edit an item, omitted fields are left unchanged
+	/*
+		->
+		POST example.com/v1/list/items/edit?id=1gMzFPoiPWNywuRwYYrilF6RP2D&item=1gMzG3ol4Vr3zPxCXQnm2tHiKQO
+
+		{"quantity":3,"note":""}
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 200 and empty response
+	*/
+	authenticatedRouter.Path("/v1/list/items/edit").Methods("POST").HandlerFunc(service.HandleEditItem)
+	// Check or uncheck an item
+	/*
+		->
+		POST example.com/v1/list/items/check?id=1gMzFPoiPWNywuRwYYrilF6RP2D&item=1gMzG3ol4Vr3zPxCXQnm2tHiKQO
+
+		{"checked":true}
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 200 and empty response
+	*/
+	authenticatedRouter.Path("/v1/list/items/check").Methods("POST").HandlerFunc(service.HandleCheckItem)
+	// Reorder items, items missing from the order are moved to the end
+	/*
+		->
+		POST example.com/v1/list/items/reorder?id=1gMzFPoiPWNywuRwYYrilF6RP2D
+
+		{"order":["1gMzG3ol4Vr3zPxCXQnm2tHiKQO","1gMzGCcp5wpDn1FI2cqWdHQFXwe"]}
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 200 and empty response
+	*/
+	authenticatedRouter.Path("/v1/list/items/reorder").Methods("POST").HandlerFunc(service.HandleReorderItems)
+	// Delete an item
+	/*
+		->
+		POST example.com/v1/list/items/delete?id=1gMzFPoiPWNywuRwYYrilF6RP2D&item=1gMzG3ol4Vr3zPxCXQnm2tHiKQO
+
 		<-
 		{"error":"something went wrong"}
 		or
 		Status 200 and empty response
 	*/
-	authenticatedRouter.Path("/v1/list/update").Methods("POST").HandlerFunc(logic.HandleUpdateList)
-	// Share a list with another user
-	// Update list contents
+	authenticatedRouter.Path("/v1/list/items/delete").Methods("POST").HandlerFunc(service.HandleDeleteItem)
+	// Merge item operations made by a client, possibly offline, and get the merged list.
+	// Each operation has the id of the client and a clock greater than the clock of any operation the client
+	// has made or received, including "clock" of the response. Kind is add, set or remove, new items get ids from clients.
+	// Concurrent changes of the same field are resolved in favour of the greater clock, then the greater client id,
+	// so all clients end up with the same list whatever order their operations arrive in.
+	// Operations merged already are skipped, so they can be sent again after a failed request.
+	/*
+		->
+		POST example.com/v1/list/ops?id=1gMzFPoiPWNywuRwYYrilF6RP2D
+
+		{"ops":[{"client_id":"phone-7f3a","clock":12,"kind":"add","item_id":"1gMzG3ol4Vr3zPxCXQnm2tHiKQO","fields":{"name":"Milk","position":3}},
+		{"client_id":"phone-7f3a","clock":13,"kind":"set","item_id":"1gMzGCcp5wpDn1FI2cqWdHQFXwe","fields":{"checked":true}},
+		{"client_id":"phone-7f3a","clock":14,"kind":"remove","item_id":"1gMzGPB5kUDQYRUJ1fQrE2iSc0A"}]}
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 400
+		{"error":"invalid operation"}
+		or
+		ETag: "7"
+		{"clock":14,"list":{"id":"1gMzFPoiPWNywuRwYYrilF6RP2D",...,"version":7,"items":[...]}}
+	*/
+	authenticatedRouter.Path("/v1/list/ops").Methods("POST").HandlerFunc(service.HandleMergeOps)
+	// Get merged operations on a list with a clock greater than since, ordered by clock and client id
+	/*
+		->
+		GET example.com/v1/list/ops?id=1gMzFPoiPWNywuRwYYrilF6RP2D&since=12
+		<-
+		{"error":"something went wrong"}
+		or
+		{"clock":14,"ops":[{"client_id":"phone-7f3a","clock":13,"kind":"set","item_id":"1gMzGCcp5wpDn1FI2cqWdHQFXwe",
+		"fields":{"checked":true},"author":"vasya","received":"2020-11-06T18:24:51.735Z"}]}
+	*/
+	authenticatedRouter.Path("/v1/list/ops").Methods("GET").HandlerFunc(service.HandleGetOps)
+	// Get many lists in one request, at most 100. Each list gets its own result with the status
+	// a request for that list alone would have got, except that lists the user has no access to get 403.
+	/*
+		->
+		POST example.com/v1/lists/batch/get
+
+		{"ids":["1gMzFPoiPWNywuRwYYrilF6RP2D","1gMzG3ol4Vr3zPxCXQnm2tHiKQO"]}
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 400
+		{"error":"too many lists in the batch"}
+		or
+		[{"id":"1gMzFPoiPWNywuRwYYrilF6RP2D","status":200,"list":{"id":"1gMzFPoiPWNywuRwYYrilF6RP2D",...,"version":7,"items":[...]}},
+		{"id":"1gMzG3ol4Vr3zPxCXQnm2tHiKQO","status":403,"error":"access denied"}]
+	*/
+	authenticatedRouter.Path("/v1/lists/batch/get").Methods("POST").HandlerFunc(service.HandleBatchGetLists)
+	// Merge item operations into many lists in one request, at most 100, as /v1/list/ops does for each of them.
+	// Lists are merged independently, a failure of one list doesn't stop the others.
+	/*
+		->
+		POST example.com/v1/lists/batch/ops
+
+		{"lists":[{"id":"1gMzFPoiPWNywuRwYYrilF6RP2D","ops":[{"client_id":"phone-7f3a","clock":15,"kind":"set",
+		"item_id":"1gMzGCcp5wpDn1FI2cqWdHQFXwe","fields":{"checked":false}}]},
+		{"id":"1gMzG3ol4Vr3zPxCXQnm2tHiKQO","ops":[{"client_id":"phone-7f3a","clock":16,"kind":"add","item_id":"1gMzH0dBW6wBzQZqEo6B3Pb2Jzc"}]}]}
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 400
+		{"error":"too many lists in the batch"}
+		or
+		[{"id":"1gMzFPoiPWNywuRwYYrilF6RP2D","status":200,"list":{"id":"1gMzFPoiPWNywuRwYYrilF6RP2D",...,"version":8,"items":[...]},"clock":15},
+		{"id":"1gMzG3ol4Vr3zPxCXQnm2tHiKQO","status":400,"error":"item name can't be empty"}]
+	*/
+	authenticatedRouter.Path("/v1/lists/batch/ops").Methods("POST").HandlerFunc(service.HandleBatchMergeOps)
+	// Get the history of a list, newest first. Only the last 50 revisions are kept.
+	/*
+		->
+		GET example.com/v1/list/revisions?id=1gMzFPoiPWNywuRwYYrilF6RP2D
+		<-
+		{"error":"something went wrong"}
+		or
+		[{"version":5,"author":"katya","created":"2020-11-06T18:24:51.735Z","name":"Groceries","item_count":2,"reverted_from":3},
+		{"version":4,"author":"vasya","created":"2020-11-06T18:20:11.193Z","name":"Groceries","item_count":3}]
+	*/
+	authenticatedRouter.Path("/v1/list/revisions").Methods("GET").HandlerFunc(service.HandleGetRevisions)
+	// Get a revision of a list with the items it has changed compared to the previous revision.
+	// Diff is null for the oldest kept revision.
+	/*
+		->
+		GET example.com/v1/list/revisions/get?id=1gMzFPoiPWNywuRwYYrilF6RP2D&version=4
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 404
+		{"error":"revision not found"}
+		or
+		{"list_id":"1gMzFPoiPWNywuRwYYrilF6RP2D","version":4,"author":"vasya","created":"2020-11-06T18:20:11.193Z",
+		"name":"Groceries","items":[{"id":"1gMzG3ol4Vr3zPxCXQnm2tHiKQO","name":"Milk","checked":true}],
+		"diff":{"added":[],"removed":["Bread"],"changed":["Milk"]}}
+	*/
+	authenticatedRouter.Path("/v1/list/revisions/get").Methods("GET").HandlerFunc(service.HandleGetRevision)
+	// Restore items of a list from a revision, the restored state becomes a new revision
+	/*
+		->
+		POST example.com/v1/list/revert?id=1gMzFPoiPWNywuRwYYrilF6RP2D&version=3
+		If-Match: "4"
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 404
+		{"error":"revision not found"}
+		or
+		Status 412
+		{"error":"list was modified by someone else","list":{"id":"1gMzFPoiPWNywuRwYYrilF6RP2D",...,"version":5,...}}
+		or
+		Status 200 and empty response with new ETag
+	*/
+	authenticatedRouter.Path("/v1/list/revert").Methods("POST").HandlerFunc(service.HandleRevertList)
+	// Send a request to share a list with another user, only the owner and co-owners can do it
+	// Role is one of viewer (can only read), editor (can modify items, the default) or co-owner (can also share)
 	/*
 		->
 		POST example.com/v1/list/share
 
-		{"id":"1gMzFPoiPWNywuRwYYrilF6RP2D","guest":"username of receiver"}
+		{"id":"1gMzFPoiPWNywuRwYYrilF6RP2D","guest":"username of receiver","role":"editor"}
 		<-
 		{"error":"something went wrong"}
 		or
+		Status 400
+		{"error":"list can't be shared with yourself"}
+		or
+		Status 404
+		{"error":"user doesn't exist"}
+		or
+		Status 409
+		{"error":"list is already shared with the user"} or {"error":"user already has a pending request for the list"}
+		or
+		{"id":"1gMzJ0Khd7gFmWbTKdjLbbkGmsJ"}
+	*/
+	authenticatedRouter.Path("/v1/list/share").Methods("POST").HandlerFunc(service.HandleShareList)
+	// Take access to a list away from a guest, only the owner can do it
+	/*
+		->
+		POST example.com/v1/list/revoke?id=1gMzFPoiPWNywuRwYYrilF6RP2D&guest=vasya
+
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 404
+		{"error":"user is not a guest of the list"}
+		or
 		Status 200 and empty response
 	*/
-	authenticatedRouter.Path("/v1/list/share").Methods("POST").HandlerFunc(logic.HandleShareList)
+	authenticatedRouter.Path("/v1/list/revoke").Methods("POST").HandlerFunc(service.HandleRevokeGuest)
+	// Change the role of a guest, only the owner can do it
+	/*
+		->
+		POST example.com/v1/list/role?id=1gMzFPoiPWNywuRwYYrilF6RP2D&guest=vasya&role=viewer
+
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 400
+		{"error":"role must be one of viewer, editor or co-owner"}
+		or
+		Status 404
+		{"error":"user is not a guest of the list"}
+		or
+		Status 200 and empty response
+	*/
+	authenticatedRouter.Path("/v1/list/role").Methods("POST").HandlerFunc(service.HandleSetRole)
+	// Stop being a guest of a shared list
+	/*
+		->
+		POST example.com/v1/list/leave?id=1gMzFPoiPWNywuRwYYrilF6RP2D
+
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 404
+		{"error":"user is not a guest of the list"}
+		or
+		Status 403
+		{"error":"list is shared with the user through a group, leave the group instead"}
+		or
+		Status 200 and empty response
+	*/
+	authenticatedRouter.Path("/v1/list/leave").Methods("POST").HandlerFunc(service.HandleLeaveList)
+	// Offer ownership of a list to another user, only the owner can do it
+	// The new owner accepts or declines it like a share request. keep_as is the role the owner keeps afterwards,
+	// the owner leaves the list if it is empty.
+	/*
+		->
+		POST example.com/v1/list/transfer
+
+		{"id":"1gMzFPoiPWNywuRwYYrilF6RP2D","new_owner":"vasya","keep_as":"editor"}
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 400
+		{"error":"user already owns the list"}
+		or
+		{"id":"1gMzJ0Khd7gFmWbTKdjLbbkGmsJ"}
+	*/
+	authenticatedRouter.Path("/v1/list/transfer").Methods("POST").HandlerFunc(service.HandleTransferList)
+	// Create an invite link, only the owner and co-owners can do it
+	// Anyone who opens the link with the token joins the list with the role. Both expires and max_uses are optional,
+	// without them the invite never expires and may be used any number of times.
+	/*
+		->
+		POST example.com/v1/list/invites/create?id=1gMzFPoiPWNywuRwYYrilF6RP2D
+
+		{"role":"viewer","expires":"2020-08-27T15:59:04.82Z","max_uses":5}
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 400
+		{"error":"expiry must be in the future and max uses must not be negative"}
+		or
+		{"id":"1gN2Vh4C3W1FMGGxnkBn5fjJvKd","token":"q9bP3xq8m6Ag0t3Zz6C8eK0aKhqgTeeHbqTFTLpQDHY","list_id":"1gMzFPoiPWNywuRwYYrilF6RP2D","creator":"katya","role":"viewer","created":"2020-08-20T15:59:04.82Z","expires":"2020-08-27T15:59:04.82Z","max_uses":5,"uses":0}
+	*/
+	authenticatedRouter.Path("/v1/list/invites/create").Methods("POST").HandlerFunc(service.HandleCreateInvite)
+	// Get invite links of a list which can still be used
+	/*
+		->
+		GET example.com/v1/list/invites?id=1gMzFPoiPWNywuRwYYrilF6RP2D
+
+		<-
+		{"error":"something went wrong"}
+		or
+		[{"id":"1gN2Vh4C3W1FMGGxnkBn5fjJvKd","token":"q9bP3xq8m6Ag0t3Zz6C8eK0aKhqgTeeHbqTFTLpQDHY",...,"max_uses":5,"uses":1}]
+	*/
+	authenticatedRouter.Path("/v1/list/invites").Methods("GET").HandlerFunc(service.HandleGetInvites)
+	// Revoke an invite link
+	/*
+		->
+		POST example.com/v1/list/invites/revoke?id=1gMzFPoiPWNywuRwYYrilF6RP2D&invite=1gN2Vh4C3W1FMGGxnkBn5fjJvKd
+
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 404
+		{"error":"invite not found"}
+		or
+		Status 200 and empty response
+	*/
+	authenticatedRouter.Path("/v1/list/invites/revoke").Methods("POST").HandlerFunc(service.HandleRevokeInvite)
+	// Join a list with the token of an invite link
+	/*
+		->
+		POST example.com/v1/invites/join?token=q9bP3xq8m6Ag0t3Zz6C8eK0aKhqgTeeHbqTFTLpQDHY
+
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 404
+		{"error":"invite not found"}
+		or
+		Status 410
+		{"error":"invite has expired or has been used up"}
+		or
+		Status 409
+		{"error":"list is already shared with the user"}
+		or
+		{"id":"1gMzFPoiPWNywuRwYYrilF6RP2D"}
+	*/
+	authenticatedRouter.Path("/v1/invites/join").Methods("POST").HandlerFunc(service.HandleJoinByInvite)
+	// Share a list with a group, every member of the group gets the role in the list for as long as they are members
+	// The user must be allowed to share the list and be a member of the group. The role is editor if it is omitted.
+	/*
+		->
+		POST example.com/v1/list/groups/share?id=1gMzFPoiPWNywuRwYYrilF6RP2D&group=1gP4aT0bXkqvG0fN1HqJp4ZsQwE&role=editor
+
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 404
+		{"error":"group not found"}
+		or
+		Status 409
+		{"error":"list is already shared with the group"}
+		or
+		Status 200 and empty response
+	*/
+	authenticatedRouter.Path("/v1/list/groups/share").Methods("POST").HandlerFunc(service.HandleShareWithGroup)
+	// Stop sharing a list with a group, the owner of the list and admins of the group can do it
+	/*
+		->
+		POST example.com/v1/list/groups/unshare?id=1gMzFPoiPWNywuRwYYrilF6RP2D&group=1gP4aT0bXkqvG0fN1HqJp4ZsQwE
+
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 404
+		{"error":"list is not shared with the group"}
+		or
+		Status 200 and empty response
+	*/
+	authenticatedRouter.Path("/v1/list/groups/unshare").Methods("POST").HandlerFunc(service.HandleUnshareWithGroup)
+	// Create a group, the user becomes its admin
+	/*
+		->
+		POST example.com/v1/groups/create
+
+		{"name":"Home"}
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 400
+		{"error":"group name must not be empty"}
+		or
+		{"id":"1gP4aT0bXkqvG0fN1HqJp4ZsQwE"}
+	*/
+	authenticatedRouter.Path("/v1/groups/create").Methods("POST").HandlerFunc(service.HandleCreateGroup)
+	// Get groups of the user
+	/*
+		->
+		GET example.com/v1/groups
+
+		<-
+		{"error":"something went wrong"}
+		or
+		[{"id":"1gP4aT0bXkqvG0fN1HqJp4ZsQwE","name":"Home","members":[{"username":"katya","role":"admin","joined":"2020-08-20T15:59:04.82Z"}],"created":"2020-08-20T15:59:04.82Z"}]
+	*/
+	authenticatedRouter.Path("/v1/groups").Methods("GET").HandlerFunc(service.HandleGetGroups)
+	// Get a group, only its members can do it
+	/*
+		->
+		GET example.com/v1/groups/get?id=1gP4aT0bXkqvG0fN1HqJp4ZsQwE
+
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 404
+		{"error":"group not found"}
+		or
+		{"id":"1gP4aT0bXkqvG0fN1HqJp4ZsQwE","name":"Home","members":[{"username":"katya","role":"admin","joined":"2020-08-20T15:59:04.82Z"},{"username":"vasya","role":"member","joined":"2020-08-21T10:02:11.3Z"}],"created":"2020-08-20T15:59:04.82Z"}
+	*/
+	authenticatedRouter.Path("/v1/groups/get").Methods("GET").HandlerFunc(service.HandleGetGroup)
+	// Get lists shared with a group
+	/*
+		->
+		GET example.com/v1/groups/lists?id=1gP4aT0bXkqvG0fN1HqJp4ZsQwE
+
+		<-
+		{"error":"something went wrong"}
+		or
+		[{"id":"1gMzFPoiPWNywuRwYYrilF6RP2D","display_name":"Katya kishechka","aliased":false}]
+	*/
+	authenticatedRouter.Path("/v1/groups/lists").Methods("GET").HandlerFunc(service.HandleGetGroupLists)
+	// Delete a group, only admins can do it. Lists shared with it stay with their owners.
+	/*
+		->
+		POST example.com/v1/groups/delete?id=1gP4aT0bXkqvG0fN1HqJp4ZsQwE
+
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 200 and empty response
+	*/
+	authenticatedRouter.Path("/v1/groups/delete").Methods("POST").HandlerFunc(service.HandleDeleteGroup)
+	// Add a user to a group as a member or an admin, only admins can do it
+	/*
+		->
+		POST example.com/v1/groups/members/add?id=1gP4aT0bXkqvG0fN1HqJp4ZsQwE&username=vasya&role=member
+
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 404
+		{"error":"user doesn't exist"}
+		or
+		Status 409
+		{"error":"user is already a member of the group"}
+		or
+		Status 200 and empty response
+	*/
+	authenticatedRouter.Path("/v1/groups/members/add").Methods("POST").HandlerFunc(service.HandleAddGroupMember)
+	// Remove a member from a group, only admins can do it
+	/*
+		->
+		POST example.com/v1/groups/members/remove?id=1gP4aT0bXkqvG0fN1HqJp4ZsQwE&username=vasya
+
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 409
+		{"error":"the group must keep at least one admin"}
+		or
+		Status 200 and empty response
+	*/
+	authenticatedRouter.Path("/v1/groups/members/remove").Methods("POST").HandlerFunc(service.HandleRemoveGroupMember)
+	// Change the role of a member, only admins can do it
+	/*
+		->
+		POST example.com/v1/groups/members/role?id=1gP4aT0bXkqvG0fN1HqJp4ZsQwE&username=vasya&role=admin
+
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 400
+		{"error":"group role must be admin or member"}
+		or
+		Status 200 and empty response
+	*/
+	authenticatedRouter.Path("/v1/groups/members/role").Methods("POST").HandlerFunc(service.HandleSetGroupRole)
+	// Leave a group, the group is deleted when its last member leaves
+	/*
+		->
+		POST example.com/v1/groups/leave?id=1gP4aT0bXkqvG0fN1HqJp4ZsQwE
+
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 409
+		{"error":"the group must keep at least one admin"}
+		or
+		Status 200 and empty response
+	*/
+	authenticatedRouter.Path("/v1/groups/leave").Methods("POST").HandlerFunc(service.HandleLeaveGroup)
+	// Make a list readable by anyone with the returned token, only the owner can do it
+	// The current token is returned if the list is public already.
+	/*
+		->
+		POST example.com/v1/list/public/enable?id=1gMzFPoiPWNywuRwYYrilF6RP2D
+
+		<-
+		{"error":"something went wrong"}
+		or
+		{"token":"mQ0t3vC9Xl2xkPjz8o1QpW2c6nBHfV0rUa4sYdE7gKI"}
+	*/
+	authenticatedRouter.Path("/v1/list/public/enable").Methods("POST").HandlerFunc(service.HandleEnablePublicLink)
+	// Replace the token of a public list, the old link stops working
+	/*
+		->
+		POST example.com/v1/list/public/rotate?id=1gMzFPoiPWNywuRwYYrilF6RP2D
+
+		<-
+		{"error":"something went wrong"}
+		or
+		{"token":"Zc4pT1hWb9nV3yQmE0sKf7uLr2aXgD5oJ8iN6tHwC1Y"}
+	*/
+	authenticatedRouter.Path("/v1/list/public/rotate").Methods("POST").HandlerFunc(service.HandleRotatePublicLink)
+	// Make a public list private again
+	/*
+		->
+		POST example.com/v1/list/public/disable?id=1gMzFPoiPWNywuRwYYrilF6RP2D
+
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 200 and empty response
+	*/
+	authenticatedRouter.Path("/v1/list/public/disable").Methods("POST").HandlerFunc(service.HandleDisablePublicLink)
 	// Get all shared lists
 	/*
 		->
@@ -119,9 +749,9 @@ func main() {
 		<-
 		{"error":"something went wrong"}
 		or
-		[{"id":"1gMwLXlw92AZMcvAwyidItzOR29","display_name":"List1"},{"id":"Jn7wLXlw92A36cvAwyidItzOH65","display_name":"List2"}]
+		[{"id":"1gMwLXlw92AZMcvAwyidItzOR29","display_name":"List1","aliased":false},{"id":"Jn7wLXlw92A36cvAwyidItzOH65","display_name":"List2","aliased":true}]
 	*/
-	authenticatedRouter.Path("/v1/lists/shared").Methods("GET").HandlerFunc(logic.HandleGetSharedLists)
+	authenticatedRouter.Path("/v1/lists/shared").Methods("GET").HandlerFunc(service.HandleGetSharedLists)
 	// Get all owned lists
 	/*
 		->
@@ -130,55 +760,187 @@ func main() {
 		<-
 		{"error":"something went wrong"}
 		or
-		[{"id":"1gMwLXlw92AZMcvAwyidItzOR29","display_name":"List1"},{"id":"Jn7wLXlw92A36cvAwyidItzOH65","display_name":"List2"}]
+		[{"id":"1gMwLXlw92AZMcvAwyidItzOR29","display_name":"List1","aliased":false},{"id":"Jn7wLXlw92A36cvAwyidItzOH65","display_name":"List2","aliased":false}]
+	*/
+	authenticatedRouter.Path("/v1/lists/owned").Methods("GET").HandlerFunc(service.HandleGetOwnedLists)
+	// Get lists changed since the cursor returned by the previous call, omit the cursor to get all lists
+	// Lists seen only through a group have the id of the group in "group".
+	/*
+		->
+		GET example.com/v1/sync?cursor=2020-08-20T15:59:02.82Z
+
+		<-
+		{"error":"something went wrong"}
+		or
+		{"cursor":"2020-08-20T16:10:00.5Z","reset":false,"changed":[{"display_name":"List1","owned":true,"list":{"id":"1gMzFPoiPWNywuRwYYrilF6RP2D",...}}],"removed":["1gMwLXlw92AZMcvAwyidItzOR29"]}
+	*/
+	authenticatedRouter.Path("/v1/sync").Methods("GET").HandlerFunc(service.HandleSync)
+	// Stream changes of a list, or of all lists of the user if id is omitted, as Server-Sent Events.
+	// The stream ends when the access token expires or is revoked, clients reconnect after refreshing it.
+	/*
+		->
+		GET example.com/v1/events?id=1gMzFPoiPWNywuRwYYrilF6RP2D
+
+		<-
+		{"error":"something went wrong"}
+		or
+		event: list_edited
+		data: {"type":"list_edited","list_id":"1gMzFPoiPWNywuRwYYrilF6RP2D","actor":"vasya","version":4,"time":"2020-08-20T15:59:04.82Z"}
 	*/
-	authenticatedRouter.Path("/v1/lists/owned").Methods("GET").HandlerFunc(logic.HandleGetOwnedLists)
-	// Get all notifications
-	authenticatedRouter.Path("/v1/notifications/get").Methods("GET").HandlerFunc(handlerPlaceholder)
+	authenticatedRouter.Path("/v1/events").Methods("GET").HandlerFunc(service.HandleEvents)
+	// Get notifications, newest first
+	/*
+		->
+		GET example.com/v1/notifications/get?offset=0&limit=50&unread=true
+
+		<-
+		{"error":"something went wrong"}
+		or
+		{"total":1,"unread":1,"notifications":[{"id":"1gN0hWJH2fgPyXKqU3tLxRbSGNl","type":"list_shared","list_id":"1gMzFPoiPWNywuRwYYrilF6RP2D","list_name":"List1","actor":"katya","created":"2020-08-20T15:59:04.82Z","read":false}]}
+	*/
+	authenticatedRouter.Path("/v1/notifications/get").Methods("GET").HandlerFunc(service.HandleGetNotifications)
+	// Get the number of unread notifications
+	/*
+		->
+		GET example.com/v1/notifications/unread
+
+		<-
+		{"error":"something went wrong"}
+		or
+		{"unread":3}
+	*/
+	authenticatedRouter.Path("/v1/notifications/unread").Methods("GET").HandlerFunc(service.HandleGetUnreadCount)
+	// Mark a notification as read, or all of them if id is omitted
+	/*
+		->
+		POST example.com/v1/notifications/read?id=1gN0hWJH2fgPyXKqU3tLxRbSGNl
+
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 200 and empty response
+	*/
+	authenticatedRouter.Path("/v1/notifications/read").Methods("POST").HandlerFunc(service.HandleMarkNotificationsRead)
 	// Delete notification
-	authenticatedRouter.Path("/v1/notifications/delete").Methods("POST").HandlerFunc(handlerPlaceholder)
-	// Get all requests
-	authenticatedRouter.Path("/v1/requests/get").Methods("GET").HandlerFunc(handlerPlaceholder)
+	/*
+		->
+		POST example.com/v1/notifications/delete?id=1gN0hWJH2fgPyXKqU3tLxRbSGNl
+
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 200 and empty response
+	*/
+	authenticatedRouter.Path("/v1/notifications/delete").Methods("POST").HandlerFunc(service.HandleDeleteNotification)
+	// Get all requests sent to the user
+	/*
+		->
+		GET example.com/v1/requests/get
+
+		<-
+		{"error":"something went wrong"}
+		or
+		[{"id":"1gMzJ0Khd7gFmWbTKdjLbbkGmsJ","list_id":"1gMzFPoiPWNywuRwYYrilF6RP2D","list_name":"List1","owner":"katya","guest":"vasya","created":"2020-08-20T15:59:04.82Z"}]
+	*/
+	authenticatedRouter.Path("/v1/requests/get").Methods("GET").HandlerFunc(service.HandleGetRequests)
 	// Accept request to share a list
-	authenticatedRouter.Path("/v1/requests/accept").Methods("POST").HandlerFunc(handlerPlaceholder)
+	/*
+		->
+		POST example.com/v1/requests/accept?id=1gMzJ0Khd7gFmWbTKdjLbbkGmsJ
+
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 409, the request is removed as the user has the list already
+		{"error":"list is already shared with the user"}
+		or
+		Status 200 and empty response
+	*/
+	authenticatedRouter.Path("/v1/requests/accept").Methods("POST").HandlerFunc(service.HandleAcceptRequest)
 	// Decline request to share a list
-	authenticatedRouter.Path("/v1/requests/decline").Methods("POST").HandlerFunc(handlerPlaceholder)
+	/*
+		->
+		POST example.com/v1/requests/decline?id=1gMzJ0Khd7gFmWbTKdjLbbkGmsJ
+
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 200 and empty response
+	*/
+	authenticatedRouter.Path("/v1/requests/decline").Methods("POST").HandlerFunc(service.HandleDeclineRequest)
+	// Get all pending requests sent by the user
+	/*
+		->
+		GET example.com/v1/requests/sent
+
+		<-
+		{"error":"something went wrong"}
+		or
+		[{"id":"1gMzJ0Khd7gFmWbTKdjLbbkGmsJ","list_id":"1gMzFPoiPWNywuRwYYrilF6RP2D","list_name":"List1","owner":"katya","guest":"vasya","created":"2020-08-20T15:59:04.82Z"}]
+	*/
+	authenticatedRouter.Path("/v1/requests/sent").Methods("GET").HandlerFunc(service.HandleGetSentRequests)
+	// Cancel a pending request sent by the user
+	/*
+		->
+		POST example.com/v1/requests/cancel?id=1gMzJ0Khd7gFmWbTKdjLbbkGmsJ
+
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 200 and empty response
+	*/
+	authenticatedRouter.Path("/v1/requests/cancel").Methods("POST").HandlerFunc(service.HandleCancelRequest)
+
+	publicRouter := mux.NewRouter()
+	// Read a public list without an account, format is json (default), html or text
+	/*
+		->
+		GET example.com/v1/public/list?token=mQ0t3vC9Xl2xkPjz8o1QpW2c6nBHfV0rUa4sYdE7gKI&format=json
+
+		<-
+		{"error":"something went wrong"}
+		or
+		Status 404
+		{"error":"list not found"}
+		or
+		{"name":"Katya kishechka","last_changed":"2020-08-20T15:59:04.82Z","items":[{"id":"1gMzG3ol4Vr3zPxCXQnm2tHiKQO","name":"Milk","quantity":2,"unit":"l","checked":false,"note":"","position":0}]}
+	*/
+	publicRouter.Path("/v1/public/list").Methods("GET").HandlerFunc(service.HandlePublicList)
 
 	authMW := negroni.New()
 	authMW.UseFunc(jwtmiddleware.New(jwtmiddleware.Options{
 		ValidationKeyGetter: func(_ *jwt.Token) (interface{}, error) {
 			return secretKey, nil
 		},
-		Extractor: func(r *http.Request) (string, error) {
-			cookie, err := r.Cookie("jwt")
-			if err != nil {
-				return "", err
-			}
-			token, err := url.QueryUnescape(cookie.Value)
-			if err != nil {
-				return "", err
-			}
-			return token, nil
-		},
+		Extractor:     auth.TokenFromCookie,
 		SigningMethod: jwt.SigningMethodHS256,
 		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err string) {
 			w.WriteHeader(http.StatusUnauthorized)
 			_, _ = w.Write(utils.NewWrappedError(err))
 		},
 	}).HandlerWithNext)
+	authMW.UseFunc(tokens.CheckRevoked)
 	authMW.UseHandler(authenticatedRouter)
 
 	outerRouter := mux.NewRouter()
 	outerRouter.PathPrefix("/v1/user/").Handler(unauthenticatedRouter)
+	outerRouter.PathPrefix("/v1/public/").Handler(publicRouter)
 	outerRouter.PathPrefix("/v1/").Handler(authMW)
 
 	mainChain := negroni.New()
 	mainChain.Use(negroni.NewLogger())
 	mainChain.UseHandler(outerRouter)
 
-	log.Println("Using port", port)
+	log.Println("Using port", cfg.Port)
 
-	err = http.ListenAndServe(port, mainChain)
+	server := &http.Server{
+		Addr:         cfg.Port,
+		Handler:      mainChain,
+		ReadTimeout:  cfg.Timeouts.Read,
+		WriteTimeout: cfg.Timeouts.Write,
+		IdleTimeout:  cfg.Timeouts.Idle,
+	}
+	err = server.ListenAndServe()
 	log.Println(err)
 
 }
@@ -0,0 +1,215 @@
+package sqldb
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// migrations bring the schema from one version to the next, the schema version is the number of applied ones.
+// Applied migrations must never be changed, add a new one instead.
+// Statements must work in both SQLite and PostgreSQL.
+var migrations = [][]string{
+	// 1: users, lists and links between them, requests, notifications, tombstones and tokens
+	{
+		`CREATE TABLE users (
+			username TEXT PRIMARY KEY,
+			hash TEXT NOT NULL
+		)`,
+		`CREATE TABLE lists (
+			id TEXT PRIMARY KEY,
+			owner TEXT NOT NULL REFERENCES users (username) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			last_changed BIGINT NOT NULL,
+			version BIGINT NOT NULL,
+			content TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX lists_owner ON lists (owner)`,
+		`CREATE TABLE list_items (
+			list_id TEXT NOT NULL REFERENCES lists (id) ON DELETE CASCADE,
+			id TEXT NOT NULL,
+			seq INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			quantity DOUBLE PRECISION NOT NULL,
+			unit TEXT NOT NULL,
+			checked BOOLEAN NOT NULL,
+			note TEXT NOT NULL,
+			position INTEGER NOT NULL,
+			PRIMARY KEY (list_id, id)
+		)`,
+		`CREATE TABLE list_guests (
+			list_id TEXT NOT NULL REFERENCES lists (id) ON DELETE CASCADE,
+			username TEXT NOT NULL REFERENCES users (username) ON DELETE CASCADE,
+			added BIGINT NOT NULL,
+			PRIMARY KEY (list_id, username)
+		)`,
+		`CREATE INDEX list_guests_username ON list_guests (username)`,
+		// Links of owned and shared lists, removed together with the list
+		`CREATE TABLE list_links (
+			username TEXT NOT NULL REFERENCES users (username) ON DELETE CASCADE,
+			list_id TEXT NOT NULL REFERENCES lists (id) ON DELETE CASCADE,
+			owned BOOLEAN NOT NULL,
+			display_name TEXT NOT NULL,
+			linked BIGINT NOT NULL,
+			PRIMARY KEY (username, list_id)
+		)`,
+		`CREATE INDEX list_links_list_id ON list_links (list_id)`,
+		`CREATE TABLE share_requests (
+			id TEXT PRIMARY KEY,
+			list_id TEXT NOT NULL REFERENCES lists (id) ON DELETE CASCADE,
+			list_name TEXT NOT NULL,
+			owner TEXT NOT NULL,
+			guest TEXT NOT NULL,
+			created BIGINT NOT NULL,
+			UNIQUE (list_id, guest)
+		)`,
+		`CREATE INDEX share_requests_owner ON share_requests (owner)`,
+		`CREATE INDEX share_requests_guest ON share_requests (guest)`,
+		`CREATE TABLE notifications (
+			id TEXT PRIMARY KEY,
+			username TEXT NOT NULL REFERENCES users (username) ON DELETE CASCADE,
+			type TEXT NOT NULL,
+			list_id TEXT NOT NULL,
+			list_name TEXT NOT NULL,
+			actor TEXT NOT NULL,
+			created BIGINT NOT NULL,
+			read BOOLEAN NOT NULL
+		)`,
+		`CREATE INDEX notifications_username_created ON notifications (username, created)`,
+		`CREATE TABLE tombstones (
+			list_id TEXT NOT NULL,
+			username TEXT NOT NULL,
+			removed BIGINT NOT NULL
+		)`,
+		`CREATE INDEX tombstones_username_removed ON tombstones (username, removed)`,
+		`CREATE TABLE refresh_tokens (
+			hash TEXT PRIMARY KEY,
+			username TEXT NOT NULL REFERENCES users (username) ON DELETE CASCADE,
+			session TEXT NOT NULL,
+			used BOOLEAN NOT NULL,
+			expires BIGINT NOT NULL
+		)`,
+		`CREATE INDEX refresh_tokens_session ON refresh_tokens (session)`,
+		`CREATE TABLE revoked_tokens (
+			id TEXT PRIMARY KEY,
+			expires BIGINT NOT NULL
+		)`,
+	},
+	// 2: roles of guests, existing guests keep editing
+	{
+		`ALTER TABLE list_guests ADD COLUMN role TEXT NOT NULL DEFAULT 'editor'`,
+		`ALTER TABLE share_requests ADD COLUMN role TEXT NOT NULL DEFAULT 'editor'`,
+	},
+	// 3: ownership transfers
+	{
+		`ALTER TABLE share_requests ADD COLUMN former_owner_role TEXT NOT NULL DEFAULT ''`,
+	},
+	// 4: invite links, expires is NULL for invites without expiry
+	{
+		`CREATE TABLE invites (
+			id TEXT PRIMARY KEY,
+			token TEXT NOT NULL UNIQUE,
+			list_id TEXT NOT NULL REFERENCES lists (id) ON DELETE CASCADE,
+			creator TEXT NOT NULL,
+			role TEXT NOT NULL,
+			created BIGINT NOT NULL,
+			expires BIGINT,
+			max_uses BIGINT NOT NULL,
+			uses BIGINT NOT NULL
+		)`,
+		`CREATE INDEX invites_list_id ON invites (list_id)`,
+	},
+	// 5: public links, public_token is NULL for private lists
+	{
+		`ALTER TABLE lists ADD COLUMN public_token TEXT`,
+		`CREATE UNIQUE INDEX lists_public_token ON lists (public_token)`,
+	},
+	// 6: groups of users and lists shared with them
+	{
+		`CREATE TABLE user_groups (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			created BIGINT NOT NULL
+		)`,
+		`CREATE TABLE group_members (
+			group_id TEXT NOT NULL REFERENCES user_groups (id) ON DELETE CASCADE,
+			username TEXT NOT NULL REFERENCES users (username) ON DELETE CASCADE,
+			role TEXT NOT NULL,
+			joined BIGINT NOT NULL,
+			PRIMARY KEY (group_id, username)
+		)`,
+		`CREATE INDEX group_members_username ON group_members (username)`,
+		`CREATE TABLE list_groups (
+			list_id TEXT NOT NULL REFERENCES lists (id) ON DELETE CASCADE,
+			group_id TEXT NOT NULL REFERENCES user_groups (id) ON DELETE CASCADE,
+			role TEXT NOT NULL,
+			added BIGINT NOT NULL,
+			PRIMARY KEY (list_id, group_id)
+		)`,
+		`CREATE INDEX list_groups_group_id ON list_groups (group_id)`,
+	},
+	// 7: aliases, links with one keep their name when the list is renamed
+	{
+		`ALTER TABLE list_links ADD COLUMN aliased BOOLEAN NOT NULL DEFAULT FALSE`,
+	},
+	// 8: history of lists, items of a revision are stored as JSON
+	{
+		`CREATE TABLE list_revisions (
+			list_id TEXT NOT NULL REFERENCES lists (id) ON DELETE CASCADE,
+			version BIGINT NOT NULL,
+			author TEXT NOT NULL,
+			created BIGINT NOT NULL,
+			name TEXT NOT NULL,
+			items TEXT NOT NULL,
+			reverted_from BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (list_id, version)
+		)`,
+	},
+	// 9: trash, deleted is set while a list is in the trash of its owner
+	{
+		`ALTER TABLE lists ADD COLUMN deleted BIGINT`,
+		`CREATE INDEX lists_deleted ON lists (deleted)`,
+	},
+	// 10: operations merged into items, and stamps of the operations which have set item fields as JSON
+	{
+		`CREATE TABLE item_ops (
+			list_id TEXT NOT NULL REFERENCES lists (id) ON DELETE CASCADE,
+			client_id TEXT NOT NULL,
+			clock BIGINT NOT NULL,
+			kind TEXT NOT NULL,
+			item_id TEXT NOT NULL,
+			fields TEXT NOT NULL,
+			author TEXT NOT NULL,
+			received BIGINT NOT NULL,
+			PRIMARY KEY (list_id, client_id, clock)
+		)`,
+		`CREATE INDEX item_ops_list_id_clock ON item_ops (list_id, clock)`,
+		`ALTER TABLE list_items ADD COLUMN stamps TEXT NOT NULL DEFAULT ''`,
+	},
+}
+
+func (db *DB) migrate() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`)
+	if err != nil {
+		return err
+	}
+	var current int
+	err = db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return err
+	}
+	for version := current + 1; version <= len(migrations); version++ {
+		err = db.InTx(func(tx *Tx) error {
+			for _, statement := range migrations[version-1] {
+				if _, err := tx.Exec(statement); err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, version)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		log.Info("Migrated database schema to version ", version)
+	}
+	return nil
+}
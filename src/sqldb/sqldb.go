@@ -0,0 +1,238 @@
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Supported database drivers
+const (
+	SQLite   = "sqlite"
+	Postgres = "postgres"
+)
+
+// DB is a connection pool of one of the supported databases with the schema migrated to the latest version.
+// Queries are written with ? placeholders, they are rewritten for the database in use.
+type DB struct {
+	db     *sql.DB
+	driver string
+}
+
+// Tx is a transaction of DB, queries are rewritten the same way
+type Tx struct {
+	tx     *sql.Tx
+	driver string
+	// savepoints counts savepoints of nested transactions, which are named after it
+	savepoints int
+}
+
+// Querier is implemented by both DB and Tx
+type Querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Conn is implemented by both DB and Tx, a transaction started on Tx is nested in it
+type Conn interface {
+	Querier
+	InTx(f func(tx *Tx) error) error
+}
+
+func Open(driverName, dsn string, timeout time.Duration) (*DB, error) {
+	var pool *sql.DB
+	switch driverName {
+	case SQLite:
+		connector, err := newSQLiteConnector(dsn)
+		if err != nil {
+			return nil, err
+		}
+		pool = sql.OpenDB(connector)
+		// SQLite allows only one writer, a single connection avoids "database is locked" errors
+		pool.SetMaxOpenConns(1)
+	case Postgres:
+		var err error
+		pool, err = sql.Open(Postgres, dsn)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported database driver %q", driverName)
+	}
+	err := ping(pool, driverName, timeout)
+	if err != nil {
+		_ = pool.Close()
+		return nil, err
+	}
+	db := &DB{db: pool, driver: driverName}
+	if err = db.migrate(); err != nil {
+		_ = pool.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// ping checks that the database can be reached. SQLite is pinged without the timeout: it only opens a local file,
+// and its driver interrupts the connection whenever the context of a statement is done, even after the statement
+// has finished.
+func ping(pool *sql.DB, driverName string, timeout time.Duration) error {
+	if driverName == SQLite {
+		return pool.Ping()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return pool.PingContext(ctx)
+}
+
+// sqliteConnector enables foreign keys on every new connection, SQLite has them off by default
+type sqliteConnector struct {
+	driver driver.Driver
+	dsn    string
+}
+
+func newSQLiteConnector(dsn string) (driver.Connector, error) {
+	pool, err := sql.Open(SQLite, dsn)
+	if err != nil {
+		return nil, err
+	}
+	sqliteDriver := pool.Driver()
+	_ = pool.Close()
+	return sqliteConnector{driver: sqliteDriver, dsn: dsn}, nil
+}
+
+func (c sqliteConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	execer, ok := conn.(driver.ExecerContext)
+	if !ok {
+		_ = conn.Close()
+		return nil, errors.New("sqlite driver doesn't support Exec")
+	}
+	for _, pragma := range []string{"PRAGMA foreign_keys = ON", "PRAGMA busy_timeout = 5000"} {
+		// The context of the connect is not passed on for the same reason as in ping
+		if _, err = execer.ExecContext(context.Background(), pragma, nil); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c sqliteConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// rebind replaces ? placeholders with numbered ones for PostgreSQL
+func rebind(driverName, query string) string {
+	if driverName != Postgres {
+		return query
+	}
+	var builder strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			builder.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		builder.WriteRune(r)
+	}
+	return builder.String()
+}
+
+// Placeholders returns n comma separated placeholders for an IN clause
+func Placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func (db *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.db.Exec(rebind(db.driver, query), args...)
+}
+
+func (db *DB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.db.Query(rebind(db.driver, query), args...)
+}
+
+func (db *DB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.db.QueryRow(rebind(db.driver, query), args...)
+}
+
+func (db *DB) Begin() (*Tx, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{tx: tx, driver: db.driver}, nil
+}
+
+// InTx runs f in a transaction, which is committed if f returns nil and rolled back otherwise
+func (db *DB) InTx(f func(tx *Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = f(tx); err != nil {
+		_ = tx.tx.Rollback()
+		return err
+	}
+	return tx.tx.Commit()
+}
+
+func (db *DB) Close() error {
+	return db.db.Close()
+}
+
+// InTx runs f in a savepoint of the transaction, so only the writes of f are rolled back if it fails
+func (tx *Tx) InTx(f func(tx *Tx) error) error {
+	tx.savepoints++
+	savepoint := "nested_" + strconv.Itoa(tx.savepoints)
+	if _, err := tx.tx.Exec("SAVEPOINT " + savepoint); err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		_, _ = tx.tx.Exec("ROLLBACK TO SAVEPOINT " + savepoint)
+		return err
+	}
+	_, err := tx.tx.Exec("RELEASE SAVEPOINT " + savepoint)
+	return err
+}
+
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.tx.Exec(rebind(tx.driver, query), args...)
+}
+
+func (tx *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.tx.Query(rebind(tx.driver, query), args...)
+}
+
+func (tx *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.tx.QueryRow(rebind(tx.driver, query), args...)
+}
+
+// Affected returns the number of rows changed by a statement executed with Exec
+func Affected(res sql.Result, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Nanos converts time to Unix nanoseconds.
+// Times are stored this way, so they compare the same way in every database.
+func Nanos(t time.Time) int64 {
+	return t.UnixNano()
+}
+
+func FromNanos(nanos int64) time.Time {
+	return time.Unix(0, nanos)
+}